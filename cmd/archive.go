@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github/ajanthan/smtp-go/pkg/archive"
+	"github/ajanthan/smtp-go/pkg/storage"
+	"os"
+	"strconv"
+)
+
+func init() {
+	client.AddCommand(archiveMails)
+	addArchiveFlags(serverCmd)
+	addArchiveFlags(archiveMails)
+	serverCmd.Flags().StringSliceVar(&archiveMatch, "archive-match", nil, "archive only the received mails having these Name:Value headers")
+	archiveMails.Flags().BoolVar(&archiveUnfinished, "unfinished", false, "archive the received mails whose upload failed or was cut off by a shutdown")
+}
+
+var archiveEndpoint, archiveRegion, archiveBucket, archivePrefix, archiveLayout string
+var archiveRetries int
+var archiveMatch []string
+var archiveUnfinished bool
+
+func addArchiveFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&archiveEndpoint, "archive-endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint the mails are archived to")
+	cmd.Flags().StringVar(&archiveRegion, "archive-region", "us-east-1", "region of the archive endpoint")
+	cmd.Flags().StringVar(&archiveBucket, "archive-bucket", "", "bucket the mails are archived to, archiving is off when empty")
+	cmd.Flags().StringVar(&archivePrefix, "archive-prefix", "", "prefix of the archived object keys")
+	cmd.Flags().StringVar(&archiveLayout, "archive-layout", archive.DefaultLayout, "template of the archived object keys, with .ID, .MessageID, .Sender, .Time, .Year, .Month and .Day")
+	cmd.Flags().IntVar(&archiveRetries, "archive-retries", 3, "retries of a failed upload")
+}
+
+// openArchiver returns the archiver configured by the flags, the credentials are read from
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func openArchiver() *archive.Archiver {
+	s3Client := &archive.S3Client{
+		Endpoint:  archiveEndpoint,
+		Region:    archiveRegion,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	archiver, err := archive.NewArchiver(s3Client, archiveBucket, archivePrefix, archiveLayout)
+	if err != nil {
+		fmt.Println("Unable to initialize the archiver,", err.Error())
+		os.Exit(1)
+	}
+	archiver.Retries = archiveRetries
+	return archiver
+}
+
+var archiveMails = &cobra.Command{
+	Use:   "archive [ID...]",
+	Short: "upload stored emails and their metadata to the S3 archive",
+	Run: func(cmd *cobra.Command, args []string) {
+		if archiveBucket == "" {
+			fmt.Println("--archive-bucket is required")
+			os.Exit(1)
+		}
+		if len(args) == 0 && !archiveUnfinished {
+			fmt.Println("mail ids or --unfinished are required")
+			os.Exit(1)
+		}
+		store := openStorage()
+		archiver := openArchiver()
+		var ids []uint
+		failed := false
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Println("invalid mail id,", arg)
+				failed = true
+				continue
+			}
+			ids = append(ids, uint(id))
+		}
+		if archiveUnfinished {
+			page, err := store.FindMails(storage.MailQuery{ArchiveStates: []string{storage.ArchivePending, storage.ArchiveFailed}})
+			if err != nil {
+				fmt.Println("Unable to get the emails to archive,", err.Error())
+				os.Exit(1)
+			}
+			for _, mail := range page.Mails {
+				ids = append(ids, mail.ID)
+			}
+		}
+		for _, id := range ids {
+			if err := archiveMail(store, archiver, id); err != nil {
+				fmt.Printf("Unable to archive mail %d, %s\n", id, err.Error())
+				failed = true
+				continue
+			}
+			fmt.Printf("archived mail %d\n", id)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func archiveMail(store storage.Storage, archiver *archive.Archiver, id uint) error {
+	mail, err := store.GetMail(id)
+	if err != nil {
+		return err
+	}
+	raw, err := store.GetRawByMailID(id)
+	if err != nil {
+		return err
+	}
+	headers, err := store.GetHeadersByMailID(id)
+	if err != nil {
+		return err
+	}
+	for i := range headers {
+		mail.Headers = append(mail.Headers, &headers[i])
+	}
+	state := storage.ArchiveDone
+	err = archiver.Archive(mail, raw)
+	if err != nil {
+		state = storage.ArchiveFailed
+	}
+	if stateErr := store.SetArchiveState(id, state); err == nil {
+		err = stateErr
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+func init() {
+	rootCmd.AddCommand(blob)
+	blob.AddCommand(collectBlobs)
+	collectBlobs.Flags().DurationVar(&blobGrace, "grace", time.Hour, "keep the blobs written this recently, a running server may not have committed their mails yet")
+}
+
+var blobGrace time.Duration
+
+var blob = &cobra.Command{
+	Use:   "blob",
+	Short: "admin the blob store given by --blob-dir",
+}
+
+var collectBlobs = &cobra.Command{
+	Use:   "gc",
+	Short: "remove the blobs no mail references",
+	Run: func(cmd *cobra.Command, args []string) {
+		if blobDir == "" {
+			fmt.Println("--blob-dir is required")
+			os.Exit(1)
+		}
+		removed, err := openDatabase().CollectBlobs(blobGrace)
+		if err != nil {
+			fmt.Println("Unable to collect blobs,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("removed %d unreferenced blobs\n", removed)
+	},
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github/ajanthan/smtp-go/pkg/certs"
+	"io/ioutil"
+	"os"
+)
+
+func init() {
+	rootCmd.AddCommand(certCmd)
+	certCmd.AddCommand(caCert)
+	certCmd.AddCommand(issueCert)
+	certCmd.PersistentFlags().StringVarP(&certDir, "dir", "d", "certs", "directory of the local CA and the issued certificates")
+	caCert.Flags().StringVarP(&caExportFile, "export", "e", "", "write the CA certificate to a file, - for stdout")
+	issueCert.Flags().StringSliceVarP(&certHostnames, "hostname", "n", []string{"localhost"}, "hostnames or IP addresses of the certificate")
+}
+
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "manage the local certificate authority",
+}
+
+var caCert = &cobra.Command{
+	Use:   "ca",
+	Short: "create the local CA if needed and export it for clients to trust",
+	Run: func(cmd *cobra.Command, args []string) {
+		authority := openAuthority()
+		if caExportFile == "-" {
+			fmt.Print(string(authority.CACertPEM()))
+			return
+		}
+		if caExportFile != "" {
+			if err := ioutil.WriteFile(caExportFile, authority.CACertPEM(), 0644); err != nil {
+				fmt.Println("Unable to export the CA,", err.Error())
+				os.Exit(1)
+			}
+		}
+		fmt.Printf("CA: %s\n", authority.Certificate.Subject.CommonName)
+		fmt.Printf("SHA-256 fingerprint: %s\n", authority.Fingerprint())
+		fmt.Printf("valid until: %s\n", authority.Certificate.NotAfter)
+	},
+}
+
+var issueCert = &cobra.Command{
+	Use:   "issue",
+	Short: "issue a server certificate signed by the local CA",
+	Run: func(cmd *cobra.Command, args []string) {
+		authority := openAuthority()
+		issued, err := authority.Issue(certHostnames...)
+		if err != nil {
+			fmt.Println("Unable to issue the certificate,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("issued a certificate for %v valid until %s in %s\n", certHostnames, issued.Leaf.NotAfter, certDir)
+	},
+}
+
+func openAuthority() *certs.Authority {
+	authority, err := certs.LoadOrCreateAuthority(certDir)
+	if err != nil {
+		fmt.Println("Unable to initialize the CA,", err.Error())
+		os.Exit(1)
+	}
+	return authority
+}
+
+var certDir string
+var caExportFile string
+var certHostnames []string
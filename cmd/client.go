@@ -6,9 +6,11 @@ import (
 	"github/ajanthan/smtp-go/pkg/smtp"
 	"github/ajanthan/smtp-go/pkg/storage"
 	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var serverAddress string
@@ -17,11 +19,55 @@ var subject string
 var recipient string
 var message string
 var file string
+var output string
+var sessionID string
+var listQuery storage.MailQuery
+var listAscending bool
+var listAfter, listBefore string
+var listHeaders []string
+var markFlags storage.MailFlags
 
 func init() {
 	rootCmd.AddCommand(client)
 	client.AddCommand(getMails)
 	client.AddCommand(sendMail)
+	client.AddCommand(getRawMail)
+	client.AddCommand(reparseMails)
+	client.AddCommand(getTranscript)
+	client.AddCommand(searchMails)
+	client.AddCommand(markMails)
+	client.AddCommand(getThreads)
+	getMails.Flags().IntVar(&listQuery.Limit, "limit", 20, "most mails listed, 0 lists all of them")
+	getMails.Flags().IntVar(&listQuery.Offset, "offset", 0, "mails skipped before the listing starts")
+	getMails.Flags().StringVar(&listQuery.Cursor, "cursor", "", "continue a listing from the cursor it printed")
+	getMails.Flags().StringVar(&listQuery.Sort, "sort", storage.SortReceived, "sort by received, subject or from")
+	getMails.Flags().BoolVar(&listAscending, "asc", false, "list in ascending order, newest or last first otherwise")
+	getMails.Flags().StringVar(&listQuery.From, "from", "", "list the mails whose sender contains this")
+	getMails.Flags().StringVar(&listQuery.To, "to", "", "list the mails whose recipients contain this")
+	getMails.Flags().StringVar(&listQuery.Subject, "subject", "", "list the mails whose subject contains this")
+	getMails.Flags().StringVar(&listAfter, "after", "", "list the mails received at or after this date, 2006-01-02 or RFC 3339")
+	getMails.Flags().StringVar(&listBefore, "before", "", "list the mails received before this date, 2006-01-02 or RFC 3339")
+	getMails.Flags().BoolVar(&listQuery.HasAttachment, "has-attachment", false, "list the mails with attachments")
+	getMails.Flags().StringVar(&listQuery.Mailbox, "mailbox", "", "list the mails of the user's mailbox")
+	getMails.Flags().StringSliceVar(&listHeaders, "header", nil, "list the mails having these Name:Value headers")
+	getMails.Flags().StringSliceVar(&listQuery.Tags, "tag", nil, "list the mails having all these tags")
+	getMails.Flags().BoolVar(&listQuery.Unseen, "unseen", false, "list the mails not marked as seen")
+	getMails.Flags().BoolVar(&listQuery.Starred, "starred", false, "list the starred mails")
+	getMails.Flags().BoolVar(&listQuery.Duplicated, "duplicated", false, "list the mails delivered more than once")
+	markMails.Flags().Bool("seen", false, "mark the mails as seen, --seen=false marks them as unseen")
+	markMails.Flags().Bool("starred", false, "star the mails, --starred=false removes the star")
+	markMails.Flags().Bool("trashed", false, "move the mails to the trash, the T flag of a Maildir, --trashed=false restores them")
+	markMails.Flags().StringSliceVar(&markFlags.AddTags, "tag", nil, "add these tags to the mails")
+	markMails.Flags().StringSliceVar(&markFlags.RemoveTags, "untag", nil, "remove these tags from the mails")
+	searchMails.Flags().IntVar(&listQuery.Limit, "limit", 20, "most mails listed, 0 lists all of them")
+	searchMails.Flags().IntVar(&listQuery.Offset, "offset", 0, "mails skipped before the listing starts")
+	searchMails.Flags().StringVar(&listQuery.Cursor, "cursor", "", "continue a listing from the cursor it printed")
+	searchMails.Flags().StringVar(&listQuery.Sort, "sort", storage.SortReceived, "sort by received, subject or from")
+	searchMails.Flags().BoolVar(&listAscending, "asc", false, "list in ascending order, newest or last first otherwise")
+	searchMails.Flags().StringVar(&listQuery.Mailbox, "mailbox", "", "search the mails of the user's mailbox")
+	getThreads.Flags().StringVar(&listQuery.Mailbox, "mailbox", "", "thread the mails of the user's mailbox")
+	getTranscript.Flags().StringVar(&sessionID, "session", "", "look the transcript up by session id instead of mail id")
+	getRawMail.Flags().StringVarP(&output, "output", "o", "", "file to write the .eml to, stdout when not given")
 	sendMail.Flags().StringVarP(&serverAddress, "address", "a", "127.0.0.1:10587", "address:smtpPort of the smtp server")
 	sendMail.Flags().StringVarP(&subject, "subject", "s", "", "subject of the email")
 	sendMail.Flags().StringVarP(&sender, "sender", "t", "", "email address of sender")
@@ -61,11 +107,7 @@ var getMails = &cobra.Command{
 	Use:   "get",
 	Short: "get all email",
 	Run: func(cmd *cobra.Command, args []string) {
-		store, err := storage.NewStorage("mail.db")
-		if err != nil {
-			fmt.Println("Unable to initialize storage,", err.Error())
-			os.Exit(1)
-		}
+		store := openStorage()
 		if len(args) > 0 {
 			fmt.Println("getting an email content...")
 			id, err := strconv.Atoi(args[0])
@@ -80,40 +122,278 @@ var getMails = &cobra.Command{
 			}
 			fmt.Printf("Message:%s", string(body.Data))
 		} else {
-			fmt.Println("getting all emails...")
-			emails, err := store.GetAll()
+			query, err := listMailQuery()
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			page, err := store.FindMails(query)
+			if err != nil {
+				fmt.Printf("Unable to get the emails: %s\n", err.Error())
+				os.Exit(1)
+			}
+			printMails(page)
+		}
+	},
+}
+
+var searchMails = &cobra.Command{
+	Use:   "search QUERY...",
+	Short: "search the emails",
+	Long: `search the emails by words or "quoted phrases" found in the subject, the addresses, the text bodies
+or the attachment names, narrowed by from:, to:, subject:, has:attachment, tag:, is:unseen, is:starred,
+is:duplicate, before:DATE and after:DATE`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		query := listQuery
+		query.Descending = !listAscending
+		if err := storage.ParseSearchQuery(strings.Join(args, " "), &query); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		page, err := store.FindMails(query)
+		if err != nil {
+			fmt.Printf("Unable to search the emails: %s\n", err.Error())
+			os.Exit(1)
+		}
+		printMails(page)
+	},
+}
+
+var markMails = &cobra.Command{
+	Use:   "mark ID...",
+	Short: "change the read state, the star, the trash mark and the tags of emails",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := markFlags
+		if cmd.Flags().Changed("seen") {
+			seen, _ := cmd.Flags().GetBool("seen")
+			flags.Seen = &seen
+		}
+		if cmd.Flags().Changed("starred") {
+			starred, _ := cmd.Flags().GetBool("starred")
+			flags.Starred = &starred
+		}
+		if cmd.Flags().Changed("trashed") {
+			trashed, _ := cmd.Flags().GetBool("trashed")
+			flags.Trashed = &trashed
+		}
+		store := openStorage()
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
 			if err != nil {
-				fmt.Printf("Unable to get all the emails: %s\n", err.Error())
+				fmt.Println("invalid mail id,", arg)
+				os.Exit(1)
 			}
+			mail, err := store.UpdateFlags(uint(id), flags)
+			if err != nil {
+				fmt.Println("Unable to mark the email,", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("%d seen=%t starred=%t trashed=%t tags=%s\n", mail.ID, mail.Seen, mail.Starred, mail.Trashed, strings.Join(mail.Tags, ","))
+		}
+	},
+}
 
-			printDivider()
-			fmt.Printf("|%-3s|", "ID")
-			fmt.Printf("%-20s|", "TO")
-			fmt.Printf("%-30s|", "FROM")
-			fmt.Printf("%-40s|", "SUBJECT")
-			fmt.Printf("%-40s|\n", "URL")
-			for _, email := range emails {
-				printDivider()
-				fmt.Printf("|%-3d|", email.ID)
-				if len(email.To[0]) > 20 {
-					fmt.Printf("%-20s..|", email.To[0][0:18])
-				} else {
-					fmt.Printf("%-20s|", email.To[0])
-				}
-				if len(email.From) > 30 {
-					fmt.Printf("%-30s..|", email.From[0:28])
-				} else {
-					fmt.Printf("%-30s|", email.From)
-				}
-				if len(email.Subject) > 40 {
-					fmt.Printf("%-40s..|", email.Subject[0:38])
-				} else {
-					fmt.Printf("%-40s|", email.Subject)
-				}
-				fmt.Printf("%-40v|\n", " http://localhost:8085/mail/"+strconv.Itoa(int(email.ID))+"/content")
+var getThreads = &cobra.Command{
+	Use:   "threads [ID]",
+	Short: "list the conversations, or print the one an email belongs to",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		if len(args) == 1 {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Println("invalid mail id,", args[0])
+				os.Exit(1)
 			}
-			printDivider()
+			thread, err := storage.GetThread(store, uint(id), listQuery.Mailbox)
+			if err != nil {
+				fmt.Println("Unable to find the thread of mail", args[0])
+				os.Exit(1)
+			}
+			printThreadNode(thread.Root, 0)
+			return
+		}
+		page, err := store.FindThreads(storage.MailQuery{Mailbox: listQuery.Mailbox})
+		if err != nil {
+			fmt.Printf("Unable to get the emails: %s\n", err.Error())
+			os.Exit(1)
+		}
+		threads := page.Threads
+		for _, thread := range threads {
+			fmt.Printf("%-4d %3d messages  %s  %s\n", threadMailID(thread.Root), thread.Messages,
+				thread.LastReceived.Format(time.RFC3339), thread.Subject)
+		}
+		fmt.Printf("%d threads\n", len(threads))
+	},
+}
+
+// threadMailID returns the ID of the root mail, or of its first reply when the root was not received.
+func threadMailID(node *storage.ThreadNode) uint {
+	for node.Mail == nil && len(node.Replies) > 0 {
+		node = node.Replies[0]
+	}
+	if node.Mail == nil {
+		return 0
+	}
+	return node.Mail.ID
+}
+
+func printThreadNode(node *storage.ThreadNode, depth int) {
+	indent := strings.Repeat("  ", depth)
+	if node.Mail == nil {
+		fmt.Printf("%s- <%s> (not received)\n", indent, node.MessageID)
+	} else {
+		fmt.Printf("%s- %d %s: %s\n", indent, node.Mail.ID, node.Mail.From, node.Mail.Subject)
+	}
+	for _, reply := range node.Replies {
+		printThreadNode(reply, depth+1)
+	}
+}
+
+func printMails(page *storage.MailPage) {
+	emails := page.Mails
+	printDivider()
+	fmt.Printf("|%-3s|", "ID")
+	fmt.Printf("%-20s|", "TO")
+	fmt.Printf("%-30s|", "FROM")
+	fmt.Printf("%-40s|", "SUBJECT")
+	fmt.Printf("%-40s|\n", "URL")
+	for _, email := range emails {
+		printDivider()
+		fmt.Printf("|%-3d|", email.ID)
+		to := ""
+		if len(email.To) > 0 {
+			to = email.To[0]
+		}
+		if len(to) > 20 {
+			fmt.Printf("%-20s..|", to[0:18])
+		} else {
+			fmt.Printf("%-20s|", to)
+		}
+		if len(email.From) > 30 {
+			fmt.Printf("%-30s..|", email.From[0:28])
+		} else {
+			fmt.Printf("%-30s|", email.From)
+		}
+		if len(email.Subject) > 40 {
+			fmt.Printf("%-40s..|", email.Subject[0:38])
+		} else {
+			fmt.Printf("%-40s|", email.Subject)
+		}
+		fmt.Printf("%-40v|\n", " http://localhost:8085/mail/"+strconv.Itoa(int(email.ID))+"/content")
+	}
+	printDivider()
+	fmt.Printf("%d of %d emails\n", len(emails), page.Total)
+	if page.NextCursor != "" {
+		fmt.Printf("next page: --cursor %s\n", page.NextCursor)
+	}
+}
+
+func listMailQuery() (storage.MailQuery, error) {
+	query := listQuery
+	query.Descending = !listAscending
+	for _, header := range listHeaders {
+		query.Filters = append(query.Filters, storage.ParseHeaderFilter(header))
+	}
+	var err error
+	if listAfter != "" {
+		if query.After, err = storage.ParseDate(listAfter); err != nil {
+			return query, err
+		}
+	}
+	if listBefore != "" {
+		if query.Before, err = storage.ParseDate(listBefore); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+var getRawMail = &cobra.Command{
+	Use:   "raw ID",
+	Short: "download the original message of an email as .eml",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Println("invalid mail id,", args[0])
+			os.Exit(1)
+		}
+		raw, err := store.GetRawByMailID(uint(id))
+		if err != nil {
+			fmt.Println("Unable to get the raw message,", err.Error())
+			os.Exit(1)
+		}
+		if output == "" {
+			os.Stdout.Write(raw)
+			return
+		}
+		if err := ioutil.WriteFile(output, raw, 0644); err != nil {
+			fmt.Println("Unable to write the raw message,", err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+var reparseMails = &cobra.Command{
+	Use:   "reparse ID...",
+	Short: "parse stored emails again from their original message",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		failed := false
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Println("invalid mail id,", arg)
+				failed = true
+				continue
+			}
+			if err := store.Reparse(uint(id)); err != nil {
+				fmt.Printf("Unable to reparse mail %d, %s\n", id, err.Error())
+				failed = true
+				continue
+			}
+			fmt.Printf("reparsed mail %d\n", id)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var getTranscript = &cobra.Command{
+	Use:   "transcript [ID]",
+	Short: "print the SMTP session transcript of an email",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		var transcript *storage.Transcript
+		var err error
+		if sessionID != "" {
+			transcript, err = store.GetTranscriptBySessionID(sessionID)
+		} else if len(args) == 1 {
+			var id int
+			id, err = strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Println("invalid mail id,", args[0])
+				os.Exit(1)
+			}
+			transcript, err = store.GetTranscriptByMailID(uint(id))
+		} else {
+			fmt.Println("a mail id or --session is required")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Println("Unable to get the transcript,", err.Error())
+			os.Exit(1)
 		}
+		fmt.Printf("session %s from %s at %s\n", transcript.SessionID, transcript.ClientAddress, transcript.StartedAt.Format(time.RFC3339))
+		fmt.Print(transcript.ToSMTP())
 	},
 }
 
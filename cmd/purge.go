@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github/ajanthan/smtp-go/pkg/storage"
+	"os"
+	"time"
+)
+
+func init() {
+	rootCmd.AddCommand(purge)
+	addRetentionFlags(purge)
+	addRetentionFlags(serverCmd)
+	purge.Flags().BoolVar(&purgeAll, "all", false, "delete every mail")
+	purge.Flags().StringSliceVar(&purgeHeaders, "header", nil, "delete the mails having these Name:Value headers")
+	serverCmd.Flags().DurationVar(&retentionInterval, "retention-interval", time.Hour, "how often the retention limits are enforced")
+}
+
+var retention storage.RetentionPolicy
+var retentionInterval time.Duration
+var purgeAll bool
+var purgeHeaders []string
+
+func addRetentionFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&retention.MaxAge, "max-age", 0, "delete the mails older than this, like 720h")
+	cmd.Flags().IntVar(&retention.MaxMails, "max-mails", 0, "most mails kept, the oldest are deleted first")
+	cmd.Flags().Int64Var(&retention.MaxSize, "max-size", 0, "most bytes the storage takes, the database with the --blob-dir files or the maildir, the oldest mails are deleted first")
+	cmd.Flags().IntVar(&retention.MaxMailsPerMailbox, "max-mails-per-mailbox", 0, "most mails kept per user mailbox")
+}
+
+// checkRetentionInterval exits when the janitor of the server could not be scheduled.
+func checkRetentionInterval() {
+	if retentionInterval <= 0 {
+		fmt.Println("--retention-interval must be positive")
+		os.Exit(1)
+	}
+}
+
+var purge = &cobra.Command{
+	Use:   "purge",
+	Short: "delete mails by header, all of them or those beyond the retention limits, and compact the storage",
+	Run: func(cmd *cobra.Command, args []string) {
+		var filters []storage.HeaderFilter
+		for _, header := range purgeHeaders {
+			filters = append(filters, storage.ParseHeaderFilter(header))
+		}
+		if !purgeAll && len(filters) == 0 && retention.IsZero() {
+			fmt.Println("give --all, --header or a retention limit")
+			os.Exit(1)
+		}
+		if (purgeAll || len(filters) > 0) && !retention.IsZero() {
+			fmt.Println("retention limits can not be combined with --all or --header")
+			os.Exit(1)
+		}
+		store := openStorage()
+		var deleted int
+		var err error
+		if purgeAll || len(filters) > 0 {
+			deleted, err = store.DeleteAll(filters...)
+		} else {
+			deleted, err = storage.Purge(store, retention)
+		}
+		if err != nil {
+			fmt.Printf("Unable to purge the mails, %s (%d deleted)\n", err.Error(), deleted)
+			os.Exit(1)
+		}
+		if err := store.Compact(); err != nil {
+			fmt.Println("Unable to compact the storage,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("deleted %d mails\n", deleted)
+	},
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"github/ajanthan/smtp-go/pkg/storage"
 	"os"
 )
 
@@ -17,3 +18,76 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&databaseDSN, "db", databaseDSN, "SQLite database file or PostgreSQL DSN (postgres://... or key=value pairs)")
+	rootCmd.PersistentFlags().StringVar(&blobDir, "blob-dir", "", "directory keeping large bodies and attachments out of the database, deduplicated by SHA-256")
+	rootCmd.PersistentFlags().IntVar(&blobThreshold, "blob-threshold", 64*1024, "size in bytes above which a body or attachment is kept in --blob-dir")
+	rootCmd.PersistentFlags().StringVar(&storageBackend, "storage", storageBackend, "storage backend, sqlite (the --db database, SQLite or PostgreSQL), memory (only kept by a running server) or maildir")
+	rootCmd.PersistentFlags().StringVar(&maildirRoot, "maildir", maildirRoot, "directory of the maildir storage")
+	rootCmd.PersistentFlags().BoolVar(&maildirPerRecipient, "maildir-per-recipient", false, "deliver into a maildir per recipient under the maildir directory")
+}
+
+var databaseDSN = "mail.db"
+var databasePool storage.PoolConfig
+var blobDir string
+var blobThreshold int
+var storageBackend = "sqlite"
+var memoryMaxMails int
+var memoryMaxBytes int
+var maildirRoot = "maildir"
+var maildirPerRecipient bool
+
+// openStorage opens the storage given by --storage for the commands working on stored mails and users,
+// which the memory storage of a running server is not shared with.
+func openStorage() storage.Storage {
+	if storageBackend == "memory" {
+		fmt.Println("The memory storage is only kept by a running server, use --storage sqlite or maildir")
+		os.Exit(1)
+	}
+	return openBackend()
+}
+
+// openBackend opens the storage given by --storage.
+func openBackend() storage.Storage {
+	switch storageBackend {
+	case "sqlite", "db":
+		return openDatabase()
+	case "memory":
+		return storage.NewMemoryStorage(memoryMaxMails, memoryMaxBytes)
+	case "maildir":
+		store, err := storage.NewMaildirStorage(maildirRoot, maildirPerRecipient, openDatabase())
+		if err != nil {
+			fmt.Println("Unable to initialize maildir storage,", err.Error())
+			os.Exit(1)
+		}
+		return store
+	default:
+		fmt.Println("Unknown storage backend,", storageBackend)
+		os.Exit(1)
+		return nil
+	}
+}
+
+// openDatabase opens the database given by --db, PostgreSQL for a DSN and SQLite for a file.
+func openDatabase() *storage.GormStorage {
+	var store *storage.GormStorage
+	var err error
+	if storage.IsPostgresDSN(databaseDSN) {
+		store, err = storage.NewPostgresStorage(databaseDSN, databasePool)
+	} else {
+		store, err = storage.NewStorage(databaseDSN)
+	}
+	if err != nil {
+		fmt.Println("Unable to initialize storage,", err.Error())
+		os.Exit(1)
+	}
+	if blobDir != "" {
+		store.Blobs, err = storage.NewBlobStore(blobDir, blobThreshold)
+		if err != nil {
+			fmt.Println("Unable to initialize blob store,", err.Error())
+			os.Exit(1)
+		}
+	}
+	return store
+}
@@ -5,32 +5,55 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"github/ajanthan/smtp-go/pkg/api"
+	"github/ajanthan/smtp-go/pkg/certs"
 	"github/ajanthan/smtp-go/pkg/http"
 	"github/ajanthan/smtp-go/pkg/smtp"
 	"github/ajanthan/smtp-go/pkg/storage"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
 	serverCmd.Flags().StringVarP(&ip, "address", "a", "127.0.0.1", "ip address of the smtp server")
-	serverCmd.Flags().StringVarP(&pubKey, "certificate", "c", "", "public certificate of the server")
+	serverCmd.Flags().StringVarP(&pubKey, "certificate", "c", "", "public certificate of the server, reloaded when it changes or on SIGHUP")
 	serverCmd.Flags().StringVarP(&privateKey, "key", "k", "", "private key of the server")
 	serverCmd.Flags().IntVarP(&smtpPort, "smtpPort", "m", 10587, "smtpPort of the smtp server")
 	serverCmd.Flags().IntVarP(&httpPort, "httpPort", "u", 8085, "httpPort of the http server")
-	serverCmd.Flags().BoolVarP(&secured, "secured", "s", false, "secure the SMTP communication")
+	serverCmd.Flags().BoolVarP(&secured, "secured", "s", false, "secure the SMTP communication and require credentials for the API")
+	serverCmd.Flags().BoolVarP(&bindSender, "bind-sender", "b", false, "restrict authenticated users to their own sender addresses")
+	serverCmd.Flags().BoolVar(&deliveredTo, "delivered-to", false, "stamp a Delivered-To header per recipient")
+	serverCmd.Flags().IntVar(&memoryMaxMails, "memory-max-mails", 0, "most mails kept by the memory storage, least recently used are evicted")
+	serverCmd.Flags().IntVar(&memoryMaxBytes, "memory-max-bytes", 0, "most message bytes kept by the memory storage")
+	serverCmd.Flags().IntVar(&databasePool.MaxOpenConns, "db-max-open-conns", 20, "most open connections to a PostgreSQL database")
+	serverCmd.Flags().IntVar(&databasePool.MaxIdleConns, "db-max-idle-conns", 5, "most idle connections kept to a PostgreSQL database")
+	serverCmd.Flags().DurationVar(&databasePool.ConnMaxLifetime, "db-conn-max-lifetime", 30*time.Minute, "longest time a PostgreSQL connection is reused")
+	serverCmd.Flags().StringArrayVar(&tagRules, "tag-rule", nil, "tag the received mails, TAG=CONDITION[,CONDITION...] with to-domain:, from-domain:, subject: and header: conditions")
+	serverCmd.Flags().DurationVar(&dedupeWindow, "dedupe-window", 0, "count a message received again within this time as a duplicate instead of storing it twice, e.g. 10m")
+	serverCmd.Flags().BoolVar(&recordTranscripts, "transcripts", false, "record the full SMTP conversation of every session")
+	serverCmd.Flags().BoolVar(&requireTLS, "require-tls", false, "refuse MAIL before STARTTLS")
+	serverCmd.Flags().StringVar(&tlsMinVersion, "tls-min-version", "", "minimum TLS version accepted for STARTTLS (1.0, 1.1, 1.2 or 1.3)")
+	serverCmd.Flags().StringSliceVar(&tlsCipherSuites, "tls-ciphers", nil, "cipher suites accepted for TLS 1.2 and below")
+	serverCmd.Flags().BoolVar(&requestClientCert, "tls-request-client-cert", false, "ask STARTTLS clients for a certificate and record it")
+	serverCmd.Flags().BoolVar(&autoTLS, "auto-tls", false, "serve certificates issued by the local CA")
+	serverCmd.Flags().StringVar(&certDir, "cert-dir", "certs", "directory of the local CA used by --auto-tls")
+	serverCmd.Flags().StringSliceVar(&certHostnames, "hostname", []string{"localhost"}, "hostnames served by --auto-tls, selected by SNI")
 }
 
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "server starts a smtp server on a network interface and smtpPort",
 	Run: func(cmd *cobra.Command, args []string) {
-		store, err := storage.NewStorage("mail.db")
-		if err != nil {
-			fmt.Println("Unable to initialize storage,", err.Error())
+		var err error
+		if storageBackend == "memory" && secured {
+			// users are added by the user command, which can not reach the memory of the server
+			fmt.Println("--secured needs users, which the memory storage has none of, use --storage sqlite or maildir")
 			os.Exit(1)
 		}
-		apiHandler := &api.MailAPI{Storage: *store}
+		store := openBackend()
+		apiHandler := &api.MailAPI{Storage: store, RequireAuth: secured}
 		httpServer := &http.Server{
 			Address:  ip,
 			HTTPPort: httpPort,
@@ -43,27 +66,98 @@ var serverCmd = &cobra.Command{
 				os.Exit(1)
 			}
 		}()
+		if !retention.IsZero() {
+			checkRetentionInterval()
+			janitor := &storage.Janitor{Storage: store, Policy: retention, Interval: retentionInterval}
+			go janitor.Run(nil)
+		}
+		receiver := &storage.DBReceiver{
+			Storage:      store,
+			DedupeWindow: dedupeWindow,
+		}
+		for _, rule := range tagRules {
+			parsed, err := storage.ParseTagRule(rule)
+			if err != nil {
+				fmt.Println("Invalid tag rule,", err.Error())
+				os.Exit(1)
+			}
+			receiver.TagRules = append(receiver.TagRules, parsed)
+		}
+		if archiveBucket != "" {
+			receiver.Archiver = openArchiver()
+			for _, match := range archiveMatch {
+				receiver.ArchiveFilters = append(receiver.ArchiveFilters, storage.ParseHeaderFilter(match))
+			}
+		}
 		smtpServer := &smtp.Server{
-			Address:  ip,
-			SMTPPort: smtpPort,
-			Receiver: &storage.DBReceiver{
-				Storage: store,
-			},
+			Address:     ip,
+			SMTPPort:    smtpPort,
+			DeliveredTo: deliveredTo,
+			Receiver:    receiver,
+			// failed sessions are always kept, they are the only trace of mails that never arrived
+			SessionRecorder: receiver,
+		}
+		if recordTranscripts {
+			smtpServer.TranscriptReceiver = receiver
 		}
 		if pubKey != "" && privateKey != "" {
-			cert, err := tls.LoadX509KeyPair(pubKey, privateKey)
+			reloader, err := certs.NewKeyPairReloader(pubKey, privateKey)
 			if err != nil {
 				fmt.Println("Unable load certificate,", err.Error())
 				os.Exit(1)
 			}
-			smtpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			go func() {
+				if err := reloader.Watch(nil); err != nil {
+					fmt.Println("Unable to watch the certificate,", err.Error())
+				}
+			}()
+			smtpServer.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		} else if autoTLS {
+			authority := openAuthority()
+			authority.Hostnames = certHostnames
+			smtpServer.TLSConfig, err = authority.TLSConfig()
+			if err != nil {
+				fmt.Println("Unable to issue certificates,", err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("serving certificates of the local CA %s (SHA-256 %s)\n", authority.Certificate.Subject.CommonName, authority.Fingerprint())
+		}
+		if requestClientCert && smtpServer.TLSConfig != nil {
+			smtpServer.TLSConfig.ClientAuth = tls.RequestClientCert
+		}
+		if requireTLS && smtpServer.TLSConfig == nil {
+			fmt.Println("--require-tls needs a certificate and key")
+			os.Exit(1)
+		}
+		smtpServer.TLSRequired = requireTLS
+		if tlsMinVersion != "" {
+			smtpServer.MinTLSVersion, err = smtp.ParseTLSVersion(tlsMinVersion)
+			if err != nil {
+				fmt.Println("Invalid TLS version,", err.Error())
+				os.Exit(1)
+			}
+		}
+		if len(tlsCipherSuites) > 0 {
+			smtpServer.CipherSuites, err = smtp.ParseCipherSuites(tlsCipherSuites)
+			if err != nil {
+				fmt.Println("Invalid cipher suites,", err.Error())
+				os.Exit(1)
+			}
 		}
 		if secured {
 			smtpServer.AuthService = store
 			smtpServer.Secure = secured
+			if bindSender {
+				smtpServer.SenderPolicy = store
+			}
 		}
 		fmt.Printf("starting a smtp server on %s:%d\n", ip, smtpPort)
-		smtpServer.Start()
+		go smtpServer.Start()
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		fmt.Println("stopping, waiting for the uploads to the archive in progress")
+		receiver.WaitArchives()
 	},
 }
 
@@ -73,3 +167,13 @@ var httpPort int
 var pubKey string
 var privateKey string
 var secured bool
+var bindSender bool
+var requireTLS bool
+var deliveredTo bool
+var recordTranscripts bool
+var tlsMinVersion string
+var tlsCipherSuites []string
+var autoTLS bool
+var requestClientCert bool
+var tagRules []string
+var dedupeWindow time.Duration
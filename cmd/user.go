@@ -1,17 +1,29 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
-	"github/ajanthan/smtp-go/pkg/storage"
+	"golang.org/x/term"
 	"os"
+	"strings"
 )
 
 func init() {
 	rootCmd.AddCommand(user)
 	user.AddCommand(addUser)
+	user.AddCommand(listUsers)
+	user.AddCommand(deleteUser)
+	user.AddCommand(changePassword)
+	user.AddCommand(disableUser)
+	user.AddCommand(enableUser)
 	addUser.Flags().StringVarP(&username, "username", "u", "", "username for the user")
-	addUser.Flags().StringVarP(&password, "password", "p", "", "password for the user")
+	addUser.Flags().StringVarP(&password, "password", "p", "", "password for the user, prompted when not given")
+	addUser.Flags().BoolVar(&passwordStdin, "password-stdin", false, "read the password from stdin")
+	addUser.Flags().StringSliceVarP(&addresses, "address", "a", nil, "sender address or @domain bound to the user")
+	changePassword.Flags().BoolVar(&passwordStdin, "password-stdin", false, "read the password from stdin")
 }
 
 var user = &cobra.Command{
@@ -22,19 +34,154 @@ var addUser = &cobra.Command{
 	Use:   "add",
 	Short: "add a user",
 	Run: func(cmd *cobra.Command, args []string) {
-		store, err := storage.NewStorage("mail.db")
-		if err != nil {
-			fmt.Println("Unable to initialize storage,", err.Error())
+		store := openStorage()
+		if username == "" {
+			fmt.Println("username is required")
 			os.Exit(1)
 		}
-		hmacSecret, err := store.AddUser(username, []byte(password))
+		secret := []byte(password)
+		if password == "" {
+			var err error
+			secret, err = readPassword()
+			if err != nil {
+				fmt.Println("Unable to read the password,", err.Error())
+				os.Exit(1)
+			}
+		}
+		err := store.AddUser(username, secret)
 		if err != nil {
 			fmt.Println("Unable to add user,", err.Error())
 			os.Exit(1)
 		}
+		if len(addresses) > 0 {
+			err = store.SetUserAddresses(username, addresses)
+			if err != nil {
+				fmt.Println("Unable to bind sender addresses,", err.Error())
+				os.Exit(1)
+			}
+		}
 		fmt.Println("added the user successfully")
-		fmt.Printf("HMAC secret: %s", hmacSecret)
 	},
 }
 
+var listUsers = &cobra.Command{
+	Use:   "list",
+	Short: "list all users",
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		users, err := store.ListUsers()
+		if err != nil {
+			fmt.Println("Unable to list users,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%-30s %-9s %-20s %s\n", "USERNAME", "STATUS", "CREATED", "ADDRESSES")
+		for _, u := range users {
+			status := "active"
+			if u.Disabled {
+				status = "disabled"
+			}
+			fmt.Printf("%-30s %-9s %-20s %s\n", u.Username, status, u.CreatedAt.Format("2006-01-02 15:04:05"), strings.Join(u.Addresses, ","))
+		}
+	},
+}
+
+var deleteUser = &cobra.Command{
+	Use:   "delete USERNAME",
+	Short: "delete a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		if err := store.DeleteUser(args[0]); err != nil {
+			fmt.Println("Unable to delete user,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("deleted the user successfully")
+	},
+}
+
+var changePassword = &cobra.Command{
+	Use:   "passwd USERNAME",
+	Short: "change the password of a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		secret, err := readPassword()
+		if err != nil {
+			fmt.Println("Unable to read the password,", err.Error())
+			os.Exit(1)
+		}
+		if err := store.SetPassword(args[0], secret); err != nil {
+			fmt.Println("Unable to change the password,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("changed the password successfully")
+	},
+}
+
+var disableUser = &cobra.Command{
+	Use:   "disable USERNAME",
+	Short: "disable a user without deleting it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		if err := store.SetUserDisabled(args[0], true); err != nil {
+			fmt.Println("Unable to disable user,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("disabled the user successfully")
+	},
+}
+
+var enableUser = &cobra.Command{
+	Use:   "enable USERNAME",
+	Short: "enable a disabled user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openStorage()
+		if err := store.SetUserDisabled(args[0], false); err != nil {
+			fmt.Println("Unable to enable user,", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("enabled the user successfully")
+	},
+}
+
+// readPassword reads the password from stdin when --password-stdin is set or stdin is not a terminal,
+// otherwise it prompts for the password twice without echoing it.
+func readPassword() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if passwordStdin || !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		secret := strings.TrimRight(line, "\r\n")
+		if secret == "" {
+			return nil, errors.New("empty password")
+		}
+		return []byte(secret), nil
+	}
+	fmt.Print("Password: ")
+	secret, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("Retype password: ")
+	confirmation, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty password")
+	}
+	if !bytes.Equal(secret, confirmation) {
+		return nil, errors.New("passwords do not match")
+	}
+	return secret, nil
+}
+
 var username, password string
+var passwordStdin bool
+var addresses []string
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github/ajanthan/smtp-go/pkg/storage"
 	"html/template"
@@ -9,26 +10,144 @@ import (
 	"strings"
 )
 
+const userKey = "username"
+
+// defaultPageSize and maxPageSize bound the mails listed at once.
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 type MailAPI struct {
-	Storage storage.SQLiteStorage
+	Storage storage.Storage
+	// RequireAuth rejects the callers without credentials even before any user is added.
+	RequireAuth bool
+}
+
+// Authenticate resolves HTTP basic credentials to a storage user, authenticated callers only see their
+// own mailbox. Callers without credentials have access to every mail as long as no user exists and
+// RequireAuth is not set, they are rejected otherwise so that the mailboxes stay apart.
+func (m MailAPI) Authenticate(context *gin.Context) {
+	username, password, ok := context.Request.BasicAuth()
+	if !ok {
+		required := m.RequireAuth
+		if !required {
+			hasUsers, err := m.Storage.HasUsers()
+			if err != nil {
+				context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+				return
+			}
+			required = hasUsers
+		}
+		if required {
+			context.Header("WWW-Authenticate", `Basic realm="smtp-go"`)
+			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Message": "credential required"})
+			return
+		}
+		context.Next()
+		return
+	}
+	if err := m.Storage.Authenticate(username, []byte(password)); err != nil {
+		context.Header("WWW-Authenticate", `Basic realm="smtp-go"`)
+		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Message": "invalid credential"})
+		return
+	}
+	context.Set(userKey, username)
+	context.Next()
 }
 
+// HandleGetAllMails lists a page of the mails, newest first. The query parameters filter them:
+// header=Name:Value (repeatable), from, to and subject (contained), after and before (RFC 3339 or 2006-01-02),
+// has_attachment=true, tag (repeatable), unseen=true, starred=true, duplicated=true and mailbox; sort=received|subject|from with order=asc|desc, and limit with offset or
+// cursor page them. The X-Total-Count header counts the matching mails and X-Next-Cursor continues the listing.
 func (m MailAPI) HandleGetAllMails(context *gin.Context) {
-	mails, err := m.Storage.GetAll()
+	query, err := mailQuery(context)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+		context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
 		return
 	}
-	context.JSON(http.StatusOK, mails)
+	m.respondMails(context, query)
 }
-func (m MailAPI) HandleGetMailByID(context *gin.Context) {
-	mailIDStr := context.Param("mailID")
-	mailID, err := strconv.Atoi(mailIDStr)
+
+// HandleSearchMails lists a page of the mails matching the search in the q parameter, such as
+// "password reset from:shop.test has:attachment after:2021-01-01", see storage.ParseSearchQuery.
+// It takes the other parameters of HandleGetAllMails too.
+func (m MailAPI) HandleSearchMails(context *gin.Context) {
+	query, err := mailQuery(context)
+	if err == nil {
+		err = storage.ParseSearchQuery(context.Query("q"), &query)
+	}
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+		return
+	}
+	m.respondMails(context, query)
+}
+
+// respondMails writes the page of mails with its total count and next cursor, in the mailbox of an authenticated user.
+func (m MailAPI) respondMails(context *gin.Context, query storage.MailQuery) {
+	if username := context.GetString(userKey); username != "" {
+		query.Mailbox = username
+	}
+	page, err := m.Storage.FindMails(query)
 	if err != nil {
 		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
 		return
 	}
-	body, err := m.Storage.GetBodyByMailID(uint(mailID))
+	context.Header("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		context.Header("X-Next-Cursor", page.NextCursor)
+	}
+	context.JSON(http.StatusOK, page.Mails)
+}
+
+func mailQuery(context *gin.Context) (storage.MailQuery, error) {
+	query := storage.MailQuery{
+		Filters:       headerFilters(context),
+		From:          context.Query("from"),
+		To:            context.Query("to"),
+		Subject:       context.Query("subject"),
+		HasAttachment: context.Query("has_attachment") == "true",
+		Tags:          context.QueryArray("tag"),
+		Unseen:        context.Query("unseen") == "true",
+		Starred:       context.Query("starred") == "true",
+		Duplicated:    context.Query("duplicated") == "true",
+		Mailbox:       context.Query("mailbox"),
+		Sort:          context.Query("sort"),
+		Descending:    context.DefaultQuery("order", "desc") == "desc",
+		Cursor:        context.Query("cursor"),
+		Limit:         defaultPageSize,
+	}
+	var err error
+	if value := context.Query("after"); value != "" {
+		if query.After, err = storage.ParseDate(value); err != nil {
+			return query, err
+		}
+	}
+	if value := context.Query("before"); value != "" {
+		if query.Before, err = storage.ParseDate(value); err != nil {
+			return query, err
+		}
+	}
+	if value := context.Query("offset"); value != "" {
+		if query.Offset, err = strconv.Atoi(value); err != nil {
+			return query, fmt.Errorf("invalid offset %q", value)
+		}
+	}
+	if value := context.Query("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit < 1 || query.Limit > maxPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	return query, nil
+}
+
+func (m MailAPI) HandleGetMailByID(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	body, err := m.Storage.GetBodyByMailID(mailID)
 	if err != nil {
 		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
 		return
@@ -40,3 +159,201 @@ func (m MailAPI) HandleGetMailByID(context *gin.Context) {
 		context.String(http.StatusOK, string(body.Data))
 	}
 }
+
+func (m MailAPI) HandleGetMail(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	mail, err := m.Storage.GetMail(mailID)
+	if err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"Message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, mail)
+}
+
+func (m MailAPI) HandleGetMailAttachments(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	attachments, err := m.Storage.GetAttachmentsByMailID(mailID)
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, attachments)
+}
+
+// HandleGetRawMail serves the original message source as an .eml download.
+func (m MailAPI) HandleGetRawMail(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	raw, err := m.Storage.GetRawByMailID(mailID)
+	if err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"Message": err.Error()})
+		return
+	}
+	context.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="mail-%d.eml"`, mailID))
+	context.Data(http.StatusOK, "message/rfc822", raw)
+}
+
+// HandleGetMailHeaders returns every header field of the mail in message order.
+func (m MailAPI) HandleGetMailHeaders(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	headers, err := m.Storage.GetHeadersByMailID(mailID)
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, headers)
+}
+
+// HandleGetMailTranscript returns the SMTP conversation the mail was received in, when it was recorded.
+func (m MailAPI) HandleGetMailTranscript(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	transcript, err := m.Storage.GetTranscriptByMailID(mailID)
+	if err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"Message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, transcript)
+}
+
+// HandlePatchMail changes the flags of a mail: {"Seen":true,"Starred":false,"Trashed":true,"AddTags":["todo"]}, see
+// storage.MailFlags, and returns the mail.
+func (m MailAPI) HandlePatchMail(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	var flags storage.MailFlags
+	if err := context.ShouldBindJSON(&flags); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+		return
+	}
+	if _, err := m.Storage.GetMail(mailID); err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"Message": err.Error()})
+		return
+	}
+	mail, err := m.Storage.UpdateFlags(mailID, flags)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, mail)
+}
+
+// patchMailsRequest changes the flags of the mails listed by IDs at once.
+type patchMailsRequest struct {
+	IDs []uint
+	storage.MailFlags
+}
+
+// HandlePatchMails changes the flags of several mails: {"IDs":[1,2],"Seen":true}. Users authenticated
+// to the API only change mails of their mailbox, the others are reported as not found.
+func (m MailAPI) HandlePatchMails(context *gin.Context) {
+	var request patchMailsRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+		return
+	}
+	if len(request.IDs) == 0 {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": "give the IDs of the mails to change"})
+		return
+	}
+	username := context.GetString(userKey)
+	updated := 0
+	for _, mailID := range request.IDs {
+		if username != "" {
+			isInMailbox, err := m.Storage.IsInMailbox(mailID, username)
+			if err != nil {
+				context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error(), "Updated": updated})
+				return
+			}
+			if !isInMailbox {
+				context.JSON(http.StatusNotFound, gin.H{"Message": fmt.Sprintf("mail %d not found", mailID), "Updated": updated})
+				return
+			}
+		}
+		if _, err := m.Storage.UpdateFlags(mailID, request.MailFlags); err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error(), "Updated": updated})
+			return
+		}
+		updated++
+	}
+	context.JSON(http.StatusOK, gin.H{"Updated": updated})
+}
+
+func (m MailAPI) HandleDeleteMail(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	if err := m.Storage.Delete(mailID); err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"Message": err.Error()})
+		return
+	}
+	context.Status(http.StatusNoContent)
+}
+
+// HandleDeleteMails deletes the mails having the header=Name:Value fields, or every mail with all=true.
+// Users authenticated to the API only delete mails of their mailbox.
+func (m MailAPI) HandleDeleteMails(context *gin.Context) {
+	filters := headerFilters(context)
+	if len(filters) == 0 && context.Query("all") != "true" {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": "give header filters or all=true to delete every mail"})
+		return
+	}
+	var deleted int
+	var err error
+	if username := context.GetString(userKey); username != "" {
+		deleted, err = m.Storage.DeleteAllByMailbox(username, filters...)
+	} else {
+		deleted, err = m.Storage.DeleteAll(filters...)
+	}
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error(), "Deleted": deleted})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"Deleted": deleted})
+}
+
+func headerFilters(context *gin.Context) []storage.HeaderFilter {
+	var filters []storage.HeaderFilter
+	for _, header := range context.QueryArray("header") {
+		filters = append(filters, storage.ParseHeaderFilter(header))
+	}
+	return filters
+}
+
+// mailID parses the mailID path parameter and checks the mail is visible to the caller,
+// writing the error response when it is not.
+func (m MailAPI) mailID(context *gin.Context) (uint, bool) {
+	mailID, err := strconv.Atoi(context.Param("mailID"))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+		return 0, false
+	}
+	if username := context.GetString(userKey); username != "" {
+		isInMailbox, err := m.Storage.IsInMailbox(uint(mailID), username)
+		if err != nil {
+			context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+			return 0, false
+		}
+		if !isInMailbox {
+			context.JSON(http.StatusNotFound, gin.H{"Message": "mail not found"})
+			return 0, false
+		}
+	}
+	return uint(mailID), true
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// HandleGetSessionRecords lists the sessions that failed, were rejected or aborted.
+func (m MailAPI) HandleGetSessionRecords(context *gin.Context) {
+	records, err := m.Storage.GetSessionRecords(context.GetString(userKey))
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, records)
+}
+
+func (m MailAPI) HandleGetSessionTranscript(context *gin.Context) {
+	sessionID := context.Param("sessionID")
+	if username := context.GetString(userKey); username != "" {
+		record, err := m.Storage.GetSessionRecord(sessionID)
+		if err != nil || record.Username != username {
+			context.JSON(http.StatusNotFound, gin.H{"Message": "session not found"})
+			return
+		}
+	}
+	transcript, err := m.Storage.GetTranscriptBySessionID(sessionID)
+	if err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"Message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, transcript)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github/ajanthan/smtp-go/pkg/storage"
+	"net/http"
+	"strconv"
+)
+
+// HandleGetThreads lists a page of the conversations, the one with the latest message first. The filters
+// of HandleGetAllMails select the mails that are threaded, offset and limit page the threads and the
+// X-Total-Count header counts them.
+func (m MailAPI) HandleGetThreads(context *gin.Context) {
+	query, err := mailQuery(context)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"Message": err.Error()})
+		return
+	}
+	if username := context.GetString(userKey); username != "" {
+		query.Mailbox = username
+	}
+	page, err := m.Storage.FindThreads(query)
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"Message": err.Error()})
+		return
+	}
+	context.Header("X-Total-Count", strconv.Itoa(page.Total))
+	context.JSON(http.StatusOK, page.Threads)
+}
+
+// HandleGetThread returns the conversation the mail belongs to.
+func (m MailAPI) HandleGetThread(context *gin.Context) {
+	mailID, ok := m.mailID(context)
+	if !ok {
+		return
+	}
+	thread, err := storage.GetThread(m.Storage, mailID, context.GetString(userKey))
+	if err != nil {
+		context.JSON(http.StatusNotFound, gin.H{"Message": "mail not found"})
+		return
+	}
+	context.JSON(http.StatusOK, thread)
+}
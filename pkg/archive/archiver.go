@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github/ajanthan/smtp-go/pkg/storage"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultLayout files the mails by the day they were received.
+const DefaultLayout = "{{.Year}}/{{.Month}}/{{.Day}}/{{.ID}}"
+
+// Uploader stores an object in a bucket, S3Client is the one used outside tests.
+type Uploader interface {
+	PutObject(bucket, key, contentType string, data []byte) error
+}
+
+// Archiver uploads the raw message of a mail as <key>.eml and its metadata as <key>.json,
+// the key being Prefix followed by the Layout template executed on the mail.
+type Archiver struct {
+	Uploader Uploader
+	Bucket   string
+	Prefix   string
+	// Retries is how many times a failed upload is retried, waiting RetryDelay and doubling it after every try.
+	Retries    int
+	RetryDelay time.Duration
+	layout     *template.Template
+}
+
+// LayoutData are the fields of the mail a layout may refer to.
+type LayoutData struct {
+	ID        uint
+	MessageID string
+	Sender    string
+	Time      time.Time
+	Year      string
+	Month     string
+	Day       string
+}
+
+// Metadata is the JSON document archived next to the raw message.
+type Metadata struct {
+	ID         uint
+	MessageID  string
+	Subject    string
+	From       string
+	To         []string
+	Date       string
+	ReceivedAt time.Time
+	Size       int
+	SHA256     string
+	SessionID  string                `json:",omitempty"`
+	Owner      string                `json:",omitempty"`
+	Envelope   *storage.MailEnvelope `json:",omitempty"`
+	TLS        storage.TLSDetails
+	Headers    []MetadataHeader
+}
+
+type MetadataHeader struct {
+	Name  string
+	Value string
+}
+
+func NewArchiver(uploader Uploader, bucket, prefix, layout string) (*Archiver, error) {
+	if layout == "" {
+		layout = DefaultLayout
+	}
+	parsed, err := template.New("layout").Option("missingkey=error").Parse(layout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive layout, %w", err)
+	}
+	return &Archiver{Uploader: uploader, Bucket: bucket, Prefix: prefix, Retries: 3, RetryDelay: time.Second, layout: parsed}, nil
+}
+
+func (a *Archiver) Archive(mail *storage.Mail, raw []byte) error {
+	key, err := a.Key(mail)
+	if err != nil {
+		return err
+	}
+	metadata, err := json.MarshalIndent(newMetadata(mail, raw), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := a.upload(key+".eml", "message/rfc822", raw); err != nil {
+		return err
+	}
+	return a.upload(key+".json", "application/json", metadata)
+}
+
+// Key returns the object key of the mail without the extension.
+func (a *Archiver) Key(mail *storage.Mail) (string, error) {
+	received := mail.CreatedAt.UTC()
+	data := LayoutData{
+		ID:        mail.ID,
+		MessageID: strings.Trim(mail.MessageID, "<> "),
+		Sender:    mail.From,
+		Time:      received,
+		Year:      received.Format("2006"),
+		Month:     received.Format("01"),
+		Day:       received.Format("02"),
+	}
+	if mail.Envelope != nil && mail.Envelope.MailFrom != "" {
+		data.Sender = mail.Envelope.MailFrom
+	}
+	var key bytes.Buffer
+	if err := a.layout.Execute(&key, data); err != nil {
+		return "", err
+	}
+	return a.Prefix + strings.TrimPrefix(key.String(), "/"), nil
+}
+
+func (a *Archiver) upload(key, contentType string, data []byte) error {
+	delay := a.RetryDelay
+	var err error
+	for try := 0; ; try++ {
+		err = a.Uploader.PutObject(a.Bucket, key, contentType, data)
+		if err == nil {
+			return nil
+		}
+		if s3Err, ok := err.(*S3Error); (ok && !s3Err.Temporary()) || try >= a.Retries {
+			return fmt.Errorf("unable to upload %s, %w", key, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func newMetadata(mail *storage.Mail, raw []byte) *Metadata {
+	sum := sha256.Sum256(raw)
+	metadata := &Metadata{
+		ID:         mail.ID,
+		MessageID:  mail.MessageID,
+		Subject:    mail.Subject,
+		From:       mail.From,
+		To:         mail.To,
+		Date:       mail.Date,
+		ReceivedAt: mail.CreatedAt,
+		Size:       len(raw),
+		SHA256:     hex.EncodeToString(sum[:]),
+		SessionID:  mail.SessionID,
+		Owner:      mail.Owner,
+		Envelope:   mail.Envelope,
+		TLS:        mail.TLS,
+	}
+	for _, header := range mail.Headers {
+		metadata.Headers = append(metadata.Headers, MetadataHeader{Name: header.Name, Value: header.Value})
+	}
+	return metadata
+}
@@ -0,0 +1,113 @@
+package archive
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"github/ajanthan/smtp-go/pkg/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testMail = "Message-ID: <1234@test.com>\nSubject: Evidence\nX-Campaign-Id: 42\nContent-Type: text/plain\n\nHi\n"
+
+func TestArchiver_Archive(t *testing.T) {
+	fake, archiver := newTestArchiver(t, "evidence/", "{{.Year}}/{{.MessageID}}")
+	mail, err := storage.NewMailFromRaw([]byte(testMail))
+	require.NoError(t, err)
+	mail.ID = 7
+	mail.CreatedAt = time.Date(2021, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	// temporary failures are retried, the raw message is uploaded on the third try
+	fake.fail(2, http.StatusServiceUnavailable)
+	require.NoError(t, archiver.Archive(mail, []byte(testMail)))
+	object, ok := fake.object("/mails/evidence/2021/1234@test.com.eml")
+	require.True(t, ok)
+	assert.Equal(t, testMail, string(object.data))
+	object, ok = fake.object("/mails/evidence/2021/1234@test.com.json")
+	require.True(t, ok)
+	assert.Equal(t, "application/json", object.contentType)
+	var metadata Metadata
+	require.NoError(t, json.Unmarshal(object.data, &metadata))
+	assert.Equal(t, uint(7), metadata.ID)
+	assert.Equal(t, "Evidence", metadata.Subject)
+	assert.Equal(t, len(testMail), metadata.Size)
+	assert.Contains(t, metadata.Headers, MetadataHeader{Name: "X-Campaign-Id", Value: "42"})
+
+	fake.fail(1, http.StatusForbidden)
+	requests := fake.requests
+	err = archiver.Archive(mail, []byte(testMail))
+	assert.Error(t, err)
+	assert.Equal(t, requests+1, fake.requests)
+
+	fake.fail(4, http.StatusInternalServerError)
+	assert.Error(t, archiver.Archive(mail, []byte(testMail)))
+}
+
+func TestArchiver_Key(t *testing.T) {
+	archiver, err := NewArchiver(nil, "mails", "", "")
+	require.NoError(t, err)
+	mail := &storage.Mail{Envelope: &storage.MailEnvelope{MailFrom: "a@test.com"}}
+	mail.ID = 3
+	mail.CreatedAt = time.Date(2021, 1, 2, 23, 0, 0, 0, time.FixedZone("", -3600))
+	key, err := archiver.Key(mail)
+	require.NoError(t, err)
+	assert.Equal(t, "2021/01/03/3", key)
+
+	archiver, err = NewArchiver(nil, "mails", "by-sender/", "{{.Sender}}/{{.ID}}")
+	require.NoError(t, err)
+	key, err = archiver.Key(mail)
+	require.NoError(t, err)
+	assert.Equal(t, "by-sender/a@test.com/3", key)
+
+	_, err = NewArchiver(nil, "mails", "", "{{.ID")
+	assert.Error(t, err)
+}
+
+func TestDBReceiver_Archiver(t *testing.T) {
+	fake, archiver := newTestArchiver(t, "", "{{.MessageID}}")
+	store := storage.NewMemoryStorage(0, 0)
+	receiver := &storage.DBReceiver{
+		Storage:        store,
+		Archiver:       archiver,
+		ArchiveFilters: []storage.HeaderFilter{{Name: "x-campaign-id", Value: "42"}},
+	}
+	require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"},
+		Data: []byte("Subject: Ignored\nContent-Type: text/plain\n\nHi\n")}))
+	require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"},
+		Data: []byte(testMail)}))
+	receiver.WaitArchives()
+	_, ok := fake.object("/mails/1234@test.com.json")
+	assert.True(t, ok)
+	assert.Equal(t, 2, fake.requests)
+
+	// a failed upload is recorded for the archive command to replay
+	fake.fail(1, http.StatusForbidden)
+	require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"c@test.com"},
+		Data: []byte(testMail)}))
+	receiver.WaitArchives()
+	mails, err := store.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(mails))
+	assert.Equal(t, "", mails[0].ArchiveState)
+	assert.Equal(t, storage.ArchiveDone, mails[1].ArchiveState)
+	assert.Equal(t, storage.ArchiveFailed, mails[2].ArchiveState)
+	page, err := store.FindMails(storage.MailQuery{ArchiveStates: []string{storage.ArchivePending, storage.ArchiveFailed}})
+	require.NoError(t, err)
+	require.Equal(t, 1, page.Total)
+	assert.Equal(t, mails[2].ID, page.Mails[0].ID)
+}
+
+func newTestArchiver(t *testing.T, prefix, layout string) (*fakeS3, *Archiver) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client := &S3Client{Endpoint: server.URL, Region: "us-east-1", AccessKey: "minio", SecretKey: "minio123"}
+	archiver, err := NewArchiver(client, "mails", prefix, layout)
+	require.NoError(t, err)
+	archiver.RetryDelay = time.Millisecond
+	return fake, archiver
+}
@@ -0,0 +1,254 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+	renewBefore  = 30 * 24 * time.Hour
+)
+
+// Authority is a local certificate authority that issues server certificates for test hostnames.
+// The CA and every issued certificate are persisted in Dir so that clients only have to trust the CA once.
+type Authority struct {
+	Dir         string
+	Certificate *x509.Certificate
+	// Hostnames are served by GetCertificate, the first one is used for clients without SNI.
+	Hostnames []string
+	// OnDemand issues certificates for SNI names that are not listed in Hostnames.
+	OnDemand bool
+
+	key   crypto.Signer
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// LoadOrCreateAuthority loads the CA from dir, creating a new one when it does not exist yet.
+func LoadOrCreateAuthority(dir string) (*Authority, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	authority := &Authority{Dir: dir, certs: make(map[string]*tls.Certificate)}
+	cert, err := loadKeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if os.IsNotExist(err) {
+		return authority, authority.create()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the CA: %v", err)
+	}
+	if !cert.Leaf.IsCA {
+		return nil, errors.New("the CA certificate is not a certificate authority")
+	}
+	authority.Certificate = cert.Leaf
+	authority.key = cert.PrivateKey.(crypto.Signer)
+	return authority, nil
+}
+
+func (a *Authority) create() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "smtp-go local CA " + now.Format("2006-01-02"), Organization: []string{"smtp-go"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(filepath.Join(a.Dir, caCertFile), filepath.Join(a.Dir, caKeyFile), der, key); err != nil {
+		return err
+	}
+	a.Certificate, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	a.key = key
+	return nil
+}
+
+// CACertPEM returns the CA certificate for clients to add to their trust store.
+func (a *Authority) CACertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.Certificate.Raw})
+}
+
+// Fingerprint is the SHA-256 fingerprint of the CA certificate.
+func (a *Authority) Fingerprint() string {
+	sum := sha256.Sum256(a.Certificate.Raw)
+	return fmt.Sprintf("%X", sum)
+}
+
+// Issue returns a certificate valid for all hostnames (DNS names or IP addresses), named after the first one.
+// A certificate already persisted for the same names is reused until it is about to expire.
+func (a *Authority) Issue(hostnames ...string) (*tls.Certificate, error) {
+	if len(hostnames) == 0 {
+		return nil, errors.New("at least one hostname is required")
+	}
+	certFile, keyFile := a.certPaths(hostnames[0])
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err == nil && a.isUsable(cert.Leaf, hostnames) {
+		return cert, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostnames[0], Organization: []string{"smtp-go"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, hostname := range hostnames {
+		if ip := net.ParseIP(hostname); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.Certificate, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair(certFile, keyFile, der, key); err != nil {
+		return nil, err
+	}
+	return loadKeyPair(certFile, keyFile)
+}
+
+// GetCertificate selects the certificate by SNI and can be used as tls.Config.GetCertificate.
+func (a *Authority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" || (!a.OnDemand && !a.isConfigured(name)) {
+		if len(a.Hostnames) == 0 {
+			return nil, errors.New("no hostname is configured")
+		}
+		name = a.Hostnames[0]
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cert, ok := a.certs[name]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	cert, err := a.Issue(name)
+	if err != nil {
+		return nil, err
+	}
+	a.certs[name] = cert
+	return cert, nil
+}
+
+// TLSConfig issues the certificates of the configured hostnames up front and serves them by SNI.
+func (a *Authority) TLSConfig() (*tls.Config, error) {
+	for _, hostname := range a.Hostnames {
+		if _, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: hostname}); err != nil {
+			return nil, err
+		}
+	}
+	return &tls.Config{GetCertificate: a.GetCertificate}, nil
+}
+
+func (a *Authority) isConfigured(name string) bool {
+	for _, hostname := range a.Hostnames {
+		if strings.EqualFold(hostname, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authority) isUsable(cert *x509.Certificate, hostnames []string) bool {
+	if time.Now().Add(renewBefore).After(cert.NotAfter) || cert.CheckSignatureFrom(a.Certificate) != nil {
+		return false
+	}
+	for _, hostname := range hostnames {
+		if cert.VerifyHostname(hostname) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Authority) certPaths(hostname string) (string, string) {
+	name := strings.Replace(strings.ToLower(hostname), "*", "_wildcard", -1)
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '_'
+		}
+		return r
+	}, name)
+	return filepath.Join(a.Dir, name+".crt"), filepath.Join(a.Dir, name+".key")
+}
+
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	if _, err := os.Stat(certFile); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func writeKeyPair(certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
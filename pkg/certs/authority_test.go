@@ -0,0 +1,69 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtp-go-certs")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	authority, err := LoadOrCreateAuthority(dir)
+	require.NoError(t, err)
+	assert.True(t, authority.Certificate.IsCA)
+
+	cert, err := authority.Issue("mail.test", "127.0.0.1")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(authority.CACertPEM()))
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "mail.test", Roots: roots})
+	assert.NoError(t, err)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "127.0.0.1", Roots: roots})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "mail.test.crt"))
+
+	reissued, err := authority.Issue("mail.test", "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, cert.Leaf.SerialNumber, reissued.Leaf.SerialNumber)
+
+	reloaded, err := LoadOrCreateAuthority(dir)
+	require.NoError(t, err)
+	assert.Equal(t, authority.Fingerprint(), reloaded.Fingerprint())
+}
+
+func TestAuthority_GetCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtp-go-certs")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	authority, err := LoadOrCreateAuthority(dir)
+	require.NoError(t, err)
+	authority.Hostnames = []string{"localhost", "mx.test"}
+	config, err := authority.TLSConfig()
+	require.NoError(t, err)
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "mx.test"})
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("mx.test"))
+	cert, err = config.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("localhost"))
+	cert, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.test"})
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("localhost"))
+
+	authority.OnDemand = true
+	cert, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.test"})
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("unknown.test"))
+}
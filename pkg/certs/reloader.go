@@ -0,0 +1,120 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadDelay coalesces the events of a rotation, which usually rewrites the certificate and the key separately.
+const reloadDelay = 200 * time.Millisecond
+
+// KeyPairReloader serves a certificate and key pair from disk and swaps it when the files change or on SIGHUP.
+// A reloaded pair that fails validation is rejected and the previous one keeps being served.
+type KeyPairReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewKeyPairReloader loads the pair, which only has to match: a certificate outside its validity
+// period is served with a warning, as test certificates often are.
+func NewKeyPairReloader(certFile, keyFile string) (*KeyPairReloader, error) {
+	reloader := &KeyPairReloader{CertFile: certFile, KeyFile: keyFile}
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate and key pair: %v", err)
+	}
+	if err := checkValidity(cert); err != nil {
+		log.Printf("warning: %v", err)
+	}
+	reloader.cert = cert
+	return reloader, nil
+}
+
+// Reload loads and validates the pair, replacing the served certificate only when it is usable.
+func (r *KeyPairReloader) Reload() error {
+	cert, err := loadKeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("invalid certificate and key pair: %v", err)
+	}
+	if err := checkValidity(cert); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = cert
+	r.mu.Unlock()
+	return nil
+}
+
+func checkValidity(cert *tls.Certificate) error {
+	now := time.Now()
+	if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate %s is only valid from %s to %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotBefore, cert.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// Certificate returns the certificate being served.
+func (r *KeyPairReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate, each handshake picks up the latest pair.
+func (r *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// Watch reloads the pair whenever the files change or the process receives SIGHUP, until stop is closed.
+// The parent directories are watched so that files replaced by rename or symlink swaps are noticed as well.
+func (r *KeyPairReloader) Watch(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	dirs := map[string]bool{filepath.Dir(r.CertFile): true, filepath.Dir(r.KeyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Chmod != event.Op {
+				timer.Reset(reloadDelay)
+			}
+		case err := <-watcher.Errors:
+			log.Printf("error watching the certificate %v", err)
+		case <-hangup:
+			timer.Reset(0)
+		case <-timer.C:
+			if err := r.Reload(); err != nil {
+				log.Printf("keeping the current certificate, %v", err)
+			} else {
+				log.Printf("reloaded the certificate %s", r.CertFile)
+			}
+		}
+	}
+}
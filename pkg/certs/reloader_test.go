@@ -0,0 +1,95 @@
+package certs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyPairReloader(t *testing.T) {
+	dir, certFile, keyFile := newTestKeyPairDir(t)
+	reloader, err := NewKeyPairReloader(certFile, keyFile)
+	require.NoError(t, err)
+	first := reloader.Certificate().Leaf.SerialNumber
+
+	issueTestKeyPair(t, dir, certFile, keyFile)
+	require.NoError(t, reloader.Reload())
+	second := reloader.Certificate().Leaf.SerialNumber
+	assert.NotEqual(t, first, second)
+
+	otherKey, err := ioutil.ReadFile(filepath.Join(dir, "other.key"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(keyFile, otherKey, 0600))
+	assert.Error(t, reloader.Reload())
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second, cert.Leaf.SerialNumber)
+
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("broken"), 0644))
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, second, reloader.Certificate().Leaf.SerialNumber)
+}
+
+func TestKeyPairReloader_Expired(t *testing.T) {
+	// the bundled certificate expired, it is still served at startup but not taken on a reload
+	reloader, err := NewKeyPairReloader("../../resources/localhost.crt", "../../resources/localhost.pkcs8")
+	require.NoError(t, err)
+	assert.True(t, time.Now().After(reloader.Certificate().Leaf.NotAfter))
+	assert.Error(t, reloader.Reload())
+	assert.NotNil(t, reloader.Certificate())
+}
+
+func TestKeyPairReloader_Watch(t *testing.T) {
+	dir, certFile, keyFile := newTestKeyPairDir(t)
+	reloader, err := NewKeyPairReloader(certFile, keyFile)
+	require.NoError(t, err)
+	first := reloader.Certificate().Leaf.SerialNumber
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- reloader.Watch(stop)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	issueTestKeyPair(t, dir, certFile, keyFile)
+	assert.Eventually(t, func() bool {
+		return reloader.Certificate().Leaf.SerialNumber.Cmp(first) != 0
+	}, 5*time.Second, 50*time.Millisecond)
+	close(stop)
+	assert.NoError(t, <-done)
+}
+
+// newTestKeyPairDir issues a pair into server.crt and server.key, plus an unrelated key in other.key.
+func newTestKeyPairDir(t *testing.T) (string, string, string) {
+	dir, err := ioutil.TempDir("", "smtp-go-reload")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	issueTestKeyPair(t, dir, certFile, keyFile)
+	authority, err := LoadOrCreateAuthority(filepath.Join(dir, "ca"))
+	require.NoError(t, err)
+	_, err = authority.Issue("other")
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(filepath.Join(dir, "ca", "other.key"), filepath.Join(dir, "other.key")))
+	return dir, certFile, keyFile
+}
+
+func issueTestKeyPair(t *testing.T, dir, certFile, keyFile string) {
+	authority, err := LoadOrCreateAuthority(filepath.Join(dir, "ca"))
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(authority.Dir, "localhost.crt")))
+	_, err = authority.Issue("localhost")
+	require.NoError(t, err)
+	for from, to := range map[string]string{"localhost.crt": certFile, "localhost.key": keyFile} {
+		data, err := ioutil.ReadFile(filepath.Join(authority.Dir, from))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(to, data, 0600))
+	}
+}
@@ -19,17 +19,36 @@ func (s Server) Start(api *api.MailAPI) error {
 	//CORS middleware configuration
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowOrigins = []string{"http://localhost", "http://127.0.0.1"}
+	corsConfig.AddAllowHeaders("Authorization")
+	corsConfig.AddExposeHeaders("X-Total-Count", "X-Next-Cursor")
 	router.Use(cors.New(corsConfig))
 
-	router.LoadHTMLGlob("templates/*")
-
-	router.GET("/mail", api.HandleGetAllMails)
-	router.GET("/mail/:mailID/content", api.HandleGetMailByID)
+	// the web front is served to everyone, it asks for the credentials the API calls need
 	router.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusFound, "/app")
 	})
 	router.Static("/app", "./ui/app/xmail/build")
 
+	router.Use(api.Authenticate)
+	router.LoadHTMLGlob("templates/*")
+
+	router.GET("/mail", api.HandleGetAllMails)
+	router.GET("/search", api.HandleSearchMails)
+	router.GET("/mail/:mailID", api.HandleGetMail)
+	router.PATCH("/mail", api.HandlePatchMails)
+	router.PATCH("/mail/:mailID", api.HandlePatchMail)
+	router.DELETE("/mail", api.HandleDeleteMails)
+	router.DELETE("/mail/:mailID", api.HandleDeleteMail)
+	router.GET("/mail/:mailID/content", api.HandleGetMailByID)
+	router.GET("/mail/:mailID/attachments", api.HandleGetMailAttachments)
+	router.GET("/mail/:mailID/raw", api.HandleGetRawMail)
+	router.GET("/mail/:mailID/headers", api.HandleGetMailHeaders)
+	router.GET("/mail/:mailID/transcript", api.HandleGetMailTranscript)
+	router.GET("/threads", api.HandleGetThreads)
+	router.GET("/threads/:mailID", api.HandleGetThread)
+	router.GET("/sessions", api.HandleGetSessionRecords)
+	router.GET("/sessions/:sessionID/transcript", api.HandleGetSessionTranscript)
+
 	err := router.Run(s.Address + ":" + strconv.Itoa(s.HTTPPort))
 	if err != nil {
 		return err
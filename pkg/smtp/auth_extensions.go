@@ -7,38 +7,41 @@ import (
 
 var NullByte = []byte("\x00")
 
-func HandlePlainAuth(cred string, authService AuthenticationService) error {
+func HandlePlainAuth(cred string, authService AuthenticationService) (string, error) {
 
 	credential, err := base64Decode(cred)
 	if err != nil {
-		return NewServerError(err.Error())
+		return "", NewServerError(err.Error())
 	}
 	parts := bytes.Split(credential, NullByte)
+	if len(parts) != 3 {
+		return "", NewServerError("invalid PLAIN format")
+	}
 	//ignoring parts[0]=> identity
-	return authService.Authenticate(string(parts[1]), parts[2])
+	return string(parts[1]), authService.Authenticate(string(parts[1]), parts[2])
 }
-func HandleLoginAuth(username, password string, authService AuthenticationService) error {
+func HandleLoginAuth(username, password string, authService AuthenticationService) (string, error) {
 	decodedUsername, err := base64Decode(username)
 	if err != nil {
-		return NewServerError(err.Error())
+		return "", NewServerError(err.Error())
 	}
 	decodedPassword, err := base64Decode(password)
 	if err != nil {
-		return NewServerError(err.Error())
+		return "", NewServerError(err.Error())
 	}
 
-	return authService.Authenticate(string(decodedUsername), decodedPassword)
+	return string(decodedUsername), authService.Authenticate(string(decodedUsername), decodedPassword)
 }
-func HandleMD5CRAMAuth(cred string, challenge []byte, authService AuthenticationService) error {
+func HandleMD5CRAMAuth(cred string, challenge []byte, authService AuthenticationService) (string, error) {
 	decodedCred, err := base64Decode(cred)
 	if err != nil {
-		return NewServerError(err.Error())
+		return "", NewServerError(err.Error())
 	}
 	creds := bytes.Split(decodedCred, []byte{' '})
 	if len(creds) != 2 {
-		return NewServerError("invalid MD5-CRAM format")
+		return "", NewServerError("invalid MD5-CRAM format")
 	}
-	return authService.ValidateHMAC(string(creds[0]), []byte(challenge), creds[1])
+	return string(creds[0]), authService.ValidateHMAC(string(creds[0]), []byte(challenge), creds[1])
 }
 
 func base64Decode(in string) ([]byte, error) {
@@ -4,3 +4,9 @@ type AuthenticationService interface {
 	Authenticate(username string, password []byte) error
 	ValidateHMAC(username string, msg []byte, code []byte) error
 }
+
+// SenderPolicy decides whether an authenticated user may use a sender address,
+// both for MAIL FROM and for the From: header of the message.
+type SenderPolicy interface {
+	AuthorizeSender(username string, sender string) error
+}
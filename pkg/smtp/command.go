@@ -6,16 +6,18 @@ import (
 )
 
 type Command struct {
-	Name string
-	Args []string
-	From string
-	To   string
+	Name   string
+	Args   []string
+	From   string
+	To     string
+	Params map[string]string
 }
 
 func (c *Command) ParseFrom() error {
-	if strings.HasPrefix(c.Args[0], "FROM:") {
-		part := strings.TrimLeft(c.Args[0], "FROM:<")
-		c.From = strings.TrimRight(part, ">")
+	if len(c.Args) > 0 && strings.HasPrefix(c.Args[0], "FROM:") {
+		part := strings.TrimPrefix(c.Args[0], "FROM:")
+		c.From = strings.TrimSuffix(strings.TrimPrefix(part, "<"), ">")
+		c.parseParams()
 		return nil
 	} else {
 		return errors.New("invalid MAIL command")
@@ -23,12 +25,29 @@ func (c *Command) ParseFrom() error {
 }
 
 func (c *Command) ParseTo() error {
-	if strings.HasPrefix(c.Args[0], "TO:") {
-		part := strings.TrimLeft(c.Args[0], "TO:<")
-		part = strings.TrimRight(part, ">")
-		c.To = part
+	if len(c.Args) > 0 && strings.HasPrefix(c.Args[0], "TO:") {
+		part := strings.TrimPrefix(c.Args[0], "TO:")
+		c.To = strings.TrimSuffix(strings.TrimPrefix(part, "<"), ">")
+		c.parseParams()
 		return nil
 	} else {
 		return errors.New("invalid RCPT command")
 	}
 }
+
+// parseParams reads the ESMTP parameters (RFC 5321 section 4.1.2) following the path,
+// e.g. "SIZE=1024 REQUIRETLS", keyed by their upper-cased names.
+func (c *Command) parseParams() {
+	c.Params = make(map[string]string)
+	for _, arg := range c.Args[1:] {
+		if arg == "" {
+			continue
+		}
+		parts := strings.SplitN(arg, "=", 2)
+		value := ""
+		if len(parts) > 1 {
+			value = parts[1]
+		}
+		c.Params[strings.ToUpper(parts[0])] = value
+	}
+}
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/mail"
 	"time"
@@ -8,9 +9,61 @@ import (
 
 type Envelope struct {
 	MessageID string
+	// SessionID is the ID of the session the mail was received in, linking it to the transcript.
+	SessionID string
 	Sender    string
 	Recipient []string
-	Content   *mail.Message
+	// MailParams are the ESMTP parameters of the MAIL command, e.g. SIZE or BODY.
+	MailParams map[string]string
+	// RecipientParams holds the ESMTP parameters of each RCPT command, in the order of Recipient.
+	RecipientParams []map[string]string
+	// Helo is the name the client introduced itself with in HELO/EHLO.
+	Helo string
+	// ClientAddress is the remote address of the connection the mail was received on.
+	ClientAddress string
+	ReceivedAt    time.Time
+	// Username is the authenticated user that submitted the mail, empty for anonymous sessions.
+	Username string
+	// RequireTLS is set when the sender asked for REQUIRETLS (RFC 8689) handling of the mail.
+	RequireTLS bool
+	// TLS describes the TLS session the mail was received on, nil for plain connections.
+	TLS *TLSInfo
+	// Data is the message as received, preceded by the trace headers stamped by the session.
+	Data    []byte
+	Content *mail.Message
+}
+
+type TLSInfo struct {
+	Version           string
+	CipherSuite       string
+	ServerName        string
+	ClientCertificate string
+	ClientIssuer      string
+}
+
+func NewTLSInfo(state tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     TLSVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.ClientCertificate = state.PeerCertificates[0].Subject.String()
+		info.ClientIssuer = state.PeerCertificates[0].Issuer.String()
+	}
+	return info
+}
+
+// String formats the session as the comment of a Received header, e.g. "version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256".
+func (t *TLSInfo) String() string {
+	comment := fmt.Sprintf("version=%s cipher=%s", t.Version, t.CipherSuite)
+	if t.ServerName != "" {
+		comment += " sni=" + t.ServerName
+	}
+	if t.ClientCertificate != "" {
+		comment += fmt.Sprintf(" verify=%q", t.ClientCertificate)
+	}
+	return comment
 }
 
 func NewEnvelope(serverName string) *Envelope {
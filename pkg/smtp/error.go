@@ -58,3 +58,16 @@ func NewAuthRequiredError(m string) AuthRequiredError {
 func (e AuthRequiredError) Error() string {
 	return e.Message
 }
+
+type SenderNotAllowedError struct {
+	Message string
+}
+
+func NewSenderNotAllowedError(m string) SenderNotAllowedError {
+	err := SenderNotAllowedError{}
+	err.Message = m
+	return err
+}
+func (e SenderNotAllowedError) Error() string {
+	return e.Message
+}
@@ -10,16 +10,30 @@ import (
 )
 
 type Server struct {
-	Address     string
-	SMTPPort    int
-	Receiver    MailReceiver
-	TLSConfig   *tls.Config
-	AuthService AuthenticationService
-	Secure      bool
-	ConnTimeOut int
+	Address   string
+	SMTPPort  int
+	Receiver  MailReceiver
+	TLSConfig *tls.Config
+	// TLSRequired refuses MAIL until the client has issued STARTTLS.
+	TLSRequired bool
+	// MinTLSVersion and CipherSuites override the corresponding TLSConfig settings when set.
+	MinTLSVersion uint16
+	CipherSuites  []uint16
+	AuthService   AuthenticationService
+	// SenderPolicy, when set, restricts authenticated users to their own sender addresses.
+	SenderPolicy SenderPolicy
+	Secure       bool
+	ConnTimeOut  int
+	// DeliveredTo stamps a Delivered-To header per recipient on every accepted mail.
+	DeliveredTo bool
+	// TranscriptReceiver, when set, records the full conversation of every session.
+	TranscriptReceiver TranscriptReceiver
+	// SessionRecorder, when set, keeps a record of the sessions that did not deliver cleanly.
+	SessionRecorder SessionRecorder
 }
 
 func (s Server) Start() {
+	tlsConfig := s.tlsConfig()
 	ln, err := net.Listen("tcp", s.Address+":"+strconv.Itoa(s.SMTPPort))
 	if err != nil {
 		panic(fmt.Sprintf("error starting server %v", err))
@@ -31,16 +45,21 @@ func (s Server) Start() {
 		}
 		go func() {
 			session := &Session{
-				Conn:        textproto.NewConn(conn),
-				conn:        conn,
-				Server:      s.Address,
-				Secure:      s.Secure,
-				Auth:        s.AuthService,
-				Receiver:    s.Receiver,
-				ConnTimeOut: s.ConnTimeOut,
+				Conn:               textproto.NewConn(conn),
+				conn:               conn,
+				Server:             s.Address,
+				Secure:             s.Secure,
+				Auth:               s.AuthService,
+				SenderPolicy:       s.SenderPolicy,
+				Receiver:           s.Receiver,
+				ConnTimeOut:        s.ConnTimeOut,
+				DeliveredTo:        s.DeliveredTo,
+				TranscriptReceiver: s.TranscriptReceiver,
+				SessionRecorder:    s.SessionRecorder,
 			}
-			if s.TLSConfig != nil {
-				session.TLSConfig = s.TLSConfig
+			if tlsConfig != nil {
+				session.TLSConfig = tlsConfig
+				session.TLSRequired = s.TLSRequired
 				session.Extensions = append(session.Extensions, StartTLS)
 			}
 			if s.Secure {
@@ -54,3 +73,17 @@ func (s Server) Start() {
 		}()
 	}
 }
+
+func (s Server) tlsConfig() *tls.Config {
+	if s.TLSConfig == nil {
+		return nil
+	}
+	config := s.TLSConfig.Clone()
+	if s.MinTLSVersion != 0 {
+		config.MinVersion = s.MinTLSVersion
+	}
+	if len(s.CipherSuites) > 0 {
+		config.CipherSuites = s.CipherSuites
+	}
+	return config
+}
@@ -6,8 +6,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/mail"
+	"net/smtp"
 	"strings"
 	"testing"
+	"time"
 )
 
 //TODO: Add benchmark tests
@@ -21,6 +23,7 @@ func TestNone_MIME_Mail(t *testing.T) {
 	go func() {
 		server.Start()
 	}()
+	waitForServer(t, fmt.Sprintf("%s:%d", server.Address, server.SMTPPort))
 	err := SendEmail(
 		fmt.Sprintf("%s:%d", server.Address, server.SMTPPort),
 		"sender@test.com",
@@ -37,7 +40,7 @@ func TestNone_MIME_Mail(t *testing.T) {
 	buffer := bytes.Buffer{}
 	_, err = buffer.ReadFrom(mails[0].Content.Body)
 	require.NoError(t, err)
-	assert.Equal(t, "Test Message\n", buffer.String())
+	assert.Equal(t, "Test Message\r\n", buffer.String())
 }
 
 func TestMiME_Mail(t *testing.T) {
@@ -50,6 +53,7 @@ func TestMiME_Mail(t *testing.T) {
 	go func() {
 		server.Start()
 	}()
+	waitForServer(t, fmt.Sprintf("%s:%d", server.Address, server.SMTPPort))
 	//"../../resources/mime_body.txt"
 	err := SendEmailFromFile(
 		fmt.Sprintf("%s:%d", server.Address, server.SMTPPort),
@@ -68,6 +72,18 @@ func TestMiME_Mail(t *testing.T) {
 	assert.NotNil(t, mails[0].Content)
 }
 
+func waitForServer(t *testing.T, address string) {
+	for i := 0; i < 50; i++ {
+		c, err := smtp.Dial(address)
+		if err == nil {
+			require.NoError(t, c.Quit())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server is not listening on %s", address)
+}
+
 type TestStorage struct {
 	mails     map[uint]Envelope
 	idCounter uint
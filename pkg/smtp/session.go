@@ -1,10 +1,12 @@
 package smtp
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/mail"
@@ -15,33 +17,65 @@ import (
 )
 
 const (
-	StartTLS = "STARTTLS"
-	Auth     = "AUTH PLAIN LOGIN MD5-CRAM"
+	StartTLS   = "STARTTLS"
+	Auth       = "AUTH PLAIN LOGIN CRAM-MD5"
+	RequireTLS = "REQUIRETLS"
 )
 
 type Session struct {
+	// ID identifies the session in transcripts and on the mails it produced.
+	ID                       string
 	conn                     net.Conn
 	Conn                     *textproto.Conn
 	Server                   string
 	Client                   string
 	IsHelloReceived          bool
+	IsExtendedHello          bool
 	IsMailReceived           bool
 	IsAtLeastOneRcptReceived bool
 	IsAuthenticated          bool
+	Username                 string
 	IsTLSConn                bool
+	TLSState                 *tls.ConnectionState
 	TLSConfig                *tls.Config
+	TLSRequired              bool
 	Extensions               []string
 	Auth                     AuthenticationService
+	SenderPolicy             SenderPolicy
 	Secure                   bool
 	Receiver                 MailReceiver
+	DeliveredTo              bool
 	ConnTimeOut              int
+	// TranscriptReceiver, when set, gets the transcript of the session once it ends.
+	TranscriptReceiver TranscriptReceiver
+	// SessionRecorder, when set, gets a record of every session that failed, was rejected or aborted.
+	SessionRecorder     SessionRecorder
+	Transcript          *Transcript
+	isReadingCredential bool
+	lastRejection       string
+	delivered           int
+	// hungUp tells whether the client closed the connection instead of sending a command.
+	hungUp bool
 }
 
-func (s *Session) Handle() error {
+func (s *Session) Handle() (err error) {
 	if s.ConnTimeOut == 0 {
 		s.ConnTimeOut = 180
 	}
-	err := s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.ConnTimeOut) * time.Second))
+	if s.ID == "" {
+		s.ID = newSessionID()
+	}
+	var envelope *Envelope
+	if s.TranscriptReceiver != nil || s.SessionRecorder != nil {
+		s.Transcript = &Transcript{SessionID: s.ID, StartedAt: time.Now()}
+		if s.conn != nil {
+			s.Transcript.ClientAddress = s.conn.RemoteAddr().String()
+		}
+		defer func() {
+			s.finishSession(err, envelope)
+		}()
+	}
+	err = s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.ConnTimeOut) * time.Second))
 	if err != nil {
 		return NewServerError(fmt.Sprintf("error setting connection timout %v", err))
 	}
@@ -50,7 +84,6 @@ func (s *Session) Handle() error {
 	if err := s.Reply(StatusReady, greetings); err != nil {
 		return NewServerError(fmt.Sprintf("error sending ready message %v", err))
 	}
-	var envelope *Envelope
 	// handling smtp commands
 	for {
 		cmd, err := s.NextCMD()
@@ -60,15 +93,15 @@ func (s *Session) Handle() error {
 					log.Printf("wrong syntax %v", err)
 					return err
 				}
+				continue
 			} else if errors.As(err, &OutOfOrderCmdError{}) {
 				if err := s.Reply(StatusOutOfSequenceCmdError, err.Error()); err != nil {
 					log.Printf("out of sequence commands %v", err)
 					return err
 				}
-			} else if errors.As(err, &ServerError{}) {
-				return err
+				continue
 			}
-			panic(fmt.Sprintf("error cmd %v", err))
+			return err
 		}
 		switch cmd.Name {
 		case "QUIT":
@@ -95,6 +128,11 @@ func (s *Session) Handle() error {
 				if err != nil {
 					return err
 				}
+				envelope.Username = s.Username
+				if s.IsMailReceived {
+					envelope.MailParams = cmd.Params
+					_, envelope.RequireTLS = cmd.Params[RequireTLS]
+				}
 			}
 		case "RCPT":
 			isRequired, err := s.checkAuthRequired()
@@ -107,6 +145,7 @@ func (s *Session) Handle() error {
 					return err
 				}
 				envelope.Recipient = append(envelope.Recipient, recipient)
+				envelope.RecipientParams = append(envelope.RecipientParams, cmd.Params)
 			}
 		case "DATA":
 			isRequired, err := s.checkAuthRequired()
@@ -114,13 +153,16 @@ func (s *Session) Handle() error {
 				return err
 			}
 			if !isRequired {
-				envelope.Content, err = s.HandleData(cmd)
+				err = s.HandleData(cmd, envelope)
 				if err != nil {
 					return err
 				}
-				err = s.Receiver.Receive(envelope)
-				if err != nil {
-					return NewServerError(fmt.Sprintf("error persisting mail %v", err))
+				if envelope.Content != nil {
+					err = s.Receiver.Receive(envelope)
+					if err != nil {
+						return NewServerError(fmt.Sprintf("error persisting mail %v", err))
+					}
+					s.delivered++
 				}
 				envelope = nil
 			}
@@ -162,7 +204,6 @@ func (s *Session) Handle() error {
 			}
 		}
 	}
-	return nil
 }
 
 func (s *Session) HandleHello(cmd Command) error {
@@ -171,7 +212,8 @@ func (s *Session) HandleHello(cmd Command) error {
 	}
 	s.Client = cmd.Args[0]
 	message := fmt.Sprintf("%s greets %s", s.Server, s.Client)
-	if len(s.Extensions) == 0 {
+	extensions := s.extensions()
+	if len(extensions) == 0 {
 		if err := s.Reply(StatusOk, message); err != nil {
 			return NewServerError(fmt.Sprintf("error sending ok %v", err))
 		}
@@ -179,19 +221,20 @@ func (s *Session) HandleHello(cmd Command) error {
 		if err := s.MultiReply(StatusOk, message); err != nil {
 			return NewServerError(fmt.Sprintf("error sending ok %v", err))
 		}
-		for i, extension := range s.Extensions {
-			if i != len(s.Extensions)-1 {
+		for i, extension := range extensions {
+			if i != len(extensions)-1 {
 				if err := s.MultiReply(StatusOk, extension); err != nil {
 					return NewServerError(fmt.Sprintf("error sending ok %v", err))
 				}
 			}
 		}
-		if err := s.Reply(StatusOk, s.Extensions[len(s.Extensions)-1]); err != nil {
+		if err := s.Reply(StatusOk, extensions[len(extensions)-1]); err != nil {
 			return NewServerError(fmt.Sprintf("error sending ok %v", err))
 		}
 	}
 
 	s.IsHelloReceived = true
+	s.IsExtendedHello = cmd.Name == "EHLO"
 	return nil
 }
 func (s *Session) HandleMail(cmd Command) (string, error) {
@@ -200,6 +243,21 @@ func (s *Session) HandleMail(cmd Command) (string, error) {
 	} else if s.IsMailReceived {
 		return "", NewOutOfOrderCmdError("MAIL command is already received")
 	}
+	if s.TLSRequired && !s.IsTLSConn {
+		if err := s.Reply(StatusStartTLSRequired, "Must issue a STARTTLS command first"); err != nil {
+			return "", NewServerError(fmt.Sprintf("error sending reply %v", err))
+		}
+		return "", nil
+	}
+	if _, ok := cmd.Params[RequireTLS]; ok && !s.IsTLSConn {
+		if err := s.Reply(StatusParameterNotRecognized, "REQUIRETLS is only supported over TLS"); err != nil {
+			return "", NewServerError(fmt.Sprintf("error sending reply %v", err))
+		}
+		return "", nil
+	}
+	if isAllowed, err := s.checkSender(cmd.From); err != nil || !isAllowed {
+		return "", err
+	}
 	if err := s.Reply(StatusOk, "OK"); err != nil {
 		return "", NewServerError(fmt.Sprintf("error sending hello %v", err))
 	}
@@ -220,17 +278,20 @@ func (s *Session) HandleRcpt(cmd Command) (string, error) {
 	}
 	return cmd.To, nil
 }
-func (s *Session) HandleData(Command) (*mail.Message, error) {
+
+// HandleData reads the message into the envelope, stamping it with the trace headers of this hop.
+// The envelope is left without content when the message is rejected.
+func (s *Session) HandleData(cmd Command, envelope *Envelope) error {
 	if !s.IsHelloReceived {
-		return nil, NewOutOfOrderCmdError("DATA command before EHLO/HELLO command")
+		return NewOutOfOrderCmdError("DATA command before EHLO/HELLO command")
 	} else if !s.IsMailReceived {
-		return nil, NewOutOfOrderCmdError("DATA command before MAIL command")
+		return NewOutOfOrderCmdError("DATA command before MAIL command")
 	} else if !s.IsAtLeastOneRcptReceived {
-		return nil, NewOutOfOrderCmdError("DATA command before at least one RCPT command")
+		return NewOutOfOrderCmdError("DATA command before at least one RCPT command")
 	}
 	message := "Start mail input; end with <CRLF>.<CRLF>"
 	if err := s.Reply(StatusContinue, message); err != nil {
-		return nil, NewServerError(fmt.Sprintf("error sending hello %v", err))
+		return NewServerError(fmt.Sprintf("error sending hello %v", err))
 	}
 	var mailReader io.Reader
 	if os.Getenv("DUMB_MAIL") != "" {
@@ -238,14 +299,38 @@ func (s *Session) HandleData(Command) (*mail.Message, error) {
 	} else {
 		mailReader = s.Conn.DotReader()
 	}
-	msg, err := mail.ReadMessage(mailReader)
+	data, err := ioutil.ReadAll(mailReader)
 	if err != nil {
-		return nil, NewServerError(fmt.Sprintf("error reading mail body %v", err))
+		return NewServerError(fmt.Sprintf("error reading mail body %v", err))
+	}
+	data = canonicalLineEndings(data)
+	s.resetTransaction()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return NewServerError(fmt.Sprintf("error reading mail body %v", err))
+	}
+	if isAllowed, err := s.checkFromHeader(msg); err != nil || !isAllowed {
+		return err
+	}
+	if s.TLSState != nil {
+		envelope.TLS = NewTLSInfo(*s.TLSState)
+	}
+	s.recordEvent("message data, %d bytes", len(data))
+	envelope.SessionID = s.ID
+	envelope.Helo = s.Client
+	if s.conn != nil {
+		envelope.ClientAddress = s.conn.RemoteAddr().String()
+	}
+	envelope.ReceivedAt = time.Now()
+	envelope.Data = append(s.traceHeaders(envelope), data...)
+	envelope.Content, err = mail.ReadMessage(bytes.NewReader(envelope.Data))
+	if err != nil {
+		return NewServerError(fmt.Sprintf("error reading stamped mail %v", err))
 	}
 	if err := s.Reply(StatusOk, "OK"); err != nil {
-		return nil, NewServerError(fmt.Sprintf("error sending ok %v", err))
+		return NewServerError(fmt.Sprintf("error sending ok %v", err))
 	}
-	return msg, nil
+	return nil
 }
 func (s *Session) HandleQuit() error {
 	message := fmt.Sprintf("%s service closing transmission channel", s.Server)
@@ -257,8 +342,7 @@ func (s *Session) HandleQuit() error {
 }
 
 func (s *Session) HandleReset() error {
-	s.IsMailReceived = false
-	s.IsAtLeastOneRcptReceived = false
+	s.resetTransaction()
 	if err := s.Reply(StatusOk, "OK"); err != nil {
 		return NewServerError(fmt.Sprintf("error sending hello %v", err))
 	}
@@ -273,11 +357,34 @@ func (s *Session) HandleStartTLS() error {
 	s.IsAtLeastOneRcptReceived = false
 	s.IsMailReceived = false
 	tlsConn := tls.Server(s.conn, s.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		s.recordEvent("TLS handshake failed, %v", err)
+		return NewServerError(fmt.Sprintf("error in TLS handshake %v", err))
+	}
 	s.Conn = textproto.NewConn(tlsConn)
 	s.IsTLSConn = true
+	state := tlsConn.ConnectionState()
+	s.TLSState = &state
+	s.recordEvent("TLS handshake completed, %s", NewTLSInfo(state))
 	return nil
 }
 
+// extensions lists the EHLO keywords for the current state of the connection:
+// STARTTLS is only offered on plain connections and REQUIRETLS only once TLS is in place.
+func (s *Session) extensions() []string {
+	var extensions []string
+	for _, extension := range s.Extensions {
+		if extension == StartTLS && s.IsTLSConn {
+			continue
+		}
+		extensions = append(extensions, extension)
+	}
+	if s.IsTLSConn {
+		extensions = append(extensions, RequireTLS)
+	}
+	return extensions
+}
+
 func (s *Session) HandleUnknownError(err error) {
 	message := fmt.Sprintf("unknown server error:%s", err.Error())
 	if err := s.Reply(StatusUnknownError, message); err != nil {
@@ -285,12 +392,15 @@ func (s *Session) HandleUnknownError(err error) {
 	}
 }
 func (s *Session) Reply(statusCode int, statusLine string) error {
+	s.recordReply(statusCode, statusLine)
+	s.recordServerLine(fmt.Sprintf("%d %s", statusCode, statusLine))
 	if err := s.Conn.PrintfLine("%d %s", statusCode, statusLine); err != nil {
 		return err
 	}
 	return nil
 }
 func (s *Session) MultiReply(statusCode int, statusLine string) error {
+	s.recordServerLine(fmt.Sprintf("%d-%s", statusCode, statusLine))
 	if err := s.Conn.PrintfLine("%d-%s", statusCode, statusLine); err != nil {
 		return err
 	}
@@ -300,8 +410,11 @@ func (s *Session) NextCMD() (Command, error) {
 	command := Command{}
 	buff, err := s.Conn.ReadLine()
 	if err != nil {
-		return Command{}, NewSyntaxError(err.Error())
+		s.recordEvent("connection read failed, %v", err)
+		s.hungUp = errors.Is(err, io.EOF)
+		return Command{}, NewServerError(fmt.Sprintf("error reading command %v", err))
 	}
+	s.recordClientLine(buff)
 	args := strings.Split(buff, " ")
 	command.Name = args[0]
 	command.Args = args[1:]
@@ -335,15 +448,17 @@ func (s *Session) HandleAuth(args []string, messageID string) error {
 				if err := s.Reply(StatusAuthChallenge, ""); err != nil {
 					return NewServerError(fmt.Sprintf("error sending auth challenge %v", err))
 				}
-				cmd, err := s.NextCMD()
+				cmd, err := s.nextCredential()
 				if err != nil {
 					return NewServerError(fmt.Sprintf("error receiving PLAIN credential %v", err))
 				}
 				cred = cmd.Name
 			}
-			if err := HandlePlainAuth(cred, s.Auth); err != nil {
+			username, err := HandlePlainAuth(cred, s.Auth)
+			if err != nil {
 				return s.handleAuthError(err)
 			}
+			s.Username = username
 			if err := s.Reply(StatusAuthSuccess, "Authentication successful"); err != nil {
 				return NewServerError(fmt.Sprintf("error sending auth challenge %v", err))
 			}
@@ -363,9 +478,11 @@ func (s *Session) HandleAuth(args []string, messageID string) error {
 			if err != nil {
 				return err
 			}
-			if err := HandleLoginAuth(username, password, s.Auth); err != nil {
+			username, err = HandleLoginAuth(username, password, s.Auth)
+			if err != nil {
 				return s.handleAuthError(err)
 			}
+			s.Username = username
 			if err := s.Reply(StatusAuthSuccess, "Authentication successful"); err != nil {
 				return NewServerError(fmt.Sprintf("error sending auth challenge %v", err))
 			}
@@ -375,13 +492,15 @@ func (s *Session) HandleAuth(args []string, messageID string) error {
 			if err := s.Reply(StatusAuthChallenge, string(challenge)); err != nil {
 				return NewServerError(fmt.Sprintf("error sending auth challenge %v", err))
 			}
-			cmd, err := s.NextCMD()
+			cmd, err := s.nextCredential()
 			if err != nil {
 				return NewServerError(fmt.Sprintf("error receiving PLAIN credential %v", err))
 			}
-			if err := HandleMD5CRAMAuth(cmd.Name, []byte(messageID), s.Auth); err != nil {
+			username, err := HandleMD5CRAMAuth(cmd.Name, []byte(messageID), s.Auth)
+			if err != nil {
 				return s.handleAuthError(err)
 			}
+			s.Username = username
 			if err := s.Reply(StatusAuthSuccess, "Authentication successful"); err != nil {
 				return NewServerError(fmt.Sprintf("error sending auth challenge %v", err))
 			}
@@ -399,12 +518,22 @@ func (s *Session) getLoginParameters(msg string) (string, error) {
 	if err := s.Reply(StatusAuthChallenge, msg); err != nil {
 		return "", NewServerError(fmt.Sprintf("error sending auth challenge %v", err))
 	}
-	cmd, err := s.NextCMD()
+	cmd, err := s.nextCredential()
 	if err != nil {
 		return "", NewServerError(fmt.Sprintf("error receiving Login credential %v", err))
 	}
 	return cmd.Name, nil
 }
+
+// nextCredential reads an AUTH response line, which is kept out of the transcript.
+func (s *Session) nextCredential() (Command, error) {
+	s.isReadingCredential = true
+	defer func() {
+		s.isReadingCredential = false
+	}()
+	return s.NextCMD()
+}
+
 func (s *Session) handleAuthError(err error) error {
 	if errors.As(err, &InvalidCredentialError{}) {
 		if err = s.Reply(StatusInvalidCredentialError, err.Error()); err != nil {
@@ -427,3 +556,62 @@ func (s *Session) checkAuthRequired() (bool, error) {
 	}
 	return false, nil
 }
+
+func (s *Session) resetTransaction() {
+	s.IsMailReceived = false
+	s.IsAtLeastOneRcptReceived = false
+}
+
+// checkSender applies the sender policy to an address claimed by the authenticated user.
+// A rejected address is answered with 553 and reported as not allowed, leaving the session open.
+// The null sender of bounces and notifications claims no address and is always allowed.
+func (s *Session) checkSender(sender string) (bool, error) {
+	if sender == "" {
+		return true, nil
+	}
+	if err := s.authorizeSender(sender); err != nil {
+		return false, s.replySenderError(err)
+	}
+	return true, nil
+}
+
+// checkFromHeader verifies every address in the From: header against the sender policy.
+func (s *Session) checkFromHeader(msg *mail.Message) (bool, error) {
+	if s.SenderPolicy == nil || !s.IsAuthenticated || msg.Header.Get("From") == "" {
+		return true, nil
+	}
+	senders := []string{msg.Header.Get("From")}
+	if addresses, err := msg.Header.AddressList("From"); err == nil {
+		senders = senders[:0]
+		for _, address := range addresses {
+			senders = append(senders, address.Address)
+		}
+	}
+	for _, sender := range senders {
+		if err := s.authorizeSender(sender); err != nil {
+			return false, s.replySenderError(err)
+		}
+	}
+	return true, nil
+}
+
+func (s *Session) authorizeSender(sender string) error {
+	if s.SenderPolicy == nil || !s.IsAuthenticated {
+		return nil
+	}
+	return s.SenderPolicy.AuthorizeSender(s.Username, sender)
+}
+
+func (s *Session) replySenderError(err error) error {
+	if errors.As(err, &SenderNotAllowedError{}) {
+		if err := s.Reply(StatusMailboxNameNotAllowed, err.Error()); err != nil {
+			return NewServerError(fmt.Sprintf("error sending reply %v", err))
+		}
+		return nil
+	}
+	log.Printf("error checking the sender %v", err)
+	if err := s.Reply(StatusLocalError, "unable to verify the sender"); err != nil {
+		return NewServerError(fmt.Sprintf("error sending reply %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package smtp
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// SessionFailed is a session ended by an error such as a dropped connection or a timeout.
+	SessionFailed = "failed"
+	// SessionRejected is a session in which the server refused a command, e.g. a RCPT or AUTH.
+	SessionRejected = "rejected"
+	// SessionAborted is a session closed by the client in the middle of a mail transaction.
+	SessionAborted = "aborted"
+)
+
+// SessionRecord describes a session that did not go through cleanly, so that a mail
+// which never arrived can be traced back to what happened on the wire.
+type SessionRecord struct {
+	SessionID     string
+	Outcome       string
+	Reason        string
+	ClientAddress string
+	Helo          string
+	Username      string
+	TLS           *TLSInfo
+	Sender        string
+	Recipient     []string
+	// Delivered is the number of mails accepted in the session before it ended.
+	Delivered  int
+	StartedAt  time.Time
+	EndedAt    time.Time
+	Transcript *Transcript
+}
+
+type SessionRecorder interface {
+	RecordSession(record *SessionRecord) error
+}
+
+// finishSession hands the transcript to the TranscriptReceiver and, when the session failed,
+// a record of it to the SessionRecorder. A session that got its mails accepted is not rejected
+// by the commands refused along the way.
+func (s *Session) finishSession(err error, envelope *Envelope) {
+	if s.Transcript == nil {
+		return
+	}
+	// replies sent after the session ended, like the unknown error reply of the server, are not recorded
+	transcript := s.Transcript
+	s.Transcript = nil
+	transcript.EndedAt = time.Now()
+	if s.TranscriptReceiver != nil {
+		if err := s.TranscriptReceiver.ReceiveTranscript(transcript); err != nil {
+			log.Printf("error persisting transcript %v", err)
+		}
+	}
+	if s.SessionRecorder == nil {
+		return
+	}
+	record := &SessionRecord{
+		SessionID:     s.ID,
+		ClientAddress: transcript.ClientAddress,
+		Helo:          s.Client,
+		Username:      s.Username,
+		Delivered:     s.delivered,
+		StartedAt:     transcript.StartedAt,
+		EndedAt:       transcript.EndedAt,
+		Transcript:    transcript,
+	}
+	if s.TLSState != nil {
+		record.TLS = NewTLSInfo(*s.TLSState)
+	}
+	if envelope != nil {
+		record.Sender = envelope.Sender
+		record.Recipient = envelope.Recipient
+	}
+	if err != nil && s.hungUp && s.delivered > 0 && !s.IsMailReceived {
+		// clients may hang up without QUIT once their mails are accepted
+		err = nil
+	}
+	switch {
+	case err != nil:
+		record.Outcome = SessionFailed
+		record.Reason = err.Error()
+	case s.IsMailReceived:
+		record.Outcome = SessionAborted
+		record.Reason = "session closed before the mail transaction completed"
+	case s.delivered == 0 && s.lastRejection != "":
+		record.Outcome = SessionRejected
+		record.Reason = s.lastRejection
+	default:
+		return
+	}
+	if err := s.SessionRecorder.RecordSession(record); err != nil {
+		log.Printf("error persisting session record %v", err)
+	}
+}
+
+// recordReply keeps the last 4xx or 5xx reply as the reason of a rejected session.
+func (s *Session) recordReply(statusCode int, statusLine string) {
+	if statusCode >= 400 {
+		s.lastRejection = fmt.Sprintf("%d %s", statusCode, statusLine)
+	}
+}
@@ -1,27 +1,33 @@
 package smtp
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"io/ioutil"
+	"math/big"
 	"net"
 	"net/smtp"
 	"net/textproto"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSession_HandleReset(t *testing.T) {
 	mailChan := make(chan *Envelope)
 	address := "localhost:20246"
+	ln, err := net.Listen("tcp", address)
+	require.NoError(t, err)
 	go func() {
-		ln, err := net.Listen("tcp", address)
-		assert.NoError(t, err)
 		conn, err := ln.Accept()
 		assert.NoError(t, err)
 		session := &Session{
@@ -72,7 +78,7 @@ func TestSession_HandleStartTLS(t *testing.T) {
 
 	mailChan := make(chan *Envelope)
 	address := "localhost:20247"
-	go startTesTLStServer(t, address, serverTLSConfig, mailChan, []string{}, nil, false)
+	startTesTLStServer(t, address, serverTLSConfig, mailChan, []string{}, nil, false)
 
 	c, err := smtp.Dial(address)
 	require.NoError(t, err)
@@ -122,7 +128,7 @@ func TestSession_HandleAuth(t *testing.T) {
 
 	mailChan := make(chan *Envelope)
 	address := "localhost:20248"
-	go startTesTLStServer(t, address, serverTLSConfig, mailChan, []string{"AUTH PLAIN LOGIN MD5-CRAM"}, testAuth, true)
+	startTesTLStServer(t, address, serverTLSConfig, mailChan, []string{"AUTH PLAIN LOGIN MD5-CRAM"}, testAuth, true)
 
 	testCases := []struct {
 		name      string
@@ -202,47 +208,526 @@ func TestSession_HandleAuth(t *testing.T) {
 	}
 }
 
-func startTesTLStServer(t *testing.T, address string, serverTLSConfig *tls.Config, mailChan chan *Envelope, exts []string, auth AuthenticationService, isSecure bool) {
-	ln, err := net.Listen("tcp", address)
-	assert.NoError(t, err)
-	for {
-		conn, err := ln.Accept()
-		assert.NoError(t, err)
+func TestSession_HandleSenderPolicy(t *testing.T) {
+	testAuth := NewTestAuthService()
+	username := "test"
+	password := []byte("test@123")
+	err := testAuth.AddUser(username, password)
+	require.NoError(t, err)
+	policy := &TestSenderPolicy{senders: map[string][]string{username: {"test@example.com"}}}
 
-		session := &Session{
+	mailChan := make(chan *Envelope)
+	address := "localhost:20249"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
+			conn:         conn,
+			Conn:         textproto.NewConn(conn),
+			Server:       "localhost",
+			Extensions:   []string{"AUTH CRAM-MD5"},
+			Auth:         testAuth,
+			SenderPolicy: policy,
+			Secure:       true,
+			Receiver: &TestMailReceiver{
+				mailChan: mailChan,
+			},
+		}
+	})
+
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	err = c.Hello("localhost")
+	require.NoError(t, err)
+	err = c.Auth(smtp.CRAMMD5Auth(username, string(password)))
+	require.NoError(t, err)
+
+	// the null sender of a bounce claims no address
+	err = c.Mail("")
+	require.NoError(t, err)
+	err = c.Reset()
+	require.NoError(t, err)
+
+	err = c.Mail("spoofed@example.com")
+	requireStatus(t, StatusMailboxNameNotAllowed, err)
+
+	err = c.Mail("test@example.com")
+	require.NoError(t, err)
+	err = c.Rcpt("rtest0@test.com")
+	require.NoError(t, err)
+	wc, err := c.Data()
+	require.NoError(t, err)
+	err = sendMessageBody(wc, "spoofed@example.com", "rtest0@test.com", "Test", strings.NewReader("Hi"))
+	requireStatus(t, StatusMailboxNameNotAllowed, err)
+
+	err = c.Mail("test@example.com")
+	require.NoError(t, err)
+	err = c.Rcpt("rtest1@test.com")
+	require.NoError(t, err)
+	wc, err = c.Data()
+	require.NoError(t, err)
+	err = sendMessageBody(wc, "test@example.com", "rtest1@test.com", "Test", strings.NewReader("Hi"))
+	require.NoError(t, err)
+	err = c.Quit()
+	require.NoError(t, err)
+
+	mail := <-mailChan
+	assert.Equal(t, "test@example.com", mail.Sender)
+	assert.Equal(t, "rtest1@test.com", mail.Recipient[0])
+}
+
+func TestSession_HandleRequireTLS(t *testing.T) {
+	serverTLSConfig, clientTLSConfig, err := getTestTLSConfig()
+	require.NoError(t, err)
+
+	mailChan := make(chan *Envelope)
+	address := "localhost:20250"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
+			conn:        conn,
+			Conn:        textproto.NewConn(conn),
+			Server:      "localhost",
+			TLSConfig:   serverTLSConfig,
+			TLSRequired: true,
+			Extensions:  []string{StartTLS},
+			Receiver: &TestMailReceiver{
+				mailChan: mailChan,
+			},
+		}
+	})
+
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	err = c.Hello("localhost")
+	require.NoError(t, err)
+	isRequireTLSSupported, _ := c.Extension(RequireTLS)
+	assert.False(t, isRequireTLSSupported)
+	err = c.Mail("test0@test.com")
+	requireStatus(t, StatusStartTLSRequired, err)
+
+	err = c.StartTLS(clientTLSConfig)
+	require.NoError(t, err)
+	isRequireTLSSupported, _ = c.Extension(RequireTLS)
+	assert.True(t, isRequireTLSSupported)
+	isTLSSupported, _ := c.Extension(StartTLS)
+	assert.False(t, isTLSSupported)
+
+	id, err := c.Text.Cmd("MAIL FROM:<test0@test.com> REQUIRETLS")
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(StatusOk)
+	c.Text.EndResponse(id)
+	require.NoError(t, err)
+	err = c.Rcpt("rtest0@test.com")
+	require.NoError(t, err)
+	wc, err := c.Data()
+	require.NoError(t, err)
+	err = sendMessageBody(wc, "test0@test.com", "rtest0@test.com", "Test", strings.NewReader("Hi"))
+	require.NoError(t, err)
+	err = c.Quit()
+	require.NoError(t, err)
+
+	mail := <-mailChan
+	assert.Equal(t, "test0@test.com", mail.Sender)
+	assert.True(t, mail.RequireTLS)
+}
+
+func TestSession_HandleStartTLSMinVersion(t *testing.T) {
+	serverTLSConfig, clientTLSConfig, err := getTestTLSConfig()
+	require.NoError(t, err)
+	server := Server{TLSConfig: serverTLSConfig, MinTLSVersion: tls.VersionTLS13}
+
+	address := "localhost:20251"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
+			conn:       conn,
+			Conn:       textproto.NewConn(conn),
+			Server:     "localhost",
+			TLSConfig:  server.tlsConfig(),
+			Extensions: []string{StartTLS},
+		}
+	})
+
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	clientTLSConfig.MaxVersion = tls.VersionTLS12
+	err = c.StartTLS(clientTLSConfig)
+	assert.Error(t, err)
+
+	c, err = smtp.Dial(address)
+	require.NoError(t, err)
+	clientTLSConfig.MaxVersion = tls.VersionTLS13
+	err = c.StartTLS(clientTLSConfig)
+	require.NoError(t, err)
+	state, ok := c.TLSConnectionState()
+	require.True(t, ok)
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	require.NoError(t, c.Quit())
+}
+
+func TestSession_RecordTLSInfo(t *testing.T) {
+	serverTLSConfig, clientTLSConfig, err := getTestTLSConfig()
+	require.NoError(t, err)
+	serverTLSConfig.ClientAuth = tls.RequestClientCert
+
+	mailChan := make(chan *Envelope)
+	address := "localhost:20252"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
 			conn:       conn,
 			Conn:       textproto.NewConn(conn),
 			Server:     "localhost",
 			TLSConfig:  serverTLSConfig,
-			Extensions: append(exts, StartTLS),
-			Auth:       auth,
-			Secure:     isSecure,
+			Extensions: []string{StartTLS},
 			Receiver: &TestMailReceiver{
 				mailChan: mailChan,
 			},
 		}
-		err = session.Handle()
-		if err != nil {
-			session.HandleUnknownError(err)
-			assert.Fail(t, err.Error())
-			close(mailChan)
+	})
+
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	err = c.StartTLS(clientTLSConfig)
+	require.NoError(t, err)
+	err = c.Mail("test0@test.com")
+	require.NoError(t, err)
+	err = c.Rcpt("rtest0@test.com")
+	require.NoError(t, err)
+	wc, err := c.Data()
+	require.NoError(t, err)
+	err = sendMessageBody(wc, "test0@test.com", "rtest0@test.com", "Test", strings.NewReader("Hi"))
+	require.NoError(t, err)
+	err = c.Quit()
+	require.NoError(t, err)
+
+	mail := <-mailChan
+	require.NotNil(t, mail.TLS)
+	assert.Equal(t, "TLS1.3", mail.TLS.Version)
+	assert.True(t, strings.HasPrefix(mail.TLS.CipherSuite, "TLS_"))
+	assert.Equal(t, "localhost", mail.TLS.ServerName)
+	assert.Equal(t, "CN=localhost,O=smtp-go", mail.TLS.ClientCertificate)
+	received := mail.Content.Header.Get("Received")
+	assert.Contains(t, received, "with ESMTPS (version=TLS1.3 cipher="+mail.TLS.CipherSuite)
+}
+
+func TestSession_TraceHeaders(t *testing.T) {
+	mailChan := make(chan *Envelope)
+	address := "localhost:20253"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
+			conn:        conn,
+			Conn:        textproto.NewConn(conn),
+			Server:      "mx.localhost",
+			DeliveredTo: true,
+			Receiver: &TestMailReceiver{
+				mailChan: mailChan,
+			},
 		}
+	})
+
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	err = c.Hello("client.localhost")
+	require.NoError(t, err)
+	err = c.Mail("test0@test.com")
+	require.NoError(t, err)
+	err = c.Rcpt("rtest0@test.com")
+	require.NoError(t, err)
+	err = c.Rcpt("rtest1@test.com")
+	require.NoError(t, err)
+	wc, err := c.Data()
+	require.NoError(t, err)
+	_, err = wc.Write([]byte("Received: from upstream by client.localhost; Tue, 5 Jan 2021 11:49:26 -0800\r\nSubject: Test\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	require.NoError(t, c.Quit())
+
+	mail := <-mailChan
+	assert.Equal(t, "<test0@test.com>", mail.Content.Header.Get("Return-Path"))
+	assert.Equal(t, []string{"rtest0@test.com", "rtest1@test.com"}, mail.Content.Header["Delivered-To"])
+	received := mail.Content.Header["Received"]
+	require.Equal(t, 2, len(received))
+	assert.Regexp(t, `^from client\.localhost \(\[127\.0\.0\.1\]\) by mx\.localhost \(smtp-go\) with ESMTP id <\d+@mx\.localhost>; `, received[0])
+	assert.NotContains(t, received[0], " for ")
+	date, err := time.Parse(time.RFC1123Z, received[0][strings.LastIndex(received[0], "; ")+2:])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), date, time.Minute)
+	assert.Equal(t, "from upstream by client.localhost; Tue, 5 Jan 2021 11:49:26 -0800", received[1])
+	assert.True(t, strings.HasPrefix(string(mail.Data), "Return-Path: <test0@test.com>\r\nDelivered-To: rtest0@test.com\r\n"))
+	assert.True(t, strings.HasSuffix(string(mail.Data), "Subject: Test\r\n\r\nHi\r\n"))
+}
+
+func TestSession_RecordEnvelope(t *testing.T) {
+	mailChan := make(chan *Envelope)
+	address := "localhost:20254"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
+			conn:   conn,
+			Conn:   textproto.NewConn(conn),
+			Server: "mx.localhost",
+			Receiver: &TestMailReceiver{
+				mailChan: mailChan,
+			},
+		}
+	})
+
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.localhost"))
+	command := func(format string, args ...interface{}) {
+		id, err := c.Text.Cmd(format, args...)
+		require.NoError(t, err)
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		_, _, err = c.Text.ReadResponse(StatusOk)
+		require.NoError(t, err)
+	}
+	command("MAIL FROM:<bounce@test.com> BODY=8BITMIME ENVID=abc")
+	command("RCPT TO:<rtest0@test.com> NOTIFY=SUCCESS,FAILURE")
+	command("RCPT TO:<bcc@test.com>")
+	wc, err := c.Data()
+	require.NoError(t, err)
+	_, err = wc.Write([]byte("To: rtest0@test.com\r\nSubject: Test\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	require.NoError(t, c.Quit())
+
+	mail := <-mailChan
+	assert.Equal(t, "bounce@test.com", mail.Sender)
+	assert.Equal(t, map[string]string{"BODY": "8BITMIME", "ENVID": "abc"}, mail.MailParams)
+	assert.Equal(t, []string{"rtest0@test.com", "bcc@test.com"}, mail.Recipient)
+	require.Equal(t, 2, len(mail.RecipientParams))
+	assert.Equal(t, map[string]string{"NOTIFY": "SUCCESS,FAILURE"}, mail.RecipientParams[0])
+	assert.Empty(t, mail.RecipientParams[1])
+	assert.Equal(t, "client.localhost", mail.Helo)
+	assert.True(t, strings.HasPrefix(mail.ClientAddress, "127.0.0.1:"))
+	assert.WithinDuration(t, time.Now(), mail.ReceivedAt, time.Minute)
+}
+
+func TestSession_RecordTranscript(t *testing.T) {
+	testAuth := NewTestAuthService()
+	username := "test"
+	password := []byte("test@123")
+	require.NoError(t, testAuth.AddUser(username, password))
+	mailChan := make(chan *Envelope)
+	transcriptChan := make(chan *Transcript, 1)
+	address := "localhost:20255"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
+			conn:               conn,
+			Conn:               textproto.NewConn(conn),
+			Server:             "localhost",
+			Extensions:         []string{"AUTH CRAM-MD5"},
+			Auth:               testAuth,
+			Secure:             true,
+			TranscriptReceiver: &TestTranscriptReceiver{transcriptChan: transcriptChan},
+			Receiver: &TestMailReceiver{
+				mailChan: mailChan,
+			},
+		}
+	})
+
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.localhost"))
+	require.NoError(t, c.Auth(smtp.CRAMMD5Auth(username, string(password))))
+	require.NoError(t, c.Mail("test0@test.com"))
+	require.NoError(t, c.Rcpt("rtest0@test.com"))
+	wc, err := c.Data()
+	require.NoError(t, err)
+	_, err = wc.Write([]byte("Subject: Test\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	require.NoError(t, c.Quit())
+
+	mail := <-mailChan
+	transcript := <-transcriptChan
+	assert.NotEmpty(t, transcript.SessionID)
+	assert.Equal(t, transcript.SessionID, mail.SessionID)
+	assert.True(t, strings.HasPrefix(transcript.ClientAddress, "127.0.0.1:"))
+	assert.False(t, transcript.EndedAt.Before(transcript.StartedAt))
+	var lines []string
+	for _, entry := range transcript.Entries {
+		lines = append(lines, entry.Direction+" "+entry.Line)
 	}
+	assert.Equal(t, "S 220 localhost ESMTP smtp-go", lines[0])
+	assert.Contains(t, lines, "C EHLO client.localhost")
+	assert.Contains(t, lines, "C AUTH CRAM-MD5")
+	assert.Contains(t, lines, "C <credential redacted>")
+	assert.Contains(t, lines, "C MAIL FROM:<test0@test.com>")
+	assert.Contains(t, lines, "* message data, 21 bytes")
+	assert.Equal(t, "S 221 localhost service closing transmission channel", lines[len(lines)-1])
+}
+
+func TestSession_RecordFailedSessions(t *testing.T) {
+	recordChan := make(chan *SessionRecord, 1)
+	address := "localhost:20256"
+	startTestServer(t, address, func(conn net.Conn) *Session {
+		return &Session{
+			conn:            conn,
+			Conn:            textproto.NewConn(conn),
+			Server:          "localhost",
+			SessionRecorder: &TestSessionRecorder{recordChan: recordChan},
+			Receiver:        &TestMailReceiver{mailChan: make(chan *Envelope, 1)},
+		}
+	})
+
+	// a clean session leaves no record
+	c, err := smtp.Dial(address)
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.localhost"))
+	require.NoError(t, c.Mail("test0@test.com"))
+	require.NoError(t, c.Rcpt("rtest0@test.com"))
+	wc, err := c.Data()
+	require.NoError(t, err)
+	_, err = wc.Write([]byte("Subject: Test\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	require.NoError(t, c.Quit())
+
+	// a rejected command
+	c, err = smtp.Dial(address)
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.localhost"))
+	id, err := c.Text.Cmd("VRFY rtest0@test.com")
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(StatusOk)
+	c.Text.EndResponse(id)
+	requireStatus(t, StatusCommandNotImplemented, err)
+	require.NoError(t, c.Quit())
+	record := <-recordChan
+	assert.Equal(t, SessionRejected, record.Outcome)
+	assert.Equal(t, "502 VRFY is not supported", record.Reason)
+	assert.Equal(t, "client.localhost", record.Helo)
+	assert.Equal(t, 0, record.Delivered)
+
+	// a client hanging up without QUIT once its mail is accepted, after a rejected command
+	c, err = smtp.Dial(address)
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.localhost"))
+	id, err = c.Text.Cmd("VRFY rtest0@test.com")
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(StatusOk)
+	c.Text.EndResponse(id)
+	requireStatus(t, StatusCommandNotImplemented, err)
+	require.NoError(t, c.Mail("test0@test.com"))
+	require.NoError(t, c.Rcpt("rtest0@test.com"))
+	wc, err = c.Data()
+	require.NoError(t, err)
+	_, err = wc.Write([]byte("Subject: Test\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	require.NoError(t, c.Close())
+
+	// a connection dropped in the middle of a transaction
+	c, err = smtp.Dial(address)
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.localhost"))
+	require.NoError(t, c.Mail("test0@test.com"))
+	require.NoError(t, c.Rcpt("rtest0@test.com"))
+	require.NoError(t, c.Close())
+	record = <-recordChan
+	assert.Equal(t, SessionFailed, record.Outcome)
+	assert.Contains(t, record.Reason, "EOF")
+	assert.Equal(t, "test0@test.com", record.Sender)
+	assert.Equal(t, []string{"rtest0@test.com"}, record.Recipient)
+	require.NotNil(t, record.Transcript)
+	last := record.Transcript.Entries[len(record.Transcript.Entries)-1]
+	assert.Equal(t, SessionEvent, last.Direction)
+	assert.Equal(t, "connection read failed, EOF", last.Line)
+	select {
+	case record = <-recordChan:
+		t.Errorf("unexpected session record %v", record)
+	default:
+	}
+}
+
+func startTestServer(t *testing.T, address string, newSession func(conn net.Conn) *Session) {
+	ln, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			session := newSession(conn)
+			err = session.Handle()
+			if err != nil {
+				session.HandleUnknownError(err)
+			}
+		}
+	}()
+}
+
+func requireStatus(t *testing.T, code int, err error) {
+	var protoErr *textproto.Error
+	require.True(t, errors.As(err, &protoErr), "expected a protocol error, got %v", err)
+	assert.Equal(t, code, protoErr.Code)
+}
+
+func startTesTLStServer(t *testing.T, address string, serverTLSConfig *tls.Config, mailChan chan *Envelope, exts []string, auth AuthenticationService, isSecure bool) {
+	ln, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			assert.NoError(t, err)
+
+			session := &Session{
+				conn:       conn,
+				Conn:       textproto.NewConn(conn),
+				Server:     "localhost",
+				TLSConfig:  serverTLSConfig,
+				Extensions: append(exts, StartTLS),
+				Auth:       auth,
+				Secure:     isSecure,
+				Receiver: &TestMailReceiver{
+					mailChan: mailChan,
+				},
+			}
+			err = session.Handle()
+			if err != nil {
+				session.HandleUnknownError(err)
+				assert.Fail(t, err.Error())
+				close(mailChan)
+			}
+		}
+	}()
 }
 
 func getTestTLSConfig() (*tls.Config, *tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair("../../resources/localhost.crt", "../../resources/localhost.pkcs8")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
 	}
-	serverTLSConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-
-	caPool := x509.NewCertPool()
-	pem, err := ioutil.ReadFile("../../resources/localhost.crt")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"smtp-go"}},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
 	if err != nil {
 		return nil, nil, err
 	}
-	caPool.AppendCertsFromPEM(pem)
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	serverTLSConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(leaf)
 	clientTLSConfig := serverTLSConfig.Clone()
 	clientTLSConfig.ServerName = "localhost"
 	clientTLSConfig.RootCAs = caPool
@@ -301,6 +786,24 @@ func (auth *TestAuthService) AddUser(username string, password []byte) error {
 	return nil
 }
 
+type TestTranscriptReceiver struct {
+	transcriptChan chan *Transcript
+}
+
+func (r *TestTranscriptReceiver) ReceiveTranscript(transcript *Transcript) error {
+	r.transcriptChan <- transcript
+	return nil
+}
+
+type TestSessionRecorder struct {
+	recordChan chan *SessionRecord
+}
+
+func (r *TestSessionRecorder) RecordSession(record *SessionRecord) error {
+	r.recordChan <- record
+	return nil
+}
+
 type TestMailReceiver struct {
 	mailChan chan *Envelope
 }
@@ -311,3 +814,16 @@ func (r *TestMailReceiver) Receive(mail *Envelope) error {
 	}()
 	return nil
 }
+
+type TestSenderPolicy struct {
+	senders map[string][]string
+}
+
+func (p *TestSenderPolicy) AuthorizeSender(username string, sender string) error {
+	for _, allowed := range p.senders[username] {
+		if allowed == sender {
+			return nil
+		}
+	}
+	return NewSenderNotAllowedError(fmt.Sprintf("%s is not allowed to send as <%s>", username, sender))
+}
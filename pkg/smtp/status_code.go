@@ -7,12 +7,16 @@ const (
 	StatusClose                  = 221
 	StatusAuthChallenge          = 334
 	StatusContinue               = 354
+	StatusLocalError             = 451
 	StatusTempAuthError          = 454
 	StatusSyntaxError            = 501
 	StatusCommandNotImplemented  = 502
 	StatusOutOfSequenceCmdError  = 503
 	StatusAuthRequired           = 503
+	StatusStartTLSRequired       = 530
 	StatusInvalidCredentialError = 535
 	StatusTLSRequired            = 538
+	StatusMailboxNameNotAllowed  = 553
 	StatusUnknownError           = 554
+	StatusParameterNotRecognized = 555
 )
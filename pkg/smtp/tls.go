@@ -0,0 +1,54 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version such as "1.2" or "TLS1.2" to its crypto/tls constant.
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(name), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %s", name)
+	}
+	return version, nil
+}
+
+// TLSVersionName returns the name of a crypto/tls version constant, e.g. TLS1.3.
+func TLSVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLS" + name
+		}
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// ParseCipherSuites converts IANA cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+// to their crypto/tls IDs. Cipher suites of TLS 1.3 are not configurable and are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite
+	}
+	var ids []uint16
+	for _, name := range names {
+		suite, ok := suites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suite %s of TLS 1.3 is not configurable", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
@@ -0,0 +1,29 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := ParseTLSVersion("1.2")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+	version, err = ParseTLSVersion("TLS1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+	_, err = ParseTLSVersion("3.0")
+	assert.Error(t, err)
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_rsa_with_aes_256_gcm_sha384"})
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, suites)
+	_, err = ParseCipherSuites([]string{"TLS_AES_128_GCM_SHA256"})
+	assert.Error(t, err)
+	_, err = ParseCipherSuites([]string{"NOT_A_SUITE"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// traceHeaders builds the trace fields of RFC 5321 section 4.4 for the message: Return-Path,
+// optionally a Delivered-To per recipient and the Received line of this hop, folded as in RFC 5322.
+// Lines end with CRLF like the rest of the message, see canonicalLineEndings.
+func (s *Session) traceHeaders(envelope *Envelope) []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "Return-Path: <%s>\r\n", envelope.Sender)
+	if s.DeliveredTo {
+		for _, recipient := range envelope.Recipient {
+			fmt.Fprintf(&buffer, "Delivered-To: %s\r\n", recipient)
+		}
+	}
+	fmt.Fprintf(&buffer, "Received: from %s (%s)\r\n", s.Client, s.remoteAddressLiteral())
+	fmt.Fprintf(&buffer, "\tby %s (smtp-go) with %s", s.Server, s.protocol(envelope))
+	if envelope.TLS != nil {
+		fmt.Fprintf(&buffer, "\r\n\t(%s)", envelope.TLS)
+	}
+	fmt.Fprintf(&buffer, "\r\n\tid %s", envelope.MessageID)
+	if envelope.Username != "" {
+		fmt.Fprintf(&buffer, "\r\n\t(authenticated as %s)", envelope.Username)
+	}
+	// the for clause would disclose the other recipients of a mail with several of them
+	if len(envelope.Recipient) == 1 {
+		fmt.Fprintf(&buffer, "\r\n\tfor <%s>", envelope.Recipient[0])
+	}
+	fmt.Fprintf(&buffer, ";\r\n\t%s\r\n", envelope.ReceivedAt.Format(time.RFC1123Z))
+	return buffer.Bytes()
+}
+
+// canonicalLineEndings puts back the CRLF line endings the dot reader turned into LF, so the message
+// is kept as it was sent (RFC 5322). Lines already ending with CRLF are left as they are.
+func canonicalLineEndings(data []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Grow(len(data) + bytes.Count(data, []byte("\n")))
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			buffer.WriteByte('\r')
+		}
+		buffer.WriteByte(b)
+	}
+	return buffer.Bytes()
+}
+
+// protocol returns the "with" keyword registered by RFC 3848 for the session.
+func (s *Session) protocol(envelope *Envelope) string {
+	if !s.IsExtendedHello {
+		return "SMTP"
+	}
+	protocol := "ESMTP"
+	if envelope.TLS != nil {
+		protocol += "S"
+	}
+	if envelope.Username != "" {
+		protocol += "A"
+	}
+	return protocol
+}
+
+func (s *Session) remoteAddressLiteral() string {
+	if s.conn == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return "unknown"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "[IPv6:" + host + "]"
+	}
+	return "[" + host + "]"
+}
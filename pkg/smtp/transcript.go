@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ClientLine   = "C"
+	ServerLine   = "S"
+	SessionEvent = "*"
+)
+
+// Transcript is the record of a whole SMTP session, kept for debugging misbehaving clients.
+type Transcript struct {
+	SessionID     string
+	ClientAddress string
+	StartedAt     time.Time
+	EndedAt       time.Time
+	Entries       []TranscriptEntry
+}
+
+type TranscriptEntry struct {
+	Time time.Time
+	// Direction is ClientLine, ServerLine or SessionEvent for things like the TLS upgrade.
+	Direction string
+	Line      string
+}
+
+type TranscriptReceiver interface {
+	ReceiveTranscript(transcript *Transcript) error
+}
+
+func (t *Transcript) add(direction, line string) {
+	t.Entries = append(t.Entries, TranscriptEntry{Time: time.Now(), Direction: direction, Line: line})
+}
+
+func (t *Transcript) String() string {
+	var builder strings.Builder
+	for _, entry := range t.Entries {
+		fmt.Fprintf(&builder, "%+.3fs %s: %s\n", entry.Time.Sub(t.StartedAt).Seconds(), entry.Direction, entry.Line)
+	}
+	return builder.String()
+}
+
+func newSessionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// recordClientLine adds a command line to the transcript, hiding AUTH credentials.
+func (s *Session) recordClientLine(line string) {
+	if s.Transcript == nil {
+		return
+	}
+	if s.isReadingCredential {
+		line = "<credential redacted>"
+	} else if fields := strings.Fields(line); len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		line = fields[0] + " " + fields[1] + " <credential redacted>"
+	}
+	s.Transcript.add(ClientLine, line)
+}
+
+func (s *Session) recordServerLine(line string) {
+	if s.Transcript != nil {
+		s.Transcript.add(ServerLine, line)
+	}
+}
+
+func (s *Session) recordEvent(format string, args ...interface{}) {
+	if s.Transcript != nil {
+		s.Transcript.add(SessionEvent, fmt.Sprintf(format, args...))
+	}
+}
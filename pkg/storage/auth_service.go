@@ -3,63 +3,256 @@ package storage
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"encoding"
+	"errors"
 	"fmt"
 	"github/ajanthan/smtp-go/pkg/smtp"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"strings"
 )
 
 type User struct {
 	gorm.Model
 	Username string
 	Password []byte
+	// CRAMSecret holds the HMAC-MD5 inner and outer digest states derived from the password,
+	// which lets CRAM-MD5 be verified without keeping the password in clear text.
+	CRAMSecret []byte
+	Disabled   bool
+	// Addresses lists the sender addresses (user@example.com) and domains (@example.com)
+	// bound to the user. The username itself is used when the list is empty.
+	Addresses Recipients `sql:"type:text"`
 }
 
-func (s *SQLiteStorage) Authenticate(username string, password []byte) error {
-	var user User
-	tx := s.Db.Where("username=?", username).Find(&user)
+func (s *GormStorage) Authenticate(username string, password []byte) error {
+	user, err := s.findActiveUser(username)
+	if err != nil {
+		return err
+	}
+	return user.checkPassword(password)
+}
+func (s *GormStorage) ValidateHMAC(username string, msg []byte, code []byte) error {
+	user, err := s.findActiveUser(username)
+	if err != nil {
+		return err
+	}
+	return user.checkHMAC(msg, code)
+}
+func (s *GormStorage) AddUser(username string, password []byte) error {
+	var count int64
+	tx := s.Db.Model(&User{}).Where("username=?", username).Count(&count)
 	if tx.Error != nil {
 		return tx.Error
 	}
-	err := bcrypt.CompareHashAndPassword(user.Password, password)
-	if err != nil {
-		return smtp.NewInvalidCredentialError("invalid credential")
+	if count > 0 {
+		return fmt.Errorf("user %s already exists", username)
+	}
+	user := &User{Username: username}
+	if err := user.setPassword(password); err != nil {
+		return err
+	}
+	tx = s.Db.Create(user)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (s *GormStorage) ListUsers() ([]User, error) {
+	var users []User
+	tx := s.Db.Order("username").Find(&users)
+	if tx.Error != nil {
+		return users, tx.Error
+	}
+	return users, nil
+}
+
+func (s *GormStorage) HasUsers() (bool, error) {
+	var count int64
+	tx := s.Db.Model(&User{}).Limit(1).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count > 0, nil
+}
+
+func (s *GormStorage) DeleteUser(username string) error {
+	tx := s.Db.Unscoped().Where("username=?", username).Delete(&User{})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	return nil
+}
+
+func (s *GormStorage) SetPassword(username string, password []byte) error {
+	user := &User{}
+	if err := user.setPassword(password); err != nil {
+		return err
+	}
+	return s.updateUser(username, map[string]interface{}{"Password": user.Password, "CRAMSecret": user.CRAMSecret})
+}
+
+func (s *GormStorage) SetUserDisabled(username string, disabled bool) error {
+	return s.updateUser(username, map[string]interface{}{"Disabled": disabled})
+}
+
+func (s *GormStorage) SetUserAddresses(username string, addresses []string) error {
+	return s.updateUser(username, map[string]interface{}{"Addresses": Recipients(addresses)})
+}
+
+func (s *GormStorage) updateUser(username string, values map[string]interface{}) error {
+	tx := s.Db.Model(&User{}).Where("username=?", username).Updates(values)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return fmt.Errorf("user %s does not exist", username)
 	}
 	return nil
 }
-func (s *SQLiteStorage) ValidateHMAC(username string, msg []byte, code []byte) error {
+
+func (s *GormStorage) findActiveUser(username string) (*User, error) {
+	var user User
+	tx := s.Db.Where("username=?", username).Find(&user)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 || user.Disabled {
+		return nil, smtp.NewInvalidCredentialError("invalid credential")
+	}
+	return &user, nil
+}
+
+func (s *GormStorage) AuthorizeSender(username string, sender string) error {
 	var user User
 	tx := s.Db.Where("username=?", username).Find(&user)
 	if tx.Error != nil {
 		return tx.Error
 	}
-	hmacEncoder := hmac.New(md5.New, user.Password)
-	hmacEncoder.Write(msg)
-	expectedCode := make([]byte, 0, hmacEncoder.Size())
-	expectedCode = hmacEncoder.Sum(expectedCode)
-	expectedCodeStr := []byte(fmt.Sprintf("%x", expectedCode))
+	if tx.RowsAffected == 0 || !user.CanSendAs(sender) {
+		return senderNotAllowed(username, sender)
+	}
+	return nil
+}
 
-	if len(expectedCodeStr) != len(code) {
-		return smtp.NewInvalidCredentialError("invalid credential")
+func senderNotAllowed(username string, sender string) error {
+	return smtp.NewSenderNotAllowedError(fmt.Sprintf("%s is not allowed to send as <%s>", username, sender))
+}
+
+func (u User) CanSendAs(sender string) bool {
+	return u.OwnsAddress(sender)
+}
+
+// OwnsAddress reports whether the address matches one of the addresses or domains bound to the user.
+// A user without bound addresses owns its username when it is an address, and nothing otherwise.
+func (u User) OwnsAddress(address string) bool {
+	addresses := u.Addresses
+	if len(addresses) == 0 {
+		if !strings.Contains(u.Username, "@") {
+			return false
+		}
+		addresses = Recipients{u.Username}
+	}
+	sender := strings.ToLower(strings.TrimSpace(address))
+	at := strings.LastIndex(sender, "@")
+	if at < 0 {
+		return false
 	}
-	for i, b := range code {
-		if b != expectedCodeStr[i] {
-			return smtp.NewInvalidCredentialError("invalid credential")
+	for _, bound := range addresses {
+		bound = strings.ToLower(strings.TrimSpace(bound))
+		if strings.HasPrefix(bound, "@") {
+			if sender[at:] == bound {
+				return true
+			}
+		} else if !strings.Contains(bound, "@") {
+			if sender[at+1:] == bound {
+				return true
+			}
+		} else if sender == bound {
+			return true
 		}
 	}
+	return false
+}
+
+func (u *User) checkPassword(password []byte) error {
+	if err := bcrypt.CompareHashAndPassword(u.Password, password); err != nil {
+		return smtp.NewInvalidCredentialError("invalid credential")
+	}
+	return nil
+}
+
+func (u *User) checkHMAC(msg []byte, code []byte) error {
+	expectedCode, err := cramMD5Digest(u.CRAMSecret, msg)
+	if err != nil {
+		return smtp.NewInvalidCredentialError("invalid credential")
+	}
+	if !hmac.Equal([]byte(fmt.Sprintf("%x", expectedCode)), code) {
+		return smtp.NewInvalidCredentialError("invalid credential")
+	}
 	return nil
 }
-func (s *SQLiteStorage) AddUser(username string, password []byte) (string, error) {
+
+func (u *User) setPassword(password []byte) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword(password, 10)
 	if err != nil {
-		return "", err
+		return err
 	}
-	tx := s.Db.Create(&User{
-		Username: username,
-		Password: hashedPassword,
-	})
-	if tx.Error != nil {
-		return "", tx.Error
+	cramSecret, err := newCRAMMD5Secret(password)
+	if err != nil {
+		return err
+	}
+	u.Password = hashedPassword
+	u.CRAMSecret = cramSecret
+	return nil
+}
+
+// newCRAMMD5Secret precomputes the HMAC-MD5 key schedule (RFC 2104) of the password:
+// the MD5 states after absorbing key^ipad and key^opad.
+func newCRAMMD5Secret(password []byte) ([]byte, error) {
+	key := password
+	if len(key) > md5.BlockSize {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+	ipad := make([]byte, md5.BlockSize)
+	opad := make([]byte, md5.BlockSize)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+	var secret []byte
+	for _, pad := range [][]byte{ipad, opad} {
+		state := md5.New()
+		state.Write(pad)
+		marshaled, err := state.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, marshaled...)
+	}
+	return secret, nil
+}
+
+func cramMD5Digest(secret []byte, msg []byte) ([]byte, error) {
+	if len(secret) == 0 || len(secret)%2 != 0 {
+		return nil, errors.New("missing CRAM-MD5 secret")
+	}
+	inner := md5.New()
+	if err := inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(secret[:len(secret)/2]); err != nil {
+		return nil, err
+	}
+	outer := md5.New()
+	if err := outer.(encoding.BinaryUnmarshaler).UnmarshalBinary(secret[len(secret)/2:]); err != nil {
+		return nil, err
 	}
-	return string(hashedPassword), nil
+	inner.Write(msg)
+	outer.Write(inner.Sum(nil))
+	return outer.Sum(nil), nil
 }
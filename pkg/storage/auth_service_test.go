@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"os"
+	"testing"
+)
+
+func TestUser_CanSendAs(t *testing.T) {
+	cases := []struct {
+		user    User
+		sender  string
+		allowed bool
+	}{
+		{user: User{Username: "alice@example.com"}, sender: "alice@example.com", allowed: true},
+		{user: User{Username: "alice@example.com"}, sender: "Alice@Example.com", allowed: true},
+		{user: User{Username: "alice@example.com"}, sender: "bob@example.com", allowed: false},
+		{user: User{Username: "example.com"}, sender: "bob@example.com", allowed: false},
+		{user: User{Username: "alice"}, sender: "alice@example.com", allowed: false},
+		{user: User{Username: "alice", Addresses: Recipients{"alice@example.com"}}, sender: "alice@example.com", allowed: true},
+		{user: User{Username: "alice", Addresses: Recipients{"@example.com"}}, sender: "bob@example.com", allowed: true},
+		{user: User{Username: "alice", Addresses: Recipients{"example.com"}}, sender: "bob@example.com", allowed: true},
+		{user: User{Username: "alice", Addresses: Recipients{"@example.com"}}, sender: "bob@sub.example.com", allowed: false},
+		{user: User{Username: "alice", Addresses: Recipients{"@example.com"}}, sender: "", allowed: false},
+	}
+	for _, test := range cases {
+		assert.Equal(t, test.allowed, test.user.CanSendAs(test.sender), "%v as %s", test.user.Addresses, test.sender)
+	}
+}
+
+func TestSQLiteStorage_AuthorizeSender(t *testing.T) {
+	dbFile := "/tmp/testusers.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	err = storage.AddUser("alice", []byte("secret"))
+	require.NoError(t, err)
+	err = storage.SetUserAddresses("alice", []string{"alice@example.com", "@test.com"})
+	require.NoError(t, err)
+
+	assert.NoError(t, storage.AuthorizeSender("alice", "alice@example.com"))
+	assert.NoError(t, storage.AuthorizeSender("alice", "any@test.com"))
+	err = storage.AuthorizeSender("alice", "bob@example.com")
+	assert.True(t, errors.As(err, &smtp.SenderNotAllowedError{}))
+	err = storage.AuthorizeSender("mallory", "alice@example.com")
+	assert.True(t, errors.As(err, &smtp.SenderNotAllowedError{}))
+	assert.Error(t, storage.SetUserAddresses("mallory", []string{"@test.com"}))
+}
+
+func TestSQLiteStorage_UserManagement(t *testing.T) {
+	dbFile := "/tmp/testusermanagement.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	require.NoError(t, storage.AddUser("bob", []byte("bob@123")))
+	require.NoError(t, storage.AddUser("alice", []byte("alice@123")))
+	assert.Error(t, storage.AddUser("alice", []byte("other")))
+
+	users, err := storage.ListUsers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(users))
+	assert.Equal(t, "alice", users[0].Username)
+	assert.Equal(t, "bob", users[1].Username)
+
+	challenge := []byte("<1896.697170952@postoffice.example.net>")
+	assert.NoError(t, storage.Authenticate("alice", []byte("alice@123")))
+	assert.NoError(t, storage.ValidateHMAC("alice", challenge, cramMD5Response("alice@123", challenge)))
+	assert.Error(t, storage.ValidateHMAC("alice", challenge, cramMD5Response("wrong", challenge)))
+
+	require.NoError(t, storage.SetPassword("alice", []byte("changed")))
+	assert.Error(t, storage.Authenticate("alice", []byte("alice@123")))
+	assert.NoError(t, storage.Authenticate("alice", []byte("changed")))
+	assert.NoError(t, storage.ValidateHMAC("alice", challenge, cramMD5Response("changed", challenge)))
+
+	require.NoError(t, storage.SetUserDisabled("alice", true))
+	err = storage.Authenticate("alice", []byte("changed"))
+	assert.True(t, errors.As(err, &smtp.InvalidCredentialError{}))
+	err = storage.ValidateHMAC("alice", challenge, cramMD5Response("changed", challenge))
+	assert.True(t, errors.As(err, &smtp.InvalidCredentialError{}))
+	require.NoError(t, storage.SetUserDisabled("alice", false))
+	assert.NoError(t, storage.Authenticate("alice", []byte("changed")))
+
+	require.NoError(t, storage.DeleteUser("alice"))
+	assert.Error(t, storage.DeleteUser("alice"))
+	assert.Error(t, storage.Authenticate("alice", []byte("changed")))
+	require.NoError(t, storage.AddUser("alice", []byte("again")))
+	assert.Error(t, storage.SetPassword("mallory", []byte("secret")))
+}
+
+func cramMD5Response(password string, challenge []byte) []byte {
+	d := hmac.New(md5.New, []byte(password))
+	d.Write(challenge)
+	return []byte(fmt.Sprintf("%x", d.Sum(nil)))
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Blob counts the contents referencing a file of the blob store, the file is removed with the last reference.
+type Blob struct {
+	Key       string `gorm:"primarykey"`
+	Size      int
+	RefCount  int
+	CreatedAt time.Time
+}
+
+// BlobStore keeps the data of contents and compressed raw messages larger than Threshold bytes in files
+// named by its SHA-256, so identical attachments received in many mails are stored once.
+type BlobStore struct {
+	Root      string
+	Threshold int
+	// mu keeps a file from being collected while a mail referencing the same data is persisted.
+	mu sync.Mutex
+}
+
+func NewBlobStore(root string, threshold int) (*BlobStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &BlobStore{Root: root, Threshold: threshold}, nil
+}
+
+func (b *BlobStore) Get(key string) ([]byte, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (b *BlobStore) put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	path, _ := b.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return key, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return key, os.Rename(file.Name(), path)
+}
+
+// path spreads the files over directories named by the first byte of the key.
+func (b *BlobStore) path(key string) (string, error) {
+	if _, err := hex.DecodeString(key); err != nil || len(key) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(b.Root, key[:2], key), nil
+}
+
+// lockBlobs serializes the changes to the blob references, it returns the unlock function.
+func (s GormStorage) lockBlobs() func() {
+	if s.Blobs == nil {
+		return func() {}
+	}
+	s.Blobs.mu.Lock()
+	return s.Blobs.mu.Unlock
+}
+
+// storeBlobs moves the data of the large contents and raw message of the mail to the blob store and counts
+// their references. The data is cleared so it is not saved in the rows, the returned function puts it back.
+func (s GormStorage) storeBlobs(tx *gorm.DB, mail *Mail) (func(), error) {
+	var moved []*[]byte
+	var data [][]byte
+	restore := func() {
+		for i, field := range moved {
+			*field = data[i]
+		}
+	}
+	if s.Blobs == nil {
+		return restore, nil
+	}
+	move := func(field *[]byte, blobKey *string) error {
+		if len(*field) <= s.Blobs.Threshold {
+			return nil
+		}
+		key, err := s.putBlob(tx, *field)
+		if err != nil {
+			return err
+		}
+		*blobKey = key
+		moved = append(moved, field)
+		data = append(data, *field)
+		*field = nil
+		return nil
+	}
+	for _, content := range mail.contents() {
+		if err := move(&content.Data, &content.BlobKey); err != nil {
+			return restore, err
+		}
+	}
+	if mail.Raw != nil {
+		if err := move(&mail.Raw.Data, &mail.Raw.BlobKey); err != nil {
+			return restore, err
+		}
+	}
+	return restore, nil
+}
+
+// putBlob writes the data to the blob store and counts a reference to it. The file is checked again once the
+// reference row is written: another process releasing the last reference removes the file before its
+// transaction ends, so a file found missing here was removed in between and is written again.
+func (s GormStorage) putBlob(tx *gorm.DB, data []byte) (string, error) {
+	key, err := s.Blobs.put(data)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"ref_count": gorm.Expr("ref_count + 1")}),
+	}).Create(&Blob{Key: key, Size: len(data), RefCount: 1}).Error
+	if err != nil {
+		return "", err
+	}
+	return s.Blobs.put(data)
+}
+
+// releaseBlobs drops a reference for every key and removes the blobs left without references. It is the last
+// step of the transaction: the files are removed while the deleted rows are still locked, so a process counting
+// a new reference to one of them waits for the commit and finds the file missing, see putBlob.
+func (s GormStorage) releaseBlobs(tx *gorm.DB, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, key := range keys {
+		if err := tx.Model(&Blob{}).Where("key=?", key).Update("RefCount", gorm.Expr("ref_count - 1")).Error; err != nil {
+			return err
+		}
+	}
+	var unused []string
+	if err := tx.Model(&Blob{}).Where("key IN ? AND ref_count <= 0", keys).Pluck("key", &unused).Error; err != nil {
+		return err
+	}
+	if len(unused) > 0 {
+		if err := tx.Where("key IN ?", unused).Delete(&Blob{}).Error; err != nil {
+			return err
+		}
+	}
+	s.removeBlobs(unused)
+	return nil
+}
+
+// removeBlobs removes the files of released blobs, the caller holds the blob lock.
+func (s GormStorage) removeBlobs(keys []string) {
+	if s.Blobs == nil {
+		return
+	}
+	for _, key := range keys {
+		if path, err := s.Blobs.path(key); err == nil {
+			_ = os.Remove(path)
+		}
+	}
+}
+
+// loadBlob reads the data of a content kept in the blob store.
+func (s GormStorage) loadBlob(content *Content) error {
+	if content == nil || content.BlobKey == "" {
+		return nil
+	}
+	if s.Blobs == nil {
+		return fmt.Errorf("content %s is kept in a blob store but none is configured", content.BlobKey)
+	}
+	data, err := s.Blobs.Get(content.BlobKey)
+	if err != nil {
+		return err
+	}
+	content.Data = data
+	return nil
+}
+
+// CollectBlobs removes the blob files no content references, left behind by mails that failed to persist or
+// by a database restored from a backup. It returns the number of removed files. The files written in the last
+// grace period are kept: the lock only serializes this process, and a server sharing the blob store writes
+// the file of a mail before it commits the reference to it.
+func (s GormStorage) CollectBlobs(grace time.Duration) (int, error) {
+	if s.Blobs == nil {
+		return 0, nil
+	}
+	defer s.lockBlobs()()
+	var keys []string
+	if err := s.Db.Model(&Blob{}).Where("ref_count > 0").Pluck("key", &keys).Error; err != nil {
+		return 0, err
+	}
+	referenced := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		referenced[key] = true
+	}
+	removed := 0
+	cutoff := time.Now().Add(-grace)
+	err := filepath.Walk(s.Blobs.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || referenced[info.Name()] || info.ModTime().After(cutoff) {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	return removed, s.Db.Where("ref_count <= 0").Delete(&Blob{}).Error
+}
+
+// contents lists the contents of the bodies, alternatives, embedded files and attachments of the mail.
+func (m *Mail) contents() []*Content {
+	bodies := []*Body{m.Body}
+	for _, alternative := range m.Alternatives {
+		if alternative != nil {
+			bodies = append(bodies, alternative.Body)
+		}
+	}
+	var contents []*Content
+	for _, body := range bodies {
+		if body == nil {
+			continue
+		}
+		if body.Content != nil {
+			contents = append(contents, body.Content)
+		}
+		for _, embed := range body.Embeds {
+			if embed.Content != nil {
+				contents = append(contents, embed.Content)
+			}
+		}
+		for _, attachment := range body.Attachments {
+			if attachment.Content != nil {
+				contents = append(contents, attachment.Content)
+			}
+		}
+	}
+	return contents
+}
+
+// dirSize sums the sizes of the files under the directory.
+func dirSize(root string) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage_Blobs(t *testing.T) {
+	dbFile := fmt.Sprintf("/tmp/testblobs%d.db", time.Now().UnixNano())
+	root, err := ioutil.TempDir("", "blobs")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.Remove(dbFile)
+		_ = os.RemoveAll(root)
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	storage.Blobs, err = NewBlobStore(root, 100)
+	require.NoError(t, err)
+
+	receiver := &DBReceiver{Storage: storage}
+	for i := 0; i < 2; i++ {
+		err = receiver.Receive(&smtp.Envelope{Sender: "test1@test.com", Recipient: []string{"test2@test.com"}, Data: []byte(mailWithAttachment)})
+		require.NoError(t, err)
+	}
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mails))
+	parsed, err := NewMailFromRaw([]byte(mailWithAttachment))
+	require.NoError(t, err)
+
+	// the attachment and the identical raw messages are stored once and the small body stays in its row
+	files := blobFiles(t, root)
+	require.Equal(t, 2, len(files))
+	var blobs []Blob
+	require.NoError(t, storage.Db.Order("key").Find(&blobs).Error)
+	require.Equal(t, 2, len(blobs))
+	for i, blob := range blobs {
+		assert.Equal(t, 2, blob.RefCount)
+		assert.FileExists(t, filepath.Join(root, blob.Key[:2], blob.Key), i)
+	}
+	for _, table := range []interface{}{&Attachment{}, &RawMessage{}} {
+		var data [][]byte
+		require.NoError(t, storage.Db.Model(table).Pluck("data", &data).Error)
+		require.Equal(t, 2, len(data))
+		for _, d := range data {
+			assert.Empty(t, d)
+		}
+	}
+	for _, mail := range mails {
+		raw, err := storage.GetRawByMailID(mail.ID)
+		require.NoError(t, err)
+		assert.Equal(t, mailWithAttachment, string(raw))
+		attachments, err := storage.GetAttachmentsByMailID(mail.ID)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(attachments))
+		assert.Equal(t, parsed.Body.Attachments[0].Data, attachments[0].Data)
+		body, err := storage.GetBodyByMailID(mail.ID)
+		require.NoError(t, err)
+		assert.Equal(t, parsed.Body.Data, body.Data)
+		assert.Empty(t, body.BlobKey)
+	}
+
+	require.NoError(t, storage.Reparse(mails[0].ID))
+	require.NoError(t, storage.Db.Find(&blobs).Error)
+	assert.Equal(t, 2, blobs[0].RefCount)
+	assert.Equal(t, 2, blobs[1].RefCount)
+	require.NoError(t, storage.Delete(mails[0].ID))
+	require.NoError(t, storage.Db.Find(&blobs).Error)
+	assert.Equal(t, 1, blobs[0].RefCount)
+	assert.Equal(t, 1, blobs[1].RefCount)
+	assert.Equal(t, 2, len(blobFiles(t, root)))
+	require.NoError(t, storage.Delete(mails[1].ID))
+	require.NoError(t, storage.Db.Find(&blobs).Error)
+	assert.Empty(t, blobs)
+	assert.Empty(t, blobFiles(t, root))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "ab"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "ab", "orphan"), []byte("orphan"), 0600))
+	removed, err := storage.CollectBlobs(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = storage.CollectBlobs(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Empty(t, blobFiles(t, root))
+
+	// another process releasing the last reference removes the file between the write and the new reference
+	err = storage.Db.Callback().Create().Before("gorm:create").Register("test:remove_blob", func(db *gorm.DB) {
+		if blob, ok := db.Statement.Dest.(*Blob); ok {
+			_ = os.Remove(filepath.Join(root, blob.Key[:2], blob.Key))
+		}
+	})
+	require.NoError(t, err)
+	err = receiver.Receive(&smtp.Envelope{Sender: "test1@test.com", Recipient: []string{"test2@test.com"}, Data: []byte(mailWithAttachment)})
+	require.NoError(t, err)
+	mails, err = storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	raw, err := storage.GetRawByMailID(mails[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, mailWithAttachment, string(raw))
+	assert.Equal(t, 2, len(blobFiles(t, root)))
+}
+
+func blobFiles(t *testing.T, root string) []string {
+	files, err := filepath.Glob(filepath.Join(root, "*", "*"))
+	require.NoError(t, err)
+	return files
+}
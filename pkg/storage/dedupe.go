@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// contentHash identifies a message among the deliveries retried by a mailer: it hashes the Message-ID,
+// the envelope and the message without its header, which holds the trace fields stamped on every delivery.
+// It is empty when the message was not received as raw data.
+func contentHash(messageID string, envelope *smtp.Envelope) string {
+	if envelope.Data == nil {
+		return ""
+	}
+	content := envelope.Data
+	for _, separator := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+		if i := bytes.Index(envelope.Data, separator); i >= 0 {
+			content = envelope.Data[i+len(separator):]
+			break
+		}
+	}
+	recipients := append([]string{}, envelope.Recipient...)
+	sort.Strings(recipients)
+	hash := sha256.New()
+	for _, field := range append([]string{normalizeMessageID(messageID), envelope.Sender}, recipients...) {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// findDuplicate returns the latest mail with the content hash received within the window, nil when there is none.
+func findDuplicate(store MailStore, hash string, window time.Duration) (*Mail, error) {
+	page, err := store.FindMails(MailQuery{ContentHash: hash, After: time.Now().Add(-window), Descending: true, Limit: 1})
+	if err != nil || len(page.Mails) == 0 {
+		return nil, err
+	}
+	return &page.Mails[0], nil
+}
+
+// hashLocks serializes the deliveries of a message, so parallel retries do not both miss the mail
+// the other one is persisting.
+type hashLocks struct {
+	mu    sync.Mutex
+	locks map[string]*hashLock
+}
+
+type hashLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the hash and returns the unlock function.
+func (l *hashLocks) lock(hash string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*hashLock)
+	}
+	lock, ok := l.locks[hash]
+	if !ok {
+		lock = &hashLock{}
+		l.locks[hash] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(l.locks, hash)
+		}
+		l.mu.Unlock()
+	}
+}
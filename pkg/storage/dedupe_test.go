@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"testing"
+)
+
+func TestContentHash(t *testing.T) {
+	envelope := func(data string, recipients ...string) *smtp.Envelope {
+		return &smtp.Envelope{Sender: "a@test.com", Recipient: recipients, Data: []byte(data)}
+	}
+	hash := contentHash("<1@test.com>", envelope("Received: by one\r\nSubject: Hi\r\n\r\nHello\r\n", "b@test.com", "c@test.com"))
+	assert.NotEmpty(t, hash)
+	assert.Equal(t, hash, contentHash("1@test.com", envelope("Received: by two\r\nSubject: Hi\r\n\r\nHello\r\n", "c@test.com", "b@test.com")))
+	assert.NotEqual(t, hash, contentHash("<2@test.com>", envelope("Subject: Hi\r\n\r\nHello\r\n", "b@test.com", "c@test.com")))
+	assert.NotEqual(t, hash, contentHash("<1@test.com>", envelope("Subject: Hi\r\n\r\nHello!\r\n", "b@test.com", "c@test.com")))
+	assert.NotEqual(t, hash, contentHash("<1@test.com>", envelope("Subject: Hi\r\n\r\nHello\r\n", "b@test.com")))
+	assert.Empty(t, contentHash("<1@test.com>", &smtp.Envelope{}))
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MailEnvelope is the SMTP envelope a mail was delivered with. Unlike the From and To headers
+// it includes BCC recipients and the bounce address.
+type MailEnvelope struct {
+	gorm.Model
+	MailID uint
+	// MailFrom is the reverse path of the MAIL command, empty for bounces.
+	MailFrom      string
+	MailParams    string
+	Helo          string
+	ClientAddress string
+	AuthUser      string
+	ReceivedAt    time.Time
+	Recipients    []*EnvelopeRecipient
+}
+
+type EnvelopeRecipient struct {
+	gorm.Model
+	MailEnvelopeID uint
+	Address        string
+	Params         string
+}
+
+func NewMailEnvelope(envelope *smtp.Envelope) *MailEnvelope {
+	mailEnvelope := &MailEnvelope{
+		MailFrom:      envelope.Sender,
+		MailParams:    formatParams(envelope.MailParams),
+		Helo:          envelope.Helo,
+		ClientAddress: envelope.ClientAddress,
+		AuthUser:      envelope.Username,
+		ReceivedAt:    envelope.ReceivedAt,
+	}
+	if mailEnvelope.ReceivedAt.IsZero() {
+		mailEnvelope.ReceivedAt = time.Now()
+	}
+	for i, address := range envelope.Recipient {
+		recipient := &EnvelopeRecipient{Address: address}
+		if i < len(envelope.RecipientParams) {
+			recipient.Params = formatParams(envelope.RecipientParams[i])
+		}
+		mailEnvelope.Recipients = append(mailEnvelope.Recipients, recipient)
+	}
+	return mailEnvelope
+}
+
+// formatParams writes ESMTP parameters back in their command form, e.g. "BODY=8BITMIME SMTPUTF8".
+func formatParams(params map[string]string) string {
+	var formatted []string
+	for key, value := range params {
+		if value == "" {
+			formatted = append(formatted, key)
+		} else {
+			formatted = append(formatted, key+"="+value)
+		}
+	}
+	sort.Strings(formatted)
+	return strings.Join(formatted, " ")
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// Header is a single header field of a mail. Repeated fields are kept as separate rows in the order
+// they appear in the message.
+type Header struct {
+	ID       uint `gorm:"primarykey"`
+	MailID   uint `gorm:"index"`
+	Position int
+	// Name is the canonical form of the field name, e.g. X-Campaign-Id.
+	Name string `gorm:"index"`
+	// Value is unfolded and has RFC 2047 encoded words decoded.
+	Value string
+	// Raw is the field body as it appears in the message, including folding.
+	Raw string
+}
+
+// HeaderFilter matches mails having a header field with the given value, or with any value when Value is empty.
+type HeaderFilter struct {
+	Name  string
+	Value string
+}
+
+// ParseHeaderFilter reads a filter written as Name:Value, or Name alone to match any value.
+func ParseHeaderFilter(filter string) HeaderFilter {
+	parts := strings.SplitN(filter, ":", 2)
+	parsed := HeaderFilter{Name: strings.TrimSpace(parts[0])}
+	if len(parts) > 1 {
+		parsed.Value = strings.TrimSpace(parts[1])
+	}
+	return parsed
+}
+
+// parseHeaders reads the header section of a raw message without merging repeated fields.
+func parseHeaders(raw []byte) ([]*Header, error) {
+	var headers []*Header
+	var current *Header
+	reader := bufio.NewReader(bytes.NewReader(raw))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+		if (trimmed[0] == ' ' || trimmed[0] == '\t') && current != nil {
+			current.Raw += "\n" + trimmed
+		} else if i := strings.IndexByte(trimmed, ':'); i > 0 {
+			current = &Header{
+				Position: len(headers),
+				Name:     textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(trimmed[:i])),
+				Raw:      strings.TrimLeft(trimmed[i+1:], " \t"),
+			}
+			headers = append(headers, current)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	decoder := new(mime.WordDecoder)
+	for _, header := range headers {
+		unfolded := strings.Join(strings.Fields(header.Raw), " ")
+		decoded, err := decoder.DecodeHeader(unfolded)
+		if err != nil {
+			decoded = unfolded
+		}
+		header.Value = decoded
+	}
+	return headers, nil
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	raw := "Received: from b by c\r\nReceived: from a\r\n\tby b\r\nx-campaign-id: 42\r\n" +
+		"Subject: =?UTF-8?Q?Caf=C3=A9?= menu\r\nBroken line\r\n\r\nBody: not a header\r\n"
+	headers, err := parseHeaders([]byte(raw))
+	require.NoError(t, err)
+	require.Equal(t, 4, len(headers))
+	assert.Equal(t, &Header{Position: 0, Name: "Received", Value: "from b by c", Raw: "from b by c"}, headers[0])
+	assert.Equal(t, &Header{Position: 1, Name: "Received", Value: "from a by b", Raw: "from a\n\tby b"}, headers[1])
+	assert.Equal(t, "X-Campaign-Id", headers[2].Name)
+	assert.Equal(t, "42", headers[2].Value)
+	assert.Equal(t, "Café menu", headers[3].Value)
+	assert.Equal(t, "=?UTF-8?Q?Caf=C3=A9?= menu", headers[3].Raw)
+}
@@ -15,10 +15,59 @@ type Mail struct {
 	From         string
 	ReplyTo      string
 	Subject      string
-	MessageID    string
+	MessageID    string `gorm:"index"`
+	Received     string
+	ReturnPath   string
+	DeliveredTo  Recipients `sql:"type:text"`
 	To           Recipients `sql:"type:text"`
+	Headers      []*Header  `json:"-"`
 	Body         *Body
 	Alternatives []*Alternative
+	// Envelope is the SMTP envelope, kept apart from the header fields above.
+	Envelope *MailEnvelope
+	// SessionID links the mail to the transcript of the session it was received in.
+	SessionID string `gorm:"index"`
+	// Owner is the user that authenticated to submit the mail.
+	Owner string
+	// Mailboxes are the local users whose addresses matched one of the envelope recipients.
+	Mailboxes []*Mailbox
+	// Size is the size of the raw message in bytes, kept in Raw.
+	Size int
+	Raw  *RawMessage `json:"-"`
+	// TLS is the TLS session the mail was received on, empty for plain connections.
+	TLS TLSDetails `gorm:"embedded;embeddedPrefix:tls_"`
+	// Seen, Starred and Trashed are the S, F and T flags of the message in a Maildir. Trashed mails are
+	// kept until they are deleted, mail clients expunge them from a Maildir.
+	Seen    bool
+	Starred bool
+	Trashed bool
+	Tags    Tags
+	// InReplyTo and References are the message identifiers of the In-Reply-To and References fields,
+	// which thread the mail, see BuildThreads.
+	InReplyTo  string
+	References MessageIDs `gorm:"column:reference_ids"`
+	// ThreadID names the thread of the mail when it is stored, see threadID.
+	ThreadID string `gorm:"index"`
+	// ContentHash identifies the message among the deliveries retried by a mailer, see DBReceiver.DedupeWindow.
+	ContentHash string `gorm:"index"`
+	// Duplicates counts the deliveries of the message after the first one, which were not stored again.
+	Duplicates int
+	// ArchiveState tracks the upload of a mail selected by DBReceiver.ArchiveFilters, empty for the others.
+	ArchiveState string `gorm:"index"`
+}
+
+type TLSDetails struct {
+	Version           string
+	CipherSuite       string
+	ServerName        string
+	ClientCertificate string
+	ClientIssuer      string
+}
+
+type Mailbox struct {
+	gorm.Model
+	MailID   uint
+	Username string
 }
 
 type Recipients []string
@@ -61,7 +110,9 @@ type Body struct {
 }
 
 type Content struct {
-	Data        []byte
+	Data []byte
+	// BlobKey names the blob the data is kept in when it is too large for the row.
+	BlobKey     string `json:"-"`
 	ContentType string
 	Encoding    string
 	Type        string
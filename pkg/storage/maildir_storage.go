@@ -0,0 +1,814 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MaildirSeen    = 'S'
+	MaildirTrashed = 'T'
+	MaildirFlagged = 'F'
+	MaildirReplied = 'R'
+
+	// maildirIndexDir keeps the index, a file per message named after its ID and the last ID given.
+	maildirIndexDir = ".smtp-go-index"
+	// maildirIndexFile is the single index file of earlier versions, moved into maildirIndexDir.
+	maildirIndexFile = ".smtp-go-index.json"
+)
+
+// Accounts is the part of a Storage that is kept outside the Maildir.
+type Accounts interface {
+	UserStore
+	SessionStore
+}
+
+// MaildirStorage writes every accepted message into a Maildir (tmp, then new) so that mail tools can
+// work on them, and keeps a sidecar index of the parsed fields for listing them through the API, a file
+// per message so a change rewrites the entry of that message only.
+// Users and sessions have no place in a Maildir and are kept by Accounts.
+type MaildirStorage struct {
+	Accounts
+	Root string
+	// PerRecipient delivers into one Maildir per envelope recipient, Root/<address>, instead of Root itself.
+	PerRecipient bool
+
+	mu    sync.Mutex
+	index maildirIndex
+}
+
+type maildirIndex struct {
+	LastID  uint
+	Entries map[uint]*maildirEntry
+}
+
+type maildirEntry struct {
+	Mail    Mail
+	Headers []Header
+	// Files are the message files relative to Root, one per Maildir the message was delivered to.
+	Files []string
+	// Attachments counts the attachments of the main body.
+	Attachments int
+	// Text is what the mail is searched by, so searches need not parse the messages.
+	Text *MailText `json:",omitempty"`
+}
+
+var _ Storage = &MaildirStorage{}
+
+var maildirCounter uint64
+
+func NewMaildirStorage(root string, perRecipient bool, accounts Accounts) (*MaildirStorage, error) {
+	s := &MaildirStorage{
+		Accounts:     accounts,
+		Root:         root,
+		PerRecipient: perRecipient,
+		index:        maildirIndex{Entries: make(map[uint]*maildirEntry)},
+	}
+	if err := createMaildir(root); err != nil {
+		return nil, err
+	}
+	loaded, err := s.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	if !loaded {
+		if err := s.migrateIndex(); err != nil {
+			return nil, err
+		}
+	}
+	// indexes written before the mails were threaded
+	var unthreaded []*Mail
+	var ids []uint
+	for id, entry := range s.index.Entries {
+		if entry.Mail.ThreadID == "" {
+			unthreaded = append(unthreaded, &entry.Mail)
+			ids = append(ids, id)
+		}
+	}
+	nameThreads(unthreaded)
+	for _, id := range ids {
+		if err := s.saveEntry(id); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *MaildirStorage) Persist(mail *Mail) error {
+	if mail.Raw == nil {
+		return fmt.Errorf("maildir storage needs the raw message")
+	}
+	raw, err := decompress(mail.Raw.Data)
+	if err != nil {
+		return err
+	}
+	joined, err := joinThread(s, mail)
+	if err != nil {
+		return err
+	}
+	dirs := []string{""}
+	if s.PerRecipient && mail.Envelope != nil && len(mail.Envelope.Recipients) > 0 {
+		dirs = dirs[:0]
+		for _, recipient := range mail.Envelope.Recipients {
+			dirs = append(dirs, maildirName(recipient.Address))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []string
+	for _, dir := range dirs {
+		file, err := s.deliver(dir, raw, files)
+		if err != nil {
+			s.removeFiles(files)
+			return err
+		}
+		files = append(files, file)
+	}
+	s.index.LastID++
+	mail.ID = s.index.LastID
+	if mail.ThreadID == "" {
+		mail.ThreadID = threadID(mail)
+	}
+	mail.CreatedAt = time.Now()
+	mail.UpdatedAt = mail.CreatedAt
+	entry := &maildirEntry{Files: files}
+	entry.set(mail)
+	s.index.Entries[mail.ID] = entry
+	if err := s.saveLastID(); err != nil {
+		delete(s.index.Entries, mail.ID)
+		s.removeFiles(files)
+		return err
+	}
+	if err := s.saveEntry(mail.ID); err != nil {
+		delete(s.index.Entries, mail.ID)
+		s.removeFiles(files)
+		return err
+	}
+	for id, entry := range s.index.Entries {
+		if containsString(joined, entry.Mail.ThreadID) {
+			entry.Mail.ThreadID = mail.ThreadID
+			if err := s.saveEntry(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MaildirStorage) GetAll(filters ...HeaderFilter) ([]Mail, error) {
+	page, err := s.FindMails(MailQuery{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	return page.Mails, nil
+}
+
+func (s *MaildirStorage) GetAllByMailbox(username string, filters ...HeaderFilter) ([]Mail, error) {
+	page, err := s.FindMails(MailQuery{Mailbox: username, Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	return page.Mails, nil
+}
+
+func (s *MaildirStorage) FindThreads(query MailQuery) (*ThreadPage, error) {
+	return findThreads(s, query)
+}
+
+func (s *MaildirStorage) FindMails(query MailQuery) (*MailPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	return query.page(s.findMails(func(entry *maildirEntry, mail *Mail) bool {
+		return query.matches(mail, entry.Attachments > 0) && entry.Text.matches(query.Terms)
+	}))
+}
+
+func (s *MaildirStorage) GetMail(mailID uint) (*Mail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.entry(mailID)
+	if err != nil {
+		return nil, err
+	}
+	s.locate(entry)
+	indexed := entry.mail()
+	mail := summarize(&indexed)
+	return &mail, nil
+}
+
+func (s *MaildirStorage) IsInMailbox(mailID uint, username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.index.Entries[mailID]
+	return ok && inMailbox(&entry.Mail, username), nil
+}
+
+func (s *MaildirStorage) GetBodyByMailID(mailID uint) (*Body, error) {
+	mail, err := s.parse(mailID)
+	if err != nil {
+		return nil, err
+	}
+	if mail.Body == nil {
+		return &Body{}, nil
+	}
+	return mail.Body, nil
+}
+
+func (s *MaildirStorage) GetAttachmentsByMailID(mailID uint) ([]Attachment, error) {
+	var attachments []Attachment
+	mail, err := s.parse(mailID)
+	if err != nil || mail.Body == nil {
+		return attachments, nil
+	}
+	for _, attachment := range mail.Body.Attachments {
+		attachments = append(attachments, *attachment)
+	}
+	return attachments, nil
+}
+
+func (s *MaildirStorage) GetHeadersByMailID(mailID uint) ([]Header, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var headers []Header
+	if entry, ok := s.index.Entries[mailID]; ok {
+		headers = append(headers, entry.Headers...)
+	}
+	return headers, nil
+}
+
+func (s *MaildirStorage) GetRawByMailID(mailID uint) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.index.Entries[mailID]
+	if !ok {
+		return nil, fmt.Errorf("no raw message is stored for mail %d", mailID)
+	}
+	s.locate(entry)
+	return ioutil.ReadFile(filepath.Join(s.Root, entry.Files[0]))
+}
+
+func (s *MaildirStorage) Reparse(mailID uint) error {
+	parsed, err := s.parse(mailID)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.entry(mailID)
+	if err != nil {
+		return err
+	}
+	mail := entry.Mail
+	mail.updateParsed(parsed)
+	mail.UpdatedAt = time.Now()
+	entry.set(&mail)
+	return s.saveEntry(mailID)
+}
+
+// UpdateFlags keeps the read state, the star and the trash mark as the S, F and T flags of the message
+// files, which mail clients share, and the tags in the index.
+func (s *MaildirStorage) UpdateFlags(mailID uint, flags MailFlags) (*Mail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.entry(mailID)
+	if err != nil {
+		return nil, err
+	}
+	s.locate(entry)
+	mail := entry.mail()
+	if err := flags.apply(&mail); err != nil {
+		return nil, err
+	}
+	for flag, set := range map[rune]bool{MaildirSeen: mail.Seen, MaildirFlagged: mail.Starred, MaildirTrashed: mail.Trashed} {
+		if err := s.setFlag(entry, flag, set); err != nil {
+			return nil, err
+		}
+	}
+	entry.Mail.Tags = mail.Tags
+	entry.Mail.UpdatedAt = time.Now()
+	if err := s.saveEntry(mailID); err != nil {
+		return nil, err
+	}
+	mail = entry.mail()
+	mail = summarize(&mail)
+	return &mail, nil
+}
+
+func (s *MaildirStorage) AddDuplicate(mailID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.entry(mailID)
+	if err != nil {
+		return err
+	}
+	entry.Mail.Duplicates++
+	entry.Mail.UpdatedAt = time.Now()
+	return s.saveEntry(mailID)
+}
+
+func (s *MaildirStorage) SetArchiveState(mailID uint, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.entry(mailID)
+	if err != nil {
+		return err
+	}
+	entry.Mail.ArchiveState = state
+	return s.saveEntry(mailID)
+}
+
+// Delete removes the message from every Maildir it was delivered to.
+func (s *MaildirStorage) Delete(mailID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.index.Entries[mailID]
+	if !ok {
+		return fmt.Errorf("mail %d does not exist", mailID)
+	}
+	s.locate(entry)
+	if err := s.removeEntry(mailID); err != nil {
+		return err
+	}
+	delete(s.index.Entries, mailID)
+	s.removeFiles(entry.Files)
+	return nil
+}
+
+func (s *MaildirStorage) DeleteAll(filters ...HeaderFilter) (int, error) {
+	return s.deleteMatching(func(entry *maildirEntry) bool {
+		return true
+	}, filters)
+}
+func (s *MaildirStorage) DeleteAllByMailbox(username string, filters ...HeaderFilter) (int, error) {
+	return s.deleteMatching(func(entry *maildirEntry) bool {
+		return inMailbox(&entry.Mail, username)
+	}, filters)
+}
+func (s *MaildirStorage) ListMailInfo() ([]MailInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]MailInfo, 0, len(s.index.Entries))
+	for _, entry := range s.index.Entries {
+		infos = append(infos, newMailInfo(&entry.Mail))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos, nil
+}
+
+// Size returns the size of the message files and the index.
+func (s *MaildirStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return dirSize(s.Root)
+}
+
+// Compact has nothing to do, the files of deleted mails are removed right away.
+func (s *MaildirStorage) Compact() error {
+	return nil
+}
+func (s *MaildirStorage) Search(text string) ([]Mail, error) {
+	return search(s, text)
+}
+
+func (s *MaildirStorage) GetTranscriptByMailID(mailID uint) (*Transcript, error) {
+	mail, err := s.GetMail(mailID)
+	if err != nil {
+		return nil, err
+	}
+	if mail.SessionID == "" {
+		return nil, fmt.Errorf("no transcript is recorded for mail %d", mailID)
+	}
+	return s.Accounts.GetTranscriptBySessionID(mail.SessionID)
+}
+
+// Flags returns the Maildir flags of the message, e.g. "ST" for seen and trashed.
+func (s *MaildirStorage) Flags(mailID uint) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.entry(mailID)
+	if err != nil {
+		return "", err
+	}
+	s.locate(entry)
+	return maildirFlags(entry.Files[0]), nil
+}
+
+// SetFlag sets or clears a flag, such as MaildirSeen or MaildirTrashed, by renaming the message
+// into cur with the matching info suffix (":2,FLAGS") in every Maildir it was delivered to.
+func (s *MaildirStorage) SetFlag(mailID uint, flag rune, set bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.entry(mailID)
+	if err != nil {
+		return err
+	}
+	s.locate(entry)
+	if err := s.setFlag(entry, flag, set); err != nil {
+		return err
+	}
+	return s.saveEntry(mailID)
+}
+
+func (s *MaildirStorage) setFlag(entry *maildirEntry, flag rune, set bool) error {
+	files := make([]string, len(entry.Files))
+	for i, file := range entry.Files {
+		flags := strings.Replace(maildirFlags(file), string(flag), "", 1)
+		if set {
+			flags += string(flag)
+		}
+		files[i] = maildirFile(file, flags)
+		if files[i] == file {
+			continue
+		}
+		if err := os.Rename(filepath.Join(s.Root, file), filepath.Join(s.Root, files[i])); err != nil {
+			return err
+		}
+		entry.Files[i] = files[i]
+	}
+	return nil
+}
+
+// deliver writes the message into tmp and moves it into new, as described in maildir(5).
+// Copies after the first one are hard links to it where possible.
+func (s *MaildirStorage) deliver(dir string, raw []byte, delivered []string) (string, error) {
+	if err := createMaildir(filepath.Join(s.Root, dir)); err != nil {
+		return "", err
+	}
+	name := maildirUniqueName()
+	tmp := filepath.Join(s.Root, dir, "tmp", name)
+	file := filepath.Join(dir, "new", name)
+	if len(delivered) > 0 && os.Link(filepath.Join(s.Root, delivered[0]), filepath.Join(s.Root, file)) == nil {
+		return file, nil
+	}
+	if err := writeFileSync(tmp, raw); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Root, file)); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return file, nil
+}
+
+// locate follows messages that mail clients moved from new to cur or renamed to change their flags.
+func (s *MaildirStorage) locate(entry *maildirEntry) {
+	for i, file := range entry.Files {
+		if _, err := os.Stat(filepath.Join(s.Root, file)); !os.IsNotExist(err) {
+			continue
+		}
+		name := filepath.Base(file)
+		if j := strings.LastIndex(name, ":2,"); j >= 0 {
+			name = name[:j]
+		}
+		dir := filepath.Dir(filepath.Dir(file))
+		for _, sub := range []string{"cur", "new"} {
+			matches, _ := filepath.Glob(filepath.Join(s.Root, dir, sub, name+"*"))
+			if len(matches) > 0 {
+				if relative, err := filepath.Rel(s.Root, matches[0]); err == nil {
+					entry.Files[i] = relative
+				}
+				break
+			}
+		}
+	}
+}
+
+func (s *MaildirStorage) parse(mailID uint) (*Mail, error) {
+	raw, err := s.GetRawByMailID(mailID)
+	if err != nil {
+		return nil, err
+	}
+	return NewMailFromRaw(raw)
+}
+
+func (s *MaildirStorage) entry(mailID uint) (*maildirEntry, error) {
+	entry, ok := s.index.Entries[mailID]
+	if !ok {
+		return nil, fmt.Errorf("mail %d does not exist", mailID)
+	}
+	return entry, nil
+}
+
+func (s *MaildirStorage) deleteMatching(match func(entry *maildirEntry) bool, filters []HeaderFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := 0
+	for id, entry := range s.index.Entries {
+		mail := entry.Mail
+		mail.Headers = nil
+		for i := range entry.Headers {
+			mail.Headers = append(mail.Headers, &entry.Headers[i])
+		}
+		if match(entry) && hasHeaders(&mail, filters) {
+			s.locate(entry)
+			if err := s.removeEntry(id); err != nil {
+				return deleted, err
+			}
+			delete(s.index.Entries, id)
+			s.removeFiles(entry.Files)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// findMails returns the matching mails in the order they were received, with the headers given to match.
+func (s *MaildirStorage) findMails(match func(entry *maildirEntry, mail *Mail) bool) []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]uint, 0, len(s.index.Entries))
+	for id := range s.index.Entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	var mails []Mail
+	for _, id := range ids {
+		entry := s.index.Entries[id]
+		mail := entry.mail()
+		mail.Headers = nil
+		for i := range entry.Headers {
+			mail.Headers = append(mail.Headers, &entry.Headers[i])
+		}
+		if match(entry, &mail) {
+			mails = append(mails, summarize(&mail))
+		}
+	}
+	return mails
+}
+
+// rebuildIndex indexes the messages already in the Maildirs, e.g. ones delivered by other tools.
+func (s *MaildirStorage) rebuildIndex() error {
+	var files []string
+	err := filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		dir := filepath.Base(filepath.Dir(path))
+		if info.Mode().IsRegular() && (dir == "new" || dir == "cur") {
+			relative, err := filepath.Rel(s.Root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, relative)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// unique names start with the delivery time, so they give the delivery order whatever subdirectory a file is in
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(filepath.Join(s.Root, file))
+		if err != nil {
+			return err
+		}
+		mail, err := NewMailFromRaw(raw)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(s.Root, file))
+		if err != nil {
+			return err
+		}
+		s.index.LastID++
+		mail.ID = s.index.LastID
+		mail.CreatedAt = info.ModTime()
+		mail.UpdatedAt = mail.CreatedAt
+		entry := &maildirEntry{Files: []string{file}}
+		entry.set(mail)
+		s.index.Entries[mail.ID] = entry
+	}
+	var mails []*Mail
+	for _, entry := range s.index.Entries {
+		mails = append(mails, &entry.Mail)
+	}
+	nameThreads(mails)
+	return s.saveIndex()
+}
+
+// loadIndex reads the entries of maildirIndexDir, it returns false when there is no index yet.
+func (s *MaildirStorage) loadIndex() (bool, error) {
+	dir := filepath.Join(s.Root, maildirIndexDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return false, err
+		}
+		if file.Name() == "last-id" {
+			if err := json.Unmarshal(data, &s.index.LastID); err != nil {
+				return false, fmt.Errorf("invalid maildir index %s, remove it to rebuild: %v", maildirIndexDir, err)
+			}
+			continue
+		}
+		var id uint
+		if _, err := fmt.Sscanf(file.Name(), "%d.json", &id); err != nil || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		entry := &maildirEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return false, fmt.Errorf("invalid maildir index %s, remove it to rebuild: %v", maildirIndexDir, err)
+		}
+		s.index.Entries[id] = entry
+	}
+	return true, nil
+}
+
+// migrateIndex moves the single index file of earlier versions into maildirIndexDir, or rebuilds the index
+// from the messages when there is none.
+func (s *MaildirStorage) migrateIndex() error {
+	path := filepath.Join(s.Root, maildirIndexFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s.rebuildIndex()
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.index); err != nil {
+		return fmt.Errorf("invalid maildir index %s, remove it to rebuild: %v", maildirIndexFile, err)
+	}
+	if s.index.Entries == nil {
+		s.index.Entries = make(map[uint]*maildirEntry)
+	}
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// saveIndex writes every entry of the index, for a new index.
+func (s *MaildirStorage) saveIndex() error {
+	if err := s.saveLastID(); err != nil {
+		return err
+	}
+	for id := range s.index.Entries {
+		if err := s.saveEntry(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MaildirStorage) saveLastID() error {
+	data, err := json.Marshal(s.index.LastID)
+	if err != nil {
+		return err
+	}
+	return s.writeIndexFile("last-id", data)
+}
+
+// saveEntry replaces the index file of the message.
+func (s *MaildirStorage) saveEntry(mailID uint) error {
+	data, err := json.Marshal(s.index.Entries[mailID])
+	if err != nil {
+		return err
+	}
+	return s.writeIndexFile(fmt.Sprintf("%d.json", mailID), data)
+}
+
+func (s *MaildirStorage) removeEntry(mailID uint) error {
+	err := os.Remove(filepath.Join(s.Root, maildirIndexDir, fmt.Sprintf("%d.json", mailID)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeIndexFile replaces a file of the index atomically.
+func (s *MaildirStorage) writeIndexFile(name string, data []byte) error {
+	dir := filepath.Join(s.Root, maildirIndexDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	_ = os.Remove(path + ".tmp")
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *MaildirStorage) removeFiles(files []string) {
+	for _, file := range files {
+		_ = os.Remove(filepath.Join(s.Root, file))
+	}
+}
+
+// mail returns the indexed mail with the flags of its first message file.
+func (e *maildirEntry) mail() Mail {
+	mail := e.Mail
+	flags := maildirFlags(e.Files[0])
+	mail.Seen = strings.ContainsRune(flags, MaildirSeen)
+	mail.Starred = strings.ContainsRune(flags, MaildirFlagged)
+	mail.Trashed = strings.ContainsRune(flags, MaildirTrashed)
+	return mail
+}
+
+func (e *maildirEntry) set(mail *Mail) {
+	e.Headers = e.Headers[:0]
+	for _, header := range mail.Headers {
+		header.MailID = mail.ID
+		e.Headers = append(e.Headers, *header)
+	}
+	e.Attachments = 0
+	if mail.Body != nil {
+		e.Attachments = len(mail.Body.Attachments)
+	}
+	e.Text = newMailText(mail)
+	e.Mail = summarize(mail)
+	for _, mailbox := range mail.Mailboxes {
+		mailbox.MailID = mail.ID
+		e.Mail.Mailboxes = append(e.Mail.Mailboxes, mailbox)
+	}
+}
+
+func createMaildir(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maildirUniqueName builds a file name as recommended by maildir(5): time, microseconds,
+// process id and a delivery counter, followed by the host name.
+func maildirUniqueName() string {
+	now := time.Now()
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	counter := atomic.AddUint64(&maildirCounter, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), counter, hostname)
+}
+
+// maildirName turns a recipient address into the name of its Maildir.
+func maildirName(address string) string {
+	name := strings.ToLower(strings.TrimSpace(address))
+	name = strings.NewReplacer("/", "_", "\\", "_", string(filepath.Separator), "_").Replace(name)
+	if name == "" || name == "." || name == ".." || name == "tmp" || name == "new" || name == "cur" {
+		name = "_" + name
+	}
+	return name
+}
+
+func maildirFlags(file string) string {
+	if i := strings.LastIndex(file, ":2,"); i >= 0 {
+		return file[i+3:]
+	}
+	return ""
+}
+
+// maildirFile returns the path of the message in cur with the given flags, sorted as maildir(5) requires.
+func maildirFile(file string, flags string) string {
+	name := filepath.Base(file)
+	if i := strings.LastIndex(name, ":2,"); i >= 0 {
+		name = name[:i]
+	}
+	sorted := []byte(flags)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return filepath.Join(filepath.Dir(filepath.Dir(file)), "cur", name+":2,"+string(sorted))
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirStorage_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return newTestMaildirStorage(t, false)
+	})
+}
+
+func TestMaildirStorage_Delivery(t *testing.T) {
+	storage := newTestMaildirStorage(t, true)
+	receiver := &DBReceiver{Storage: storage}
+	raw := []byte("Subject: Test\nContent-Type: text/plain\n\nHi\n")
+	err := receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"B@test.com", "c@test.com"}, Data: raw})
+	require.NoError(t, err)
+
+	for _, recipient := range []string{"b@test.com", "c@test.com"} {
+		files, err := filepath.Glob(filepath.Join(storage.Root, recipient, "new", "*"))
+		require.NoError(t, err)
+		require.Equal(t, 1, len(files))
+		assert.Regexp(t, `^\d+\.M\d+P\d+Q\d+\.`, filepath.Base(files[0]))
+		data, err := ioutil.ReadFile(files[0])
+		require.NoError(t, err)
+		assert.Equal(t, raw, data)
+	}
+	tmp, err := filepath.Glob(filepath.Join(storage.Root, "b@test.com", "tmp", "*"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	id := mails[0].ID
+	require.NoError(t, storage.SetFlag(id, MaildirSeen, true))
+	require.NoError(t, storage.SetFlag(id, MaildirTrashed, true))
+	flags, err := storage.Flags(id)
+	require.NoError(t, err)
+	assert.Equal(t, "ST", flags)
+	files, err := filepath.Glob(filepath.Join(storage.Root, "c@test.com", "cur", "*:2,ST"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	require.NoError(t, storage.SetFlag(id, MaildirTrashed, false))
+	flags, err = storage.Flags(id)
+	require.NoError(t, err)
+	assert.Equal(t, "S", flags)
+
+	// a mail client marking the message as flagged renames it behind our back
+	files, err = filepath.Glob(filepath.Join(storage.Root, "b@test.com", "cur", "*"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+	require.NoError(t, os.Rename(files[0], strings.TrimSuffix(files[0], ":2,S")+":2,FS"))
+	stored, err := storage.GetRawByMailID(id)
+	require.NoError(t, err)
+	assert.Equal(t, raw, stored)
+	flags, err = storage.Flags(id)
+	require.NoError(t, err)
+	assert.Equal(t, "FS", flags)
+
+	reopened, err := NewMaildirStorage(storage.Root, true, storage.Accounts)
+	require.NoError(t, err)
+	mail, err := reopened.GetMail(id)
+	require.NoError(t, err)
+	assert.Equal(t, "Test", mail.Subject)
+	assert.True(t, mail.Seen)
+	assert.True(t, mail.Starred)
+	no := false
+	_, err = reopened.UpdateFlags(id, MailFlags{Seen: &no, AddTags: []string{"kept"}})
+	require.NoError(t, err)
+	flags, err = reopened.Flags(id)
+	require.NoError(t, err)
+	assert.Equal(t, "F", flags)
+	yes := true
+	_, err = reopened.UpdateFlags(id, MailFlags{Trashed: &yes})
+	require.NoError(t, err)
+	flags, err = reopened.Flags(id)
+	require.NoError(t, err)
+	assert.Equal(t, "FT", flags)
+	require.NoError(t, reopened.Delete(id))
+	files, err = filepath.Glob(filepath.Join(storage.Root, "*", "*", "*"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestMaildirStorage_RebuildIndex(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(root)
+	})
+	require.NoError(t, createMaildir(root))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "new", "1.M1P1Q1.host"), []byte(simpleMail), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "cur", "2.M1P1Q1.host:2,S"), []byte(mailWithAttachment), 0600))
+
+	storage, err := NewMaildirStorage(root, false, NewMemoryStorage(0, 0))
+	require.NoError(t, err)
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mails))
+	assert.Equal(t, "Test Mail", mails[0].Subject)
+	assert.Equal(t, "Test with Attachment", mails[1].Subject)
+	flags, err := storage.Flags(mails[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "S", flags)
+	entries, err := filepath.Glob(filepath.Join(root, maildirIndexDir, "*"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(entries), "an entry per message and the last ID")
+
+	// the single index file of earlier versions is moved into the index directory
+	data, err := json.Marshal(storage.index)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(root, maildirIndexDir)))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, maildirIndexFile), data, 0600))
+	migrated, err := NewMaildirStorage(root, false, storage.Accounts)
+	require.NoError(t, err)
+	mails, err = migrated.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mails))
+	assert.Equal(t, "Test with Attachment", mails[1].Subject)
+	_, err = os.Stat(filepath.Join(root, maildirIndexFile))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, migrated.Delete(mails[0].ID))
+	reopened, err := NewMaildirStorage(root, false, storage.Accounts)
+	require.NoError(t, err)
+	mails, err = reopened.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	assert.Equal(t, "Test with Attachment", mails[0].Subject)
+}
+
+func newTestMaildirStorage(t *testing.T, perRecipient bool) *MaildirStorage {
+	root, err := ioutil.TempDir("", "maildir")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(root)
+	})
+	storage, err := NewMaildirStorage(root, perRecipient, NewMemoryStorage(0, 0))
+	require.NoError(t, err)
+	return storage
+}
@@ -0,0 +1,609 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"net/textproto"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps everything in memory, for test runs that should not leave a database behind.
+// MaxMails and MaxBytes cap the stored mails, evicting the least recently used ones; zero means no cap.
+type MemoryStorage struct {
+	MaxMails int
+	// MaxBytes caps the total size of the raw messages.
+	MaxBytes int
+
+	mu          sync.Mutex
+	lastID      uint
+	mails       map[uint]*list.Element
+	recent      *list.List
+	size        int
+	users       map[string]*User
+	transcripts map[string]*Transcript
+	records     []*SessionRecord
+}
+
+var _ Storage = &MemoryStorage{}
+
+func NewMemoryStorage(maxMails, maxBytes int) *MemoryStorage {
+	return &MemoryStorage{
+		MaxMails:    maxMails,
+		MaxBytes:    maxBytes,
+		mails:       make(map[uint]*list.Element),
+		recent:      list.New(),
+		users:       make(map[string]*User),
+		transcripts: make(map[string]*Transcript),
+	}
+}
+
+func (s *MemoryStorage) Persist(mail *Mail) error {
+	joined, err := joinThread(s, mail)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail.ID = s.nextID()
+	if mail.ThreadID == "" {
+		mail.ThreadID = threadID(mail)
+	}
+	for _, element := range s.mails {
+		if stored := element.Value.(*Mail); containsString(joined, stored.ThreadID) {
+			stored.ThreadID = mail.ThreadID
+		}
+	}
+	mail.CreatedAt = time.Now()
+	mail.UpdatedAt = mail.CreatedAt
+	s.assignIDs(mail)
+	s.mails[mail.ID] = s.recent.PushFront(mail)
+	s.size += mail.Size
+	s.evict()
+	return nil
+}
+
+func (s *MemoryStorage) GetAll(filters ...HeaderFilter) ([]Mail, error) {
+	page, err := s.FindMails(MailQuery{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	return page.Mails, nil
+}
+
+// GetAllByMailbox returns the mails submitted by the user or delivered to one of its addresses.
+func (s *MemoryStorage) GetAllByMailbox(username string, filters ...HeaderFilter) ([]Mail, error) {
+	page, err := s.FindMails(MailQuery{Mailbox: username, Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	return page.Mails, nil
+}
+
+func (s *MemoryStorage) FindMails(query MailQuery) (*MailPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	return query.page(s.findMails(func(mail *Mail) bool {
+		return query.matches(mail, mail.Body != nil && len(mail.Body.Attachments) > 0) &&
+			(len(query.Terms) == 0 || newMailText(mail).matches(query.Terms))
+	}, nil))
+}
+
+func (s *MemoryStorage) FindThreads(query MailQuery) (*ThreadPage, error) {
+	return findThreads(s, query)
+}
+
+func (s *MemoryStorage) GetMail(mailID uint) (*Mail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail, err := s.use(mailID)
+	if err != nil {
+		return nil, err
+	}
+	summary := summarize(mail)
+	return &summary, nil
+}
+
+func (s *MemoryStorage) IsInMailbox(mailID uint, username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.mails[mailID]
+	return ok && inMailbox(element.Value.(*Mail), username), nil
+}
+
+func (s *MemoryStorage) GetBodyByMailID(mailID uint) (*Body, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail, err := s.use(mailID)
+	if err != nil {
+		return nil, err
+	}
+	if mail.Body == nil {
+		return &Body{}, nil
+	}
+	body := *mail.Body
+	return &body, nil
+}
+
+func (s *MemoryStorage) GetAttachmentsByMailID(mailID uint) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var attachments []Attachment
+	element, ok := s.mails[mailID]
+	if !ok || element.Value.(*Mail).Body == nil {
+		return attachments, nil
+	}
+	for _, attachment := range element.Value.(*Mail).Body.Attachments {
+		attachments = append(attachments, *attachment)
+	}
+	return attachments, nil
+}
+
+func (s *MemoryStorage) GetHeadersByMailID(mailID uint) ([]Header, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var headers []Header
+	if element, ok := s.mails[mailID]; ok {
+		for _, header := range element.Value.(*Mail).Headers {
+			headers = append(headers, *header)
+		}
+	}
+	return headers, nil
+}
+
+func (s *MemoryStorage) GetRawByMailID(mailID uint) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail, err := s.use(mailID)
+	if err != nil || mail.Raw == nil {
+		return nil, fmt.Errorf("no raw message is stored for mail %d", mailID)
+	}
+	return decompress(mail.Raw.Data)
+}
+
+func (s *MemoryStorage) Reparse(mailID uint) error {
+	raw, err := s.GetRawByMailID(mailID)
+	if err != nil {
+		return err
+	}
+	parsed, err := NewMailFromRaw(raw)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail, err := s.use(mailID)
+	if err != nil {
+		return err
+	}
+	mail.updateParsed(parsed)
+	mail.UpdatedAt = time.Now()
+	s.assignIDs(mail)
+	return nil
+}
+
+func (s *MemoryStorage) UpdateFlags(mailID uint, flags MailFlags) (*Mail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail, err := s.use(mailID)
+	if err != nil {
+		return nil, err
+	}
+	if err := flags.apply(mail); err != nil {
+		return nil, err
+	}
+	mail.UpdatedAt = time.Now()
+	summary := summarize(mail)
+	return &summary, nil
+}
+
+func (s *MemoryStorage) AddDuplicate(mailID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail, err := s.use(mailID)
+	if err != nil {
+		return err
+	}
+	mail.Duplicates++
+	mail.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStorage) SetArchiveState(mailID uint, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mail, err := s.use(mailID)
+	if err != nil {
+		return err
+	}
+	mail.ArchiveState = state
+	return nil
+}
+
+func (s *MemoryStorage) Delete(mailID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.mails[mailID]
+	if !ok {
+		return fmt.Errorf("mail %d does not exist", mailID)
+	}
+	s.remove(element)
+	return nil
+}
+
+func (s *MemoryStorage) Search(text string) ([]Mail, error) {
+	return search(s, text)
+}
+
+func (s *MemoryStorage) Authenticate(username string, password []byte) error {
+	user, err := s.findActiveUser(username)
+	if err != nil {
+		return err
+	}
+	return user.checkPassword(password)
+}
+
+func (s *MemoryStorage) ValidateHMAC(username string, msg []byte, code []byte) error {
+	user, err := s.findActiveUser(username)
+	if err != nil {
+		return err
+	}
+	return user.checkHMAC(msg, code)
+}
+
+func (s *MemoryStorage) AuthorizeSender(username string, sender string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok || !user.CanSendAs(sender) {
+		return senderNotAllowed(username, sender)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) AddUser(username string, password []byte) error {
+	user := &User{Username: username}
+	if err := user.setPassword(password); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return fmt.Errorf("user %s already exists", username)
+	}
+	user.ID = s.nextID()
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	s.users[username] = user
+	return nil
+}
+
+func (s *MemoryStorage) ListUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+func (s *MemoryStorage) HasUsers() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users) > 0, nil
+}
+
+func (s *MemoryStorage) DeleteAll(filters ...HeaderFilter) (int, error) {
+	return s.deleteMatching(func(mail *Mail) bool {
+		return true
+	}, filters), nil
+}
+func (s *MemoryStorage) DeleteAllByMailbox(username string, filters ...HeaderFilter) (int, error) {
+	return s.deleteMatching(func(mail *Mail) bool {
+		return inMailbox(mail, username)
+	}, filters), nil
+}
+func (s *MemoryStorage) ListMailInfo() ([]MailInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]MailInfo, 0, len(s.mails))
+	for _, element := range s.mails {
+		infos = append(infos, newMailInfo(element.Value.(*Mail)))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos, nil
+}
+
+// Size returns the size of the raw messages kept.
+func (s *MemoryStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(s.size), nil
+}
+
+// Compact has nothing to do, the memory of deleted mails is freed by the garbage collector.
+func (s *MemoryStorage) Compact() error {
+	return nil
+}
+func (s *MemoryStorage) DeleteUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	delete(s.users, username)
+	return nil
+}
+
+func (s *MemoryStorage) SetPassword(username string, password []byte) error {
+	changed := &User{}
+	if err := changed.setPassword(password); err != nil {
+		return err
+	}
+	return s.updateUser(username, func(user *User) {
+		user.Password = changed.Password
+		user.CRAMSecret = changed.CRAMSecret
+	})
+}
+
+func (s *MemoryStorage) SetUserDisabled(username string, disabled bool) error {
+	return s.updateUser(username, func(user *User) {
+		user.Disabled = disabled
+	})
+}
+
+func (s *MemoryStorage) SetUserAddresses(username string, addresses []string) error {
+	return s.updateUser(username, func(user *User) {
+		user.Addresses = addresses
+	})
+}
+
+func (s *MemoryStorage) ResolveMailboxes(recipients []string) ([]string, error) {
+	users, err := s.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	return resolveMailboxes(users, recipients), nil
+}
+
+func (s *MemoryStorage) PersistTranscript(transcript *Transcript) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transcripts[transcript.SessionID]; ok {
+		return fmt.Errorf("transcript of session %s already exists", transcript.SessionID)
+	}
+	transcript.ID = s.nextID()
+	transcript.CreatedAt = time.Now()
+	s.transcripts[transcript.SessionID] = transcript
+	return nil
+}
+
+func (s *MemoryStorage) GetTranscriptBySessionID(sessionID string) (*Transcript, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transcript, ok := s.transcripts[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("no transcript is recorded for session %s", sessionID)
+	}
+	copied := *transcript
+	return &copied, nil
+}
+
+func (s *MemoryStorage) GetTranscriptByMailID(mailID uint) (*Transcript, error) {
+	mail, err := s.GetMail(mailID)
+	if err != nil {
+		return nil, err
+	}
+	if mail.SessionID == "" {
+		return nil, fmt.Errorf("no transcript is recorded for mail %d", mailID)
+	}
+	return s.GetTranscriptBySessionID(mail.SessionID)
+}
+
+func (s *MemoryStorage) PersistSessionRecord(record *SessionRecord, transcript *Transcript) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.records {
+		if existing.SessionID == record.SessionID {
+			return fmt.Errorf("session %s is already recorded", record.SessionID)
+		}
+	}
+	record.ID = s.nextID()
+	record.CreatedAt = time.Now()
+	s.records = append(s.records, record)
+	if transcript != nil {
+		if _, ok := s.transcripts[transcript.SessionID]; !ok {
+			transcript.ID = s.nextID()
+			transcript.CreatedAt = record.CreatedAt
+			s.transcripts[transcript.SessionID] = transcript
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) GetSessionRecords(username string) ([]SessionRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []SessionRecord
+	for i := len(s.records) - 1; i >= 0 && len(records) < 50; i-- {
+		if username == "" || s.records[i].Username == username {
+			records = append(records, *s.records[i])
+		}
+	}
+	return records, nil
+}
+
+func (s *MemoryStorage) GetSessionRecord(sessionID string) (*SessionRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range s.records {
+		if record.SessionID == sessionID {
+			copied := *record
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("session %s is not recorded", sessionID)
+}
+
+func (s *MemoryStorage) deleteMatching(match func(mail *Mail) bool, filters []HeaderFilter) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := 0
+	for _, element := range s.mails {
+		if mail := element.Value.(*Mail); match(mail) && hasHeaders(mail, filters) {
+			s.remove(element)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// findMails returns the matching mails in the order they were received, like GormStorage.
+func (s *MemoryStorage) findMails(match func(mail *Mail) bool, filters []HeaderFilter) []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]uint, 0, len(s.mails))
+	for id := range s.mails {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	var mails []Mail
+	for _, id := range ids {
+		mail := s.mails[id].Value.(*Mail)
+		if match(mail) && hasHeaders(mail, filters) {
+			mails = append(mails, summarize(mail))
+		}
+	}
+	return mails
+}
+
+// use returns the mail and marks it as the most recently used one.
+func (s *MemoryStorage) use(mailID uint) (*Mail, error) {
+	element, ok := s.mails[mailID]
+	if !ok {
+		return nil, fmt.Errorf("mail %d does not exist", mailID)
+	}
+	s.recent.MoveToFront(element)
+	return element.Value.(*Mail), nil
+}
+
+func (s *MemoryStorage) evict() {
+	for s.recent.Len() > 1 && ((s.MaxMails > 0 && s.recent.Len() > s.MaxMails) || (s.MaxBytes > 0 && s.size > s.MaxBytes)) {
+		s.remove(s.recent.Back())
+	}
+}
+
+func (s *MemoryStorage) remove(element *list.Element) {
+	mail := s.recent.Remove(element).(*Mail)
+	delete(s.mails, mail.ID)
+	s.size -= mail.Size
+}
+
+func (s *MemoryStorage) updateUser(username string, update func(user *User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	update(user)
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStorage) findActiveUser(username string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok || user.Disabled {
+		return nil, smtp.NewInvalidCredentialError("invalid credential")
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *MemoryStorage) nextID() uint {
+	s.lastID++
+	return s.lastID
+}
+
+// assignIDs links the parts of a mail to it the way the database foreign keys do.
+func (s *MemoryStorage) assignIDs(mail *Mail) {
+	if mail.Body != nil {
+		mail.Body.ID = s.nextID()
+		mail.Body.MailID = mail.ID
+		for _, attachment := range mail.Body.Attachments {
+			attachment.ID = s.nextID()
+			attachment.BodyID = mail.Body.ID
+		}
+	}
+	for _, header := range mail.Headers {
+		header.ID = s.nextID()
+		header.MailID = mail.ID
+	}
+	if mail.Raw != nil {
+		mail.Raw.MailID = mail.ID
+	}
+	if mail.Envelope != nil && mail.Envelope.ID == 0 {
+		mail.Envelope.ID = s.nextID()
+		mail.Envelope.MailID = mail.ID
+		for _, recipient := range mail.Envelope.Recipients {
+			recipient.ID = s.nextID()
+			recipient.MailEnvelopeID = mail.Envelope.ID
+		}
+	}
+	for _, mailbox := range mail.Mailboxes {
+		mailbox.MailID = mail.ID
+	}
+}
+
+// summarize copies the mail the way GormStorage loads it: with the envelope but without bodies or headers.
+func summarize(mail *Mail) Mail {
+	summary := *mail
+	summary.Body = nil
+	summary.Alternatives = nil
+	summary.Headers = nil
+	summary.Raw = nil
+	summary.Mailboxes = nil
+	return summary
+}
+
+func inMailbox(mail *Mail, username string) bool {
+	if mail.Owner == username {
+		return true
+	}
+	for _, mailbox := range mail.Mailboxes {
+		if mailbox.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func hasHeaders(mail *Mail, filters []HeaderFilter) bool {
+	for _, filter := range filters {
+		name := textproto.CanonicalMIMEHeaderKey(filter.Name)
+		found := false
+		for _, header := range mail.Headers {
+			if header.Name == name && (filter.Value == "" || header.Value == filter.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
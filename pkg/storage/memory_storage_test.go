@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"testing"
+)
+
+func TestMemoryStorage_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return NewMemoryStorage(0, 0)
+	})
+}
+
+func TestMemoryStorage_Eviction(t *testing.T) {
+	storage := NewMemoryStorage(2, 0)
+	receiver := &DBReceiver{Storage: storage}
+	receive := func(subject string) {
+		raw := "Subject: " + subject + "\nContent-Type: text/plain\n\nHi\n"
+		require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(raw)}))
+	}
+	subjects := func() []string {
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		var subjects []string
+		for _, mail := range mails {
+			subjects = append(subjects, mail.Subject)
+		}
+		return subjects
+	}
+	receive("first")
+	receive("second")
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	// reading the first mail makes the second one the least recently used
+	_, err = storage.GetMail(mails[0].ID)
+	require.NoError(t, err)
+	receive("third")
+	assert.Equal(t, []string{"first", "third"}, subjects())
+
+	storage.MaxMails = 0
+	storage.MaxBytes = 100
+	receive("a much longer subject than the others")
+	assert.Equal(t, []string{"a much longer subject than the others"}, subjects())
+}
@@ -15,12 +15,19 @@ import (
 
 func NewMail(msg *gomail.Message) (*Mail, error) {
 	mail := &Mail{
-		Subject:   msg.Header.Get("Subject"),
-		From:      msg.Header.Get("From"),
-		To:        msg.Header["To"],
-		ReplyTo:   msg.Header.Get("Reply-To"),
-		MessageID: msg.Header.Get("Message-ID"),
-		Date:      msg.Header.Get("Date"),
+		Subject:     msg.Header.Get("Subject"),
+		From:        msg.Header.Get("From"),
+		To:          msg.Header["To"],
+		ReplyTo:     msg.Header.Get("Reply-To"),
+		MessageID:   msg.Header.Get("Message-ID"),
+		Date:        msg.Header.Get("Date"),
+		Received:    msg.Header.Get("Received"),
+		ReturnPath:  msg.Header.Get("Return-Path"),
+		DeliveredTo: msg.Header["Delivered-To"],
+		References:  parseMessageIDs(msg.Header.Get("References")),
+	}
+	if inReplyTo := parseMessageIDs(msg.Header.Get("In-Reply-To")); len(inReplyTo) > 0 {
+		mail.InReplyTo = inReplyTo[0]
 	}
 	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
 	if err != nil {
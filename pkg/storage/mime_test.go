@@ -1020,3 +1020,22 @@ pRedirect"/>
 
 --Apple-Mail=_422A3389-9A46-46DE-B786-4BC3C1365E81--
 `
+
+const passwordResetMail = `From: Accounts <accounts@shop.test>
+To: Alice <alice@test.com>
+Subject: Your account
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="b1"
+
+--b1
+Content-Type: text/html; charset=utf-8
+
+<html><head><style>.stylesheet{color:red}</style></head><body><p>Click to <b>reset</b> your&nbsp;password</p><a href="https://shop.test/reset">reset</a></body></html>
+--b1
+Content-Type: application/pdf; name="invoice-2021.pdf"
+Content-Disposition: attachment; filename="invoice-2021.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--b1--
+`
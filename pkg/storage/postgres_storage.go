@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"gorm.io/driver/postgres"
+	"strings"
+	"time"
+)
+
+// PoolConfig limits the connections a shared database instance keeps open, zero values keep the driver defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// NewPostgresStorage connects to the PostgreSQL database of the DSN, either a postgres:// URL or key=value pairs,
+// and migrates its tables.
+func NewPostgresStorage(dsn string, pool PoolConfig) (*GormStorage, error) {
+	storage, err := openGormStorage(postgres.Open(dsn))
+	if err != nil {
+		return storage, err
+	}
+	db, err := storage.Db.DB()
+	if err != nil {
+		return storage, err
+	}
+	if pool.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	return storage, nil
+}
+
+// IsPostgresDSN tells a PostgreSQL DSN apart from the path of a SQLite database file.
+func IsPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") ||
+		strings.Contains(dsn, "host=") || strings.Contains(dsn, "dbname=")
+}
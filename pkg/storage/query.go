@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The fields mails can be sorted by.
+const (
+	SortReceived = "received"
+	SortSubject  = "subject"
+	SortSender   = "from"
+)
+
+// MailQuery selects a page of mails. Zero values do not filter, the text filters match case-insensitive substrings.
+type MailQuery struct {
+	Filters []HeaderFilter
+	From    string
+	To      string
+	Subject string
+	// After and Before bound the time the mail was received, After inclusive and Before exclusive.
+	After         time.Time
+	Before        time.Time
+	HasAttachment bool
+	// Terms are searched in the subject, the addresses, the text bodies and the attachment names, see ParseSearchQuery.
+	Terms []string
+	// Tags keeps the mails carrying all of them, Unseen and Starred the mails with those flags.
+	Tags    []string
+	Unseen  bool
+	Starred bool
+	// Duplicated keeps the mails that were delivered more than once, ContentHash the deliveries of a message.
+	Duplicated  bool
+	ContentHash string
+	// ArchiveStates keeps the mails in one of the archive states.
+	ArchiveStates []string
+	// ThreadIDs keeps the mails of the threads, MessageIDs the mails with one of the Message-IDs, without angle brackets.
+	ThreadIDs  []string
+	MessageIDs []string
+	// Mailbox keeps the mails submitted by the user or delivered to one of its addresses.
+	Mailbox string
+	// Sort is SortReceived when empty.
+	Sort       string
+	Descending bool
+	// Cursor continues from the NextCursor of the previous page, Offset is ignored when it is set.
+	Cursor string
+	Offset int
+	// Limit is the page size, zero returns every mail.
+	Limit int
+}
+
+type MailPage struct {
+	Mails []Mail
+	// Total counts the mails matching the filters on all pages.
+	Total int
+	// NextCursor is empty on the last page.
+	NextCursor string `json:",omitempty"`
+}
+
+// mailCursor is the position after the last mail of a page, in the sort order of the query.
+type mailCursor struct {
+	Value string `json:"v,omitempty"`
+	ID    uint   `json:"id"`
+}
+
+func (q MailQuery) validate() error {
+	switch q.Sort {
+	case "", SortReceived, SortSubject, SortSender:
+	default:
+		return fmt.Errorf("mails can not be sorted by %q", q.Sort)
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return fmt.Errorf("offset and limit can not be negative")
+	}
+	return nil
+}
+
+func (q MailQuery) cursor() (*mailCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", q.Cursor)
+	}
+	var cursor mailCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", q.Cursor)
+	}
+	return &cursor, nil
+}
+
+func (q MailQuery) nextCursor(mail *Mail) string {
+	cursor := mailCursor{Value: q.sortValue(mail), ID: mail.ID}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (q MailQuery) sortValue(mail *Mail) string {
+	switch q.Sort {
+	case SortSubject:
+		return mail.Subject
+	case SortSender:
+		return mail.From
+	default:
+		return ""
+	}
+}
+
+// matches applies the filters of the query to a mail kept in memory, with its headers and mailboxes.
+func (q MailQuery) matches(mail *Mail, hasAttachment bool) bool {
+	if q.Mailbox != "" && !inMailbox(mail, q.Mailbox) {
+		return false
+	}
+	if !containsFold(mail.From, q.From) || !containsFold(strings.Join(mail.To, ","), q.To) ||
+		!containsFold(mail.Subject, q.Subject) {
+		return false
+	}
+	if (!q.After.IsZero() && mail.CreatedAt.Before(q.After)) || (!q.Before.IsZero() && !mail.CreatedAt.Before(q.Before)) {
+		return false
+	}
+	if q.HasAttachment && !hasAttachment {
+		return false
+	}
+	if (q.Unseen && mail.Seen) || (q.Starred && !mail.Starred) {
+		return false
+	}
+	if (q.Duplicated && mail.Duplicates == 0) || (q.ContentHash != "" && mail.ContentHash != q.ContentHash) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !mail.Tags.Has(tag) {
+			return false
+		}
+	}
+	if len(q.ArchiveStates) > 0 && !containsString(q.ArchiveStates, mail.ArchiveState) {
+		return false
+	}
+	if len(q.ThreadIDs) > 0 && !containsString(q.ThreadIDs, mail.ThreadID) {
+		return false
+	}
+	if len(q.MessageIDs) > 0 && !containsString(q.MessageIDs, normalizeMessageID(mail.MessageID)) {
+		return false
+	}
+	return hasHeaders(mail, q.Filters)
+}
+
+// page sorts the matching mails kept in memory and cuts the page out of them.
+func (q MailQuery) page(mails []Mail) (*MailPage, error) {
+	cursor, err := q.cursor()
+	if err != nil {
+		return nil, err
+	}
+	less := func(a, b *Mail) bool {
+		if av, bv := q.sortValue(a), q.sortValue(b); av != bv {
+			return av < bv != q.Descending
+		}
+		return a.ID != b.ID && a.ID < b.ID != q.Descending
+	}
+	sort.Slice(mails, func(i, j int) bool {
+		return less(&mails[i], &mails[j])
+	})
+	page := &MailPage{Total: len(mails), Mails: []Mail{}}
+	start := q.Offset
+	if cursor != nil {
+		position := &Mail{}
+		position.ID = cursor.ID
+		switch q.Sort {
+		case SortSubject:
+			position.Subject = cursor.Value
+		case SortSender:
+			position.From = cursor.Value
+		}
+		start = sort.Search(len(mails), func(i int) bool {
+			return less(position, &mails[i])
+		})
+	}
+	if start > len(mails) {
+		start = len(mails)
+	}
+	end := len(mails)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+		page.NextCursor = q.nextCursor(&mails[end-1])
+	}
+	page.Mails = append(page.Mails, mails[start:end]...)
+	return page, nil
+}
+
+// ParseDate reads a time given in RFC 3339 or as a date, 2006-01-02, in UTC.
+func ParseDate(value string) (time.Time, error) {
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return date, fmt.Errorf("invalid date %q, use 2006-01-02 or RFC 3339", value)
+	}
+	return date, nil
+}
+
+func containsFold(text, part string) bool {
+	return part == "" || strings.Contains(strings.ToLower(text), strings.ToLower(part))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	gomail "net/mail"
+)
+
+// RawMessage keeps the gzip compressed RFC 5322 source of a mail, as received including the trace headers.
+// It holds the attachments once more, the source is kept verbatim for downloads, reparsing and archives,
+// so GormStorage moves it to the blob store like the large contents.
+type RawMessage struct {
+	ID     uint `gorm:"primarykey"`
+	MailID uint
+	Data   []byte
+	// BlobKey names the blob the data is kept in when it is too large for the row.
+	BlobKey string
+}
+
+// NewMailFromRaw parses the message source and keeps it alongside the parsed form,
+// so that it can be downloaded or parsed again later.
+func NewMailFromRaw(raw []byte) (*Mail, error) {
+	msg, err := gomail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	mail, err := NewMail(msg)
+	if err != nil {
+		return nil, err
+	}
+	mail.Headers, err = parseHeaders(raw)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compress(raw)
+	if err != nil {
+		return nil, err
+	}
+	mail.Size = len(raw)
+	mail.Raw = &RawMessage{Data: compressed}
+	return mail, nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// updateParsed replaces the fields derived from the message source with those of a fresh parse,
+// keeping what was recorded at delivery such as the owner, envelope and TLS details.
+func (m *Mail) updateParsed(parsed *Mail) {
+	m.Date = parsed.Date
+	m.From = parsed.From
+	m.ReplyTo = parsed.ReplyTo
+	m.Subject = parsed.Subject
+	m.MessageID = parsed.MessageID
+	m.InReplyTo = parsed.InReplyTo
+	m.References = parsed.References
+	m.Received = parsed.Received
+	m.ReturnPath = parsed.ReturnPath
+	m.DeliveredTo = parsed.DeliveredTo
+	m.To = parsed.To
+	m.Body = parsed.Body
+	m.Alternatives = parsed.Alternatives
+	m.Headers = parsed.Headers
+}
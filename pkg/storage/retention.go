@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// MailInfo is what the retention policy needs to know about a mail.
+type MailInfo struct {
+	ID        uint
+	CreatedAt time.Time
+	Size      int
+	// Mailboxes are the owner and the users the mail was delivered to.
+	Mailboxes []string
+}
+
+// RetentionPolicy limits the mails kept, the oldest mails are purged first. Zero values are no limit.
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxMails int
+	// MaxSize caps the bytes the storage takes, as measured by MailStore.Size. Each mail is taken to use a
+	// share of it in proportion to the size of its raw message.
+	MaxSize            int64
+	MaxMailsPerMailbox int
+}
+
+func newMailInfo(mail *Mail) MailInfo {
+	info := MailInfo{ID: mail.ID, CreatedAt: mail.CreatedAt, Size: mail.Size}
+	if mail.Owner != "" {
+		info.Mailboxes = append(info.Mailboxes, mail.Owner)
+	}
+	for _, mailbox := range mail.Mailboxes {
+		if mailbox.Username != mail.Owner {
+			info.Mailboxes = append(info.Mailboxes, mailbox.Username)
+		}
+	}
+	return info
+}
+
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// Expired returns the IDs of the mails the policy does not keep, mails are given oldest first with the
+// size of the storage holding them.
+func (p RetentionPolicy) Expired(mails []MailInfo, storeSize int64, now time.Time) []uint {
+	expired := make(map[uint]bool)
+	if p.MaxAge > 0 {
+		for _, mail := range mails {
+			if now.Sub(mail.CreatedAt) > p.MaxAge {
+				expired[mail.ID] = true
+			}
+		}
+	}
+	if p.MaxMailsPerMailbox > 0 {
+		counts := make(map[string]int)
+		for i := len(mails) - 1; i >= 0; i-- {
+			if expired[mails[i].ID] {
+				continue
+			}
+			for _, mailbox := range mails[i].Mailboxes {
+				counts[mailbox]++
+				if counts[mailbox] > p.MaxMailsPerMailbox {
+					expired[mails[i].ID] = true
+				}
+			}
+		}
+	}
+	total := 0
+	for _, mail := range mails {
+		total += mail.Size
+	}
+	share := func(mail MailInfo) float64 {
+		if total == 0 {
+			return float64(storeSize) / float64(len(mails))
+		}
+		return float64(storeSize) * float64(mail.Size) / float64(total)
+	}
+	kept, size := 0, float64(storeSize)
+	for _, mail := range mails {
+		if expired[mail.ID] {
+			size -= share(mail)
+		} else {
+			kept++
+		}
+	}
+	for _, mail := range mails {
+		if (p.MaxMails <= 0 || kept <= p.MaxMails) && (p.MaxSize <= 0 || size <= float64(p.MaxSize)) {
+			break
+		}
+		if !expired[mail.ID] {
+			expired[mail.ID] = true
+			kept--
+			size -= share(mail)
+		}
+	}
+	ids := make([]uint, 0, len(expired))
+	for id := range expired {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// Purge deletes the mails the policy does not keep and returns how many.
+func Purge(store Storage, policy RetentionPolicy) (int, error) {
+	mails, err := store.ListMailInfo()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	if policy.MaxSize > 0 {
+		if size, err = store.Size(); err != nil {
+			return 0, err
+		}
+	}
+	deleted := 0
+	for _, id := range policy.Expired(mails, size, time.Now()) {
+		if err := store.Delete(id); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Janitor enforces a retention policy in the background.
+type Janitor struct {
+	Storage  Storage
+	Policy   RetentionPolicy
+	Interval time.Duration
+}
+
+// Run purges the storage right away and then every Interval until stop is closed.
+func (j *Janitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		j.purge()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *Janitor) purge() {
+	deleted, err := Purge(j.Storage, j.Policy)
+	if err != nil {
+		log.Printf("error purging mails %v", err)
+	}
+	if deleted == 0 {
+		return
+	}
+	log.Printf("purged %d mails", deleted)
+	if err := j.Storage.Compact(); err != nil {
+		log.Printf("error compacting the storage %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy_Expired(t *testing.T) {
+	now := time.Now()
+	mails := []MailInfo{
+		{ID: 1, CreatedAt: now.Add(-72 * time.Hour), Size: 100, Mailboxes: []string{"alice"}},
+		{ID: 2, CreatedAt: now.Add(-48 * time.Hour), Size: 100, Mailboxes: []string{"alice", "bob"}},
+		{ID: 3, CreatedAt: now.Add(-24 * time.Hour), Size: 100, Mailboxes: []string{"alice"}},
+		{ID: 4, CreatedAt: now.Add(-time.Hour), Size: 300},
+		{ID: 5, CreatedAt: now, Size: 100, Mailboxes: []string{"bob"}},
+	}
+	assert.Empty(t, RetentionPolicy{}.Expired(mails, 0, now))
+	assert.Equal(t, []uint{1, 2}, RetentionPolicy{MaxAge: 36 * time.Hour}.Expired(mails, 0, now))
+	assert.Equal(t, []uint{1, 2, 3}, RetentionPolicy{MaxMails: 2}.Expired(mails, 0, now))
+	assert.Equal(t, []uint{1, 2, 3}, RetentionPolicy{MaxSize: 800}.Expired(mails, 1400, now))
+	assert.Equal(t, []uint{1}, RetentionPolicy{MaxMailsPerMailbox: 2}.Expired(mails, 0, now))
+	assert.Equal(t, []uint{1, 2}, RetentionPolicy{MaxMailsPerMailbox: 1}.Expired(mails, 0, now))
+	// limits add up, the per mailbox cap leaves 2, 4 and 5 of which the oldest goes for MaxMails
+	assert.Equal(t, []uint{1, 2, 3}, RetentionPolicy{MaxMailsPerMailbox: 1, MaxMails: 2}.Expired(mails, 0, now))
+}
+
+func TestJanitor_Run(t *testing.T) {
+	storage := NewMemoryStorage(0, 0)
+	receiver := &DBReceiver{Storage: storage}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)}))
+	}
+	janitor := &Janitor{Storage: storage, Policy: RetentionPolicy{MaxMails: 1}, Interval: time.Hour}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		janitor.Run(stop)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		infos, err := storage.ListMailInfo()
+		return err == nil && len(infos) == 1
+	}, time.Second, 10*time.Millisecond)
+	close(stop)
+	<-done
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// MailText is the text a mail is searched by. GormStorage keeps it in a table indexed by the mail_search
+// FTS5 table when SQLite is built with FTS5 (the sqlite_fts5 build tag) and matches it with LIKE otherwise.
+type MailText struct {
+	MailID      uint `gorm:"primarykey;autoIncrement:false"`
+	Subject     string
+	Addresses   string
+	Body        string
+	Attachments string
+}
+
+var (
+	htmlHidden = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	htmlTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// newMailText collects the subject, the header and envelope addresses, the decoded text bodies,
+// with the markup of HTML bodies stripped, and the names of the attachments and embedded files.
+func newMailText(mail *Mail) *MailText {
+	text := &MailText{MailID: mail.ID, Subject: mail.Subject}
+	addresses := append([]string{mail.From, mail.ReplyTo}, mail.To...)
+	if mail.Envelope != nil {
+		addresses = append(addresses, mail.Envelope.MailFrom)
+		for _, recipient := range mail.Envelope.Recipients {
+			addresses = append(addresses, recipient.Address)
+		}
+	}
+	text.Addresses = joinText(addresses)
+	var bodies, names []string
+	for _, body := range append([]*Body{mail.Body}, alternativeBodies(mail)...) {
+		if body == nil {
+			continue
+		}
+		if body.Content != nil {
+			bodies = append(bodies, bodyText(body.Content))
+		}
+		for _, embed := range body.Embeds {
+			if embed.Content != nil {
+				names = append(names, embed.Name)
+			}
+		}
+		for _, attachment := range body.Attachments {
+			if attachment.Content != nil {
+				names = append(names, attachment.Name)
+			}
+		}
+	}
+	text.Body = joinText(bodies)
+	text.Attachments = joinText(names)
+	return text
+}
+
+func alternativeBodies(mail *Mail) []*Body {
+	var bodies []*Body
+	for _, alternative := range mail.Alternatives {
+		if alternative != nil {
+			bodies = append(bodies, alternative.Body)
+		}
+	}
+	return bodies
+}
+
+// bodyText returns the text of a text/* content, without the markup when it is HTML.
+func bodyText(content *Content) string {
+	contentType := strings.ToLower(content.ContentType)
+	switch {
+	case strings.HasPrefix(contentType, "text/html"):
+		text := htmlHidden.ReplaceAllString(string(content.Data), " ")
+		return html.UnescapeString(htmlTag.ReplaceAllString(text, " "))
+	case strings.HasPrefix(contentType, "text/"), contentType == "":
+		return string(content.Data)
+	default:
+		return ""
+	}
+}
+
+// joinText joins the non-empty parts with single spaces, collapsing the white space inside them.
+func joinText(parts []string) string {
+	var words []string
+	for _, part := range parts {
+		words = append(words, strings.Fields(part)...)
+	}
+	return strings.Join(words, " ")
+}
+
+// matches tells whether every term is contained in one of the fields.
+func (t *MailText) matches(terms []string) bool {
+	if len(terms) == 0 {
+		return true
+	}
+	if t == nil {
+		return false
+	}
+	all := strings.Join([]string{t.Subject, t.Addresses, t.Body, t.Attachments}, "\n")
+	for _, term := range terms {
+		if !containsFold(all, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSearchQuery reads a search into the query. Words and "quoted phrases" are full-text terms,
+// all of which a mail has to contain; from:, to: and subject: filter those fields, has:attachment keeps
+// the mails with attachments, tag: the mails with the tag, is:unseen and is:starred the mails with
+// those flags and is:duplicate the mails delivered more than once; before: and after: take a date, 2006-01-02 or RFC 3339.
+// Operator values may be quoted too, as in subject:"password reset".
+func ParseSearchQuery(text string, query *MailQuery) error {
+	for _, token := range searchTokens(text) {
+		if token.quoted {
+			query.Terms = append(query.Terms, token.text)
+			continue
+		}
+		i := strings.Index(token.text, ":")
+		if i < 0 {
+			query.Terms = append(query.Terms, token.text)
+			continue
+		}
+		value := token.text[i+1:]
+		var err error
+		switch strings.ToLower(token.text[:i]) {
+		case "from":
+			query.From = value
+		case "to":
+			query.To = value
+		case "subject":
+			query.Subject = value
+		case "has":
+			if !strings.EqualFold(value, "attachment") {
+				return fmt.Errorf("unknown search operator has:%s, only has:attachment is supported", value)
+			}
+			query.HasAttachment = true
+		case "tag":
+			query.Tags = append(query.Tags, value)
+		case "is":
+			switch strings.ToLower(value) {
+			case "unseen":
+				query.Unseen = true
+			case "starred":
+				query.Starred = true
+			case "duplicate":
+				query.Duplicated = true
+			default:
+				return fmt.Errorf("unknown search operator is:%s, use is:unseen, is:starred or is:duplicate", value)
+			}
+		case "before":
+			query.Before, err = ParseDate(value)
+		case "after":
+			query.After, err = ParseDate(value)
+		default:
+			query.Terms = append(query.Terms, token.text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type searchToken struct {
+	text string
+	// quoted tokens start with a quote, they are terms even when they look like an operator
+	quoted bool
+}
+
+// searchTokens splits the search at the white space outside double quotes, dropping the quotes.
+func searchTokens(text string) []searchToken {
+	var tokens []searchToken
+	var current strings.Builder
+	inQuotes, started, quoted := false, false, false
+	flush := func() {
+		if started && current.Len() > 0 {
+			tokens = append(tokens, searchToken{text: current.String(), quoted: quoted})
+		}
+		current.Reset()
+		started, quoted = false, false
+	}
+	for _, r := range text {
+		switch {
+		case r == '"':
+			if !started {
+				quoted = true
+			}
+			started = true
+			inQuotes = !inQuotes
+		case unicode.IsSpace(r) && !inQuotes:
+			flush()
+		default:
+			started = true
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// search looks the mails matching the search syntax of ParseSearchQuery up, in the order they were received.
+func search(store MailStore, text string) ([]Mail, error) {
+	var query MailQuery
+	if err := ParseSearchQuery(text, &query); err != nil {
+		return nil, err
+	}
+	page, err := store.FindMails(query)
+	if err != nil {
+		return nil, err
+	}
+	return page.Mails, nil
+}
+
+// ftsQuery turns the terms into an FTS5 query matching every one of them as a phrase,
+// the last word of which may be the prefix of a longer one.
+func ftsQuery(terms []string) string {
+	phrases := make([]string, 0, len(terms))
+	for _, term := range terms {
+		phrases = append(phrases, `"`+strings.ReplaceAll(term, `"`, `""`)+`"*`)
+	}
+	return strings.Join(phrases, " AND ")
+}
+
+// createSearchIndex creates the mail_search FTS5 table over mail_texts with the triggers keeping it up
+// to date, it returns false when SQLite has no FTS5. The triggers are dropped then, so the texts can
+// still be written, and the index is rebuilt whenever they are created again.
+func createSearchIndex(db *gorm.DB) (bool, error) {
+	if db.Dialector.Name() != "sqlite" {
+		return false, nil
+	}
+	var available bool
+	if err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available).Error; err != nil {
+		return false, err
+	}
+	if !available {
+		log.Printf("warning: SQLite is built without FTS5, searching the mail texts without an index, build with -tags sqlite_fts5")
+		for _, trigger := range []string{"mail_texts_ai", "mail_texts_ad", "mail_texts_au"} {
+			if err := db.Exec("DROP TRIGGER IF EXISTS " + trigger).Error; err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS mail_search USING fts5(subject, addresses, body, attachments, ` +
+		`content='mail_texts', content_rowid='mail_id', tokenize='unicode61 remove_diacritics 2')`).Error
+	if err != nil {
+		return false, err
+	}
+	var triggers int64
+	if err := db.Raw(`SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name='mail_texts_ai'`).Scan(&triggers).Error; err != nil {
+		return false, err
+	}
+	if triggers > 0 {
+		return true, nil
+	}
+	const insert = `INSERT INTO mail_search(rowid, subject, addresses, body, attachments) ` +
+		`VALUES (new.mail_id, new.subject, new.addresses, new.body, new.attachments);`
+	const remove = `INSERT INTO mail_search(mail_search, rowid, subject, addresses, body, attachments) ` +
+		`VALUES ('delete', old.mail_id, old.subject, old.addresses, old.body, old.attachments);`
+	for _, statement := range []string{
+		`CREATE TRIGGER mail_texts_ai AFTER INSERT ON mail_texts BEGIN ` + insert + ` END`,
+		`CREATE TRIGGER mail_texts_ad AFTER DELETE ON mail_texts BEGIN ` + remove + ` END`,
+		`CREATE TRIGGER mail_texts_au AFTER UPDATE ON mail_texts BEGIN ` + remove + ` ` + insert + ` END`,
+		`INSERT INTO mail_search(mail_search) VALUES ('rebuild')`,
+	} {
+		if err := db.Exec(statement).Error; err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// indexMissingTexts writes the texts of the mails received before they were kept, from their raw messages.
+func (s GormStorage) indexMissingTexts() error {
+	var ids []uint
+	if err := s.Db.Model(&Mail{}).Where("id NOT IN (?)", s.Db.Model(&MailText{}).Select("mail_id")).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var mail Mail
+		if err := s.Db.Preload("Envelope.Recipients").First(&mail, id).Error; err != nil {
+			return err
+		}
+		if raw, err := s.GetRawByMailID(id); err == nil {
+			if parsed, err := NewMailFromRaw(raw); err == nil {
+				mail.Body = parsed.Body
+				mail.Alternatives = parsed.Alternatives
+			}
+		}
+		if err := s.Db.Create(newMailText(&mail)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchTerms keeps the mails of the query whose text contains every term.
+func (s GormStorage) searchTerms(tx *gorm.DB, terms []string) *gorm.DB {
+	if len(terms) == 0 {
+		return tx
+	}
+	if s.fullText {
+		return tx.Where("id IN (SELECT rowid FROM mail_search WHERE mail_search MATCH ?)", ftsQuery(terms))
+	}
+	for _, term := range terms {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(term)) + "%"
+		tx = tx.Where("id IN (?)", s.Db.Model(&MailText{}).Select("mail_id").Where(
+			`LOWER(subject) LIKE ? ESCAPE '\' OR LOWER(addresses) LIKE ? ESCAPE '\' OR LOWER(body) LIKE ? ESCAPE '\' OR LOWER(attachments) LIKE ? ESCAPE '\'`,
+			pattern, pattern, pattern, pattern))
+	}
+	return tx
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	var query MailQuery
+	require.NoError(t, ParseSearchQuery(`reset from:shop.test subject:"your account" has:attachment after:2021-01-02 "to:literal" password`, &query))
+	assert.Equal(t, []string{"reset", "to:literal", "password"}, query.Terms)
+	assert.Equal(t, "shop.test", query.From)
+	assert.Equal(t, "your account", query.Subject)
+	assert.True(t, query.HasAttachment)
+	assert.Equal(t, time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), query.After)
+	assert.True(t, query.Before.IsZero())
+
+	query = MailQuery{}
+	require.NoError(t, ParseSearchQuery(`  "password  reset"   http://x `, &query))
+	assert.Equal(t, []string{"password  reset", "http://x"}, query.Terms)
+
+	query = MailQuery{}
+	require.NoError(t, ParseSearchQuery("tag:todo is:unseen tag:later is:Starred", &query))
+	assert.Equal(t, []string{"todo", "later"}, query.Tags)
+	assert.True(t, query.Unseen)
+	assert.True(t, query.Starred)
+
+	assert.Error(t, ParseSearchQuery("is:deleted", &MailQuery{}))
+	assert.Error(t, ParseSearchQuery("has:wings", &MailQuery{}))
+	assert.Error(t, ParseSearchQuery("before:tomorrow", &MailQuery{}))
+}
+
+func TestNewMailText(t *testing.T) {
+	mail, err := NewMailFromRaw([]byte(passwordResetMail))
+	require.NoError(t, err)
+	text := newMailText(mail)
+	assert.Equal(t, "Your account", text.Subject)
+	assert.Equal(t, "Accounts <accounts@shop.test> Alice <alice@test.com>", text.Addresses)
+	assert.Equal(t, "Click to reset your password reset", text.Body)
+	assert.Equal(t, "invoice-2021.pdf", text.Attachments)
+	assert.True(t, text.matches([]string{"PASSWORD", "invoice"}))
+	assert.False(t, text.matches([]string{"password", "refund"}))
+}
+
+func TestFTSQuery(t *testing.T) {
+	assert.Equal(t, `"password"* AND "say ""hi"""*`, ftsQuery([]string{"password", `say "hi"`}))
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"gorm.io/gorm"
+	"time"
+)
+
+// SessionRecord is a session that failed, was rejected or aborted before its mail was delivered.
+// Its transcript is stored as a Transcript with the same SessionID.
+type SessionRecord struct {
+	gorm.Model
+	SessionID     string `gorm:"uniqueIndex"`
+	Outcome       string
+	Reason        string
+	ClientAddress string
+	Helo          string
+	Username      string
+	TLS           TLSDetails `gorm:"embedded;embeddedPrefix:tls_"`
+	MailFrom      string
+	Recipients    Recipients `sql:"type:text"`
+	Delivered     int
+	StartedAt     time.Time
+	EndedAt       time.Time
+}
+
+// GetSessionRecords returns the latest session records, limited to the sessions of the user when username is set.
+func (s GormStorage) GetSessionRecords(username string) ([]SessionRecord, error) {
+	var records []SessionRecord
+	tx := s.Db.Order("id desc").Limit(50)
+	if username != "" {
+		tx = tx.Where("username=?", username)
+	}
+	tx = tx.Find(&records)
+	if tx.Error != nil {
+		return records, tx.Error
+	}
+	return records, nil
+}
+
+func (s GormStorage) GetSessionRecord(sessionID string) (*SessionRecord, error) {
+	var record SessionRecord
+	if err := s.Db.Where("session_id=?", sessionID).First(&record).Error; err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s GormStorage) PersistSessionRecord(record *SessionRecord, transcript *Transcript) error {
+	return s.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(record).Error; err != nil {
+			return err
+		}
+		if transcript == nil {
+			return nil
+		}
+		// the transcript is already there when transcripts of all sessions are recorded
+		return tx.Where(Transcript{SessionID: transcript.SessionID}).FirstOrCreate(transcript).Error
+	})
+}
+
+func (p *DBReceiver) RecordSession(record *smtp.SessionRecord) error {
+	sessionRecord := &SessionRecord{
+		SessionID:     record.SessionID,
+		Outcome:       record.Outcome,
+		Reason:        record.Reason,
+		ClientAddress: record.ClientAddress,
+		Helo:          record.Helo,
+		Username:      record.Username,
+		MailFrom:      record.Sender,
+		Recipients:    record.Recipient,
+		Delivered:     record.Delivered,
+		StartedAt:     record.StartedAt,
+		EndedAt:       record.EndedAt,
+	}
+	if record.TLS != nil {
+		sessionRecord.TLS = TLSDetails(*record.TLS)
+	}
+	var transcript *Transcript
+	if record.Transcript != nil {
+		transcript = newTranscript(record.Transcript)
+	}
+	return p.Storage.PersistSessionRecord(sessionRecord, transcript)
+}
@@ -1,54 +1,532 @@
 package storage
 
 import (
+	"encoding/json"
 	"fmt"
 	"github/ajanthan/smtp-go/pkg/smtp"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"log"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
 )
 
-type Storage interface {
-	Persist(mail Mail) error
-	GetAll() ([]Mail, error)
-	GetBodyByMailID(mailID uint) (Content, error)
+// GormStorage keeps mails, users and sessions in a SQL database through gorm, SQLite or PostgreSQL.
+type GormStorage struct {
+	Db *gorm.DB
+	// Blobs keeps the large contents out of the database when set.
+	Blobs *BlobStore
+	// fullText tells whether the mail_search FTS5 table indexes the mail texts.
+	fullText bool
 }
 
-type SQLiteStorage struct {
-	Db *gorm.DB
+// SQLiteStorage is the former name of GormStorage, kept for existing callers.
+type SQLiteStorage = GormStorage
+
+func NewStorage(dbFile string) (*GormStorage, error) {
+	return openGormStorage(sqlite.Open(dbFile))
 }
 
-func NewStorage(dbFile string) (*SQLiteStorage, error) {
-	db, err := gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
+func openGormStorage(dialector gorm.Dialector) (*GormStorage, error) {
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		return &SQLiteStorage{}, err
+		return &GormStorage{}, err
 	}
-	err = db.AutoMigrate(&Mail{}, &Body{}, &Attachment{}, &EmbeddedFile{}, &Alternative{}, &User{})
-	if err != nil {
-		return &SQLiteStorage{}, err
+	if err = migrate(db); err != nil {
+		return &GormStorage{}, err
 	}
-	storage := &SQLiteStorage{
+	storage := &GormStorage{
 		Db: db,
 	}
+	if storage.fullText, err = createSearchIndex(db); err != nil {
+		return &GormStorage{}, err
+	}
+	if err = storage.indexMissingTexts(); err != nil {
+		return &GormStorage{}, err
+	}
+	if err = storage.fillThreadIDs(); err != nil {
+		return &GormStorage{}, err
+	}
 	return storage, nil
 }
 
-func (s SQLiteStorage) Persist(mail *Mail) error {
-	tx := s.Db.Create(mail)
-	if tx.Error != nil {
-		return tx.Error
+// migrate creates the tables and adds the columns and indexes missing from an existing database.
+func migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Mail{}, &Body{}, &Attachment{}, &EmbeddedFile{}, &Alternative{}, &User{}, &Mailbox{}, &RawMessage{},
+		&MailEnvelope{}, &EnvelopeRecipient{}, &Header{}, &Transcript{}, &SessionRecord{}, &Blob{}, &MailText{})
+}
+
+var _ Storage = &GormStorage{}
+
+func (s GormStorage) Persist(mail *Mail) error {
+	defer s.lockBlobs()()
+	// the text is taken before the large contents are moved to the blob store
+	text := newMailText(mail)
+	joined, err := joinThread(s, mail)
+	if err != nil {
+		return err
+	}
+	return s.Db.Transaction(func(tx *gorm.DB) error {
+		restore, err := s.storeBlobs(tx, mail)
+		defer restore()
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(mail).Error; err != nil {
+			return err
+		}
+		if len(joined) > 0 {
+			if err := tx.Model(&Mail{}).Where("thread_id IN ?", joined).UpdateColumn("thread_id", mail.ThreadID).Error; err != nil {
+				return err
+			}
+		}
+		if mail.ThreadID == "" {
+			// a mail without any Message-ID is named after its ID, known once it is created
+			mail.ThreadID = threadID(mail)
+			if err := tx.Model(mail).UpdateColumn("thread_id", mail.ThreadID).Error; err != nil {
+				return err
+			}
+		}
+		text.MailID = mail.ID
+		return tx.Create(text).Error
+	})
+}
+func (s GormStorage) GetAll(filters ...HeaderFilter) ([]Mail, error) {
+	page, err := s.FindMails(MailQuery{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	return page.Mails, nil
+}
+
+// GetAllByMailbox returns the mails submitted by the user or delivered to one of its addresses.
+func (s GormStorage) GetAllByMailbox(username string, filters ...HeaderFilter) ([]Mail, error) {
+	page, err := s.FindMails(MailQuery{Mailbox: username, Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	return page.Mails, nil
+}
+
+// filterMails selects the mails matching the filters of the query.
+func (s GormStorage) filterMails(query MailQuery) *gorm.DB {
+	tx := s.Db.Model(&Mail{})
+	if query.Mailbox != "" {
+		tx = s.mailboxScope(query.Mailbox)
+	}
+	tx = s.filterHeaders(tx, query.Filters)
+	for _, contains := range [][2]string{{`"from"`, query.From}, {`"to"`, query.To}, {"subject", query.Subject}} {
+		if contains[1] != "" {
+			tx = tx.Where("LOWER("+contains[0]+`) LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(strings.ToLower(contains[1]))+"%")
+		}
+	}
+	if !query.After.IsZero() {
+		tx = tx.Where("created_at >= ?", query.After)
+	}
+	if !query.Before.IsZero() {
+		tx = tx.Where("created_at < ?", query.Before)
+	}
+	if query.HasAttachment {
+		tx = tx.Where("id IN (?)", s.Db.Model(&Body{}).Select("mail_id").Where("id IN (?)", s.Db.Model(&Attachment{}).Select("body_id")))
+	}
+	tx = s.searchTerms(tx, query.Terms)
+	if query.Unseen {
+		tx = tx.Where("seen=?", false)
+	}
+	if query.Starred {
+		tx = tx.Where("starred=?", true)
+	}
+	if query.Duplicated {
+		tx = tx.Where("duplicates > 0")
+	}
+	if query.ContentHash != "" {
+		tx = tx.Where("content_hash=?", query.ContentHash)
+	}
+	if len(query.ArchiveStates) > 0 {
+		tx = tx.Where("archive_state IN ?", query.ArchiveStates)
+	}
+	for _, tag := range query.Tags {
+		tx = tx.Where(`tags LIKE ? ESCAPE '\'`, "%"+tagPattern(tag)+"%")
+	}
+	if len(query.ThreadIDs) > 0 {
+		tx = tx.Where("thread_id IN ?", query.ThreadIDs)
+	}
+	if len(query.MessageIDs) > 0 {
+		// the Message-ID column keeps the header as it was sent, which has the angle brackets
+		var ids []string
+		for _, id := range query.MessageIDs {
+			ids = append(ids, "<"+id+">", id)
+		}
+		tx = tx.Where("message_id IN ?", ids)
+	}
+	return tx
+}
+
+func (s GormStorage) FindThreads(query MailQuery) (*ThreadPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	tx := s.filterMails(query).Session(&gorm.Session{})
+	var total int64
+	if err := tx.Distinct("thread_id").Count(&total).Error; err != nil {
+		return nil, err
+	}
+	find := tx.Select("thread_id").Group("thread_id").Order("MAX(id) DESC")
+	if query.Offset > 0 {
+		find = find.Offset(query.Offset)
+	}
+	if query.Limit > 0 {
+		find = find.Limit(query.Limit)
+	}
+	var ids []string
+	if err := find.Pluck("thread_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	threads, err := loadThreads(s, query.Mailbox, ids, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	threads.Total = int(total)
+	return threads, nil
+}
+
+// fillThreadIDs names the threads of the mails stored before they were threaded.
+func (s GormStorage) fillThreadIDs() error {
+	var mails []*Mail
+	if err := s.Db.Select("id", "created_at", "message_id", "in_reply_to", "reference_ids").Where("thread_id = '' OR thread_id IS NULL").Find(&mails).Error; err != nil {
+		return err
+	}
+	nameThreads(mails)
+	for _, mail := range mails {
+		if err := s.Db.Model(mail).UpdateColumn("thread_id", mail.ThreadID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s GormStorage) FindMails(query MailQuery) (*MailPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	cursor, err := query.cursor()
+	if err != nil {
+		return nil, err
+	}
+	tx := s.filterMails(query).Session(&gorm.Session{})
+	var total int64
+	if err := tx.Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	column := map[string]string{SortSubject: "subject", SortSender: `"from"`}[query.Sort]
+	direction, after := "", ">"
+	if query.Descending {
+		direction, after = " DESC", "<"
+	}
+	find := tx
+	if column != "" {
+		find = find.Order(column + direction)
+	}
+	find = find.Order("id" + direction)
+	if cursor != nil {
+		if column == "" {
+			find = find.Where("id "+after+" ?", cursor.ID)
+		} else {
+			find = find.Where("("+column+" "+after+" ? OR ("+column+" = ? AND id "+after+" ?))", cursor.Value, cursor.Value, cursor.ID)
+		}
+	} else if query.Offset > 0 {
+		find = find.Offset(query.Offset)
+	}
+	if query.Limit > 0 {
+		// one more mail tells whether there is a next page
+		find = find.Limit(query.Limit + 1)
+	}
+	var mails []Mail
+	if err := find.Preload("Envelope.Recipients").Find(&mails).Error; err != nil {
+		return nil, err
+	}
+	page := &MailPage{Mails: mails, Total: int(total)}
+	if query.Limit > 0 && len(mails) > query.Limit {
+		page.Mails = mails[:query.Limit]
+		page.NextCursor = query.nextCursor(&page.Mails[query.Limit-1])
+	}
+	if page.Mails == nil {
+		page.Mails = []Mail{}
+	}
+	return page, nil
+}
+
+func (s GormStorage) GetMail(mailID uint) (*Mail, error) {
+	var mail Mail
+	if err := s.Db.Preload("Envelope.Recipients").First(&mail, mailID).Error; err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+func (s GormStorage) Search(text string) ([]Mail, error) {
+	return search(s, text)
+}
+
+func (s GormStorage) UpdateFlags(mailID uint, flags MailFlags) (*Mail, error) {
+	var mail Mail
+	err := s.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Preload("Envelope.Recipients").First(&mail, mailID).Error; err != nil {
+			return err
+		}
+		if err := flags.apply(&mail); err != nil {
+			return err
+		}
+		return tx.Model(&mail).Select("Seen", "Starred", "Trashed", "Tags").Updates(&mail).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+func (s GormStorage) AddDuplicate(mailID uint) error {
+	result := s.Db.Model(&Mail{}).Where("id=?", mailID).UpdateColumn("duplicates", gorm.Expr("duplicates + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("mail %d does not exist", mailID)
+	}
+	return nil
+}
+
+func (s GormStorage) SetArchiveState(mailID uint, state string) error {
+	result := s.Db.Model(&Mail{}).Where("id=?", mailID).UpdateColumn("archive_state", state)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("mail %d does not exist", mailID)
+	}
+	return nil
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern matched with ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// tagPattern is the tag as it is written in the JSON array of the tags column, escaped for LIKE.
+func tagPattern(tag string) string {
+	data, _ := json.Marshal(strings.ToLower(tag))
+	return likeEscaper.Replace(string(data))
+}
+
+// Delete removes the mail with its bodies, headers, raw message, envelope and mailbox entries.
+func (s GormStorage) Delete(mailID uint) error {
+	deleted, err := s.deleteMails([]uint{mailID})
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("mail %d does not exist", mailID)
 	}
 	return nil
 }
-func (s SQLiteStorage) GetAll() ([]Mail, error) {
+
+func (s GormStorage) DeleteAll(filters ...HeaderFilter) (int, error) {
+	return s.deleteMatching(s.Db.Model(&Mail{}), filters)
+}
+
+func (s GormStorage) DeleteAllByMailbox(username string, filters ...HeaderFilter) (int, error) {
+	return s.deleteMatching(s.mailboxScope(username), filters)
+}
+
+func (s GormStorage) ListMailInfo() ([]MailInfo, error) {
 	var mails []Mail
-	tx := s.Db.Model(&Mail{}).Limit(10).Find(&mails)
+	if err := s.Db.Select("id", "created_at", "size", "owner").Order("id").Find(&mails).Error; err != nil {
+		return nil, err
+	}
+	var mailboxes []Mailbox
+	if err := s.Db.Select("mail_id", "username").Find(&mailboxes).Error; err != nil {
+		return nil, err
+	}
+	usernames := make(map[uint][]string)
+	for _, mailbox := range mailboxes {
+		usernames[mailbox.MailID] = append(usernames[mailbox.MailID], mailbox.Username)
+	}
+	infos := make([]MailInfo, 0, len(mails))
+	for i := range mails {
+		mails[i].Mailboxes = nil
+		for _, username := range usernames[mails[i].ID] {
+			mails[i].Mailboxes = append(mails[i].Mailboxes, &Mailbox{Username: username})
+		}
+		infos = append(infos, newMailInfo(&mails[i]))
+	}
+	return infos, nil
+}
+
+// Compact runs VACUUM, which SQLite needs to shrink the database file.
+func (s GormStorage) Compact() error {
+	return s.Db.Exec("VACUUM").Error
+}
+
+// Size returns the size of the database, without the free pages of SQLite, and of the blob files.
+func (s GormStorage) Size() (int64, error) {
+	var size int64
+	if s.Db.Dialector.Name() == "sqlite" {
+		var pages, free, pageSize int64
+		if err := s.Db.Raw("PRAGMA page_count").Scan(&pages).Error; err != nil {
+			return 0, err
+		}
+		if err := s.Db.Raw("PRAGMA freelist_count").Scan(&free).Error; err != nil {
+			return 0, err
+		}
+		if err := s.Db.Raw("PRAGMA page_size").Scan(&pageSize).Error; err != nil {
+			return 0, err
+		}
+		size = (pages - free) * pageSize
+	} else if err := s.Db.Raw("SELECT pg_database_size(current_database())").Scan(&size).Error; err != nil {
+		return 0, err
+	}
+	if s.Blobs != nil {
+		blobs, err := dirSize(s.Blobs.Root)
+		if err != nil {
+			return 0, err
+		}
+		size += blobs
+	}
+	return size, nil
+}
+
+// deleteMatching deletes the mails of the query having the header fields, in batches so a large purge
+// does not hold a single long transaction.
+func (s GormStorage) deleteMatching(tx *gorm.DB, filters []HeaderFilter) (int, error) {
+	var ids []uint
+	if err := s.filterHeaders(tx, filters).Order("id").Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		ids = ids[len(batch):]
+		count, err := s.deleteMails(batch)
+		deleted += count
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// deleteMails removes the mails with their bodies, headers, raw messages, envelopes and mailbox entries,
+// it returns how many of them existed.
+func (s GormStorage) deleteMails(mailIDs []uint) (int, error) {
+	defer s.lockBlobs()()
+	deleted := 0
+	err := s.Db.Transaction(func(tx *gorm.DB) error {
+		var keys []string
+		for _, mailID := range mailIDs {
+			result := tx.Unscoped().Delete(&Mail{}, mailID)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+			deleted++
+			bodyKeys, err := deleteBodies(tx, mailID)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, bodyKeys...)
+			if err := pluckBlobKeys(tx.Model(&RawMessage{}).Where("mail_id=?", mailID), &keys); err != nil {
+				return err
+			}
+			var envelopeIDs []uint
+			if err := tx.Model(&MailEnvelope{}).Where("mail_id=?", mailID).Pluck("id", &envelopeIDs).Error; err != nil {
+				return err
+			}
+			if len(envelopeIDs) > 0 {
+				if err := tx.Unscoped().Where("mail_envelope_id IN ?", envelopeIDs).Delete(&EnvelopeRecipient{}).Error; err != nil {
+					return err
+				}
+			}
+			for _, table := range []interface{}{&MailEnvelope{}, &Mailbox{}, &Header{}, &RawMessage{}, &MailText{}} {
+				if err := tx.Unscoped().Where("mail_id=?", mailID).Delete(table).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return s.releaseBlobs(tx, keys)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// GetHeadersByMailID returns every header field of the mail in message order.
+func (s GormStorage) GetHeadersByMailID(mailID uint) ([]Header, error) {
+	var headers []Header
+	tx := s.Db.Where("mail_id=?", mailID).Order("position").Find(&headers)
 	if tx.Error != nil {
-		return mails, tx.Error
+		return headers, tx.Error
 	}
-	return mails, nil
+	return headers, nil
 }
 
-func (s SQLiteStorage) GetBodyByMailID(mailID uint) (*Body, error) {
+func (s GormStorage) IsInMailbox(mailID uint, username string) (bool, error) {
+	var count int64
+	tx := s.mailboxScope(username).Where("id=?", mailID).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count > 0, nil
+}
+
+// ResolveMailboxes maps recipient addresses to the users owning them.
+func (s GormStorage) ResolveMailboxes(recipients []string) ([]string, error) {
+	var users []User
+	tx := s.Db.Where("disabled=?", false).Find(&users)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return resolveMailboxes(users, recipients), nil
+}
+
+func resolveMailboxes(users []User, recipients []string) []string {
+	var usernames []string
+	for _, u := range users {
+		if u.Disabled {
+			continue
+		}
+		for _, recipient := range recipients {
+			if u.OwnsAddress(recipient) {
+				usernames = append(usernames, u.Username)
+				break
+			}
+		}
+	}
+	return usernames
+}
+
+func (s GormStorage) filterHeaders(tx *gorm.DB, filters []HeaderFilter) *gorm.DB {
+	for _, filter := range filters {
+		headers := s.Db.Model(&Header{}).Select("mail_id").Where("name=?", textproto.CanonicalMIMEHeaderKey(filter.Name))
+		if filter.Value != "" {
+			headers = headers.Where("value=?", filter.Value)
+		}
+		tx = tx.Where("id IN (?)", headers)
+	}
+	return tx
+}
+func (s GormStorage) mailboxScope(username string) *gorm.DB {
+	return s.Db.Model(&Mail{}).Where("(owner=? OR id IN (?))", username,
+		s.Db.Model(&Mailbox{}).Select("mail_id").Where("username=?", username))
+}
+
+func (s GormStorage) GetBodyByMailID(mailID uint) (*Body, error) {
 	var body Body
 	var mail Mail
 	tx := s.Db.Find(&mail, "ID=?", mailID)
@@ -60,20 +538,221 @@ func (s SQLiteStorage) GetBodyByMailID(mailID uint) (*Body, error) {
 	if err != nil {
 		return &body, err
 	}
-	return &body, nil
+	return &body, s.loadBlob(body.Content)
+}
+
+// GetAttachmentsByMailID returns the attachments of the main body of the mail.
+func (s GormStorage) GetAttachmentsByMailID(mailID uint) ([]Attachment, error) {
+	var attachments []Attachment
+	tx := s.Db.Where("body_id IN (?)", s.Db.Model(&Body{}).Select("id").Where("mail_id=?", mailID)).Find(&attachments)
+	if tx.Error != nil {
+		return attachments, tx.Error
+	}
+	for _, attachment := range attachments {
+		if err := s.loadBlob(attachment.Content); err != nil {
+			return attachments, err
+		}
+	}
+	return attachments, nil
+}
+
+// GetRawByMailID returns the message source of the mail as it was received.
+func (s GormStorage) GetRawByMailID(mailID uint) ([]byte, error) {
+	var raw RawMessage
+	tx := s.Db.Where("mail_id=?", mailID).Find(&raw)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, fmt.Errorf("no raw message is stored for mail %d", mailID)
+	}
+	if raw.BlobKey != "" {
+		if s.Blobs == nil {
+			return nil, fmt.Errorf("raw message %s is kept in a blob store but none is configured", raw.BlobKey)
+		}
+		data, err := s.Blobs.Get(raw.BlobKey)
+		if err != nil {
+			return nil, err
+		}
+		raw.Data = data
+	}
+	return decompress(raw.Data)
+}
+
+// Reparse rebuilds the header fields and the bodies of the mail from its raw message,
+// which picks up the fixes of the MIME parser for mails received earlier.
+func (s GormStorage) Reparse(mailID uint) error {
+	raw, err := s.GetRawByMailID(mailID)
+	if err != nil {
+		return err
+	}
+	parsed, err := NewMailFromRaw(raw)
+	if err != nil {
+		return err
+	}
+	defer s.lockBlobs()()
+	return s.Db.Transaction(func(tx *gorm.DB) error {
+		var mail Mail
+		if err := tx.Preload("Envelope.Recipients").First(&mail, mailID).Error; err != nil {
+			return err
+		}
+		keys, err := deleteBodies(tx, mailID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("mail_id=?", mailID).Delete(&Header{}).Error; err != nil {
+			return err
+		}
+		mail.updateParsed(parsed)
+		if err := tx.Where("mail_id=?", mailID).Delete(&MailText{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(newMailText(&mail)).Error; err != nil {
+			return err
+		}
+		// the new contents are counted before the old ones are released so a blob they share is kept
+		restore, err := s.storeBlobs(tx, &mail)
+		defer restore()
+		if err != nil {
+			return err
+		}
+		if err := tx.Omit("Raw", "Mailboxes", "Envelope").Save(&mail).Error; err != nil {
+			return err
+		}
+		return s.releaseBlobs(tx, keys)
+	})
+}
+
+// deleteBodies deletes the bodies of the mail with their embedded files and attachments,
+// it returns the blob keys of the deleted contents.
+func deleteBodies(tx *gorm.DB, mailID uint) ([]string, error) {
+	var keys []string
+	for _, table := range []interface{}{&Body{}, &Alternative{}} {
+		var bodyIDs []uint
+		if err := tx.Model(table).Where("mail_id=?", mailID).Pluck("id", &bodyIDs).Error; err != nil {
+			return nil, err
+		}
+		if err := pluckBlobKeys(tx.Model(table).Where("mail_id=?", mailID), &keys); err != nil {
+			return nil, err
+		}
+		if len(bodyIDs) > 0 {
+			for _, files := range []interface{}{&Attachment{}, &EmbeddedFile{}} {
+				if err := pluckBlobKeys(tx.Model(files).Where("body_id IN ?", bodyIDs), &keys); err != nil {
+					return nil, err
+				}
+				if err := tx.Unscoped().Where("body_id IN ?", bodyIDs).Delete(files).Error; err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := tx.Unscoped().Where("mail_id=?", mailID).Delete(table).Error; err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func pluckBlobKeys(tx *gorm.DB, keys *[]string) error {
+	var found []string
+	if err := tx.Where("blob_key <> ''").Pluck("blob_key", &found).Error; err != nil {
+		return err
+	}
+	*keys = append(*keys, found...)
+	return nil
 }
 
 type DBReceiver struct {
-	Storage *SQLiteStorage
+	Storage Storage
+	// Archiver copies the received mails matching all ArchiveFilters out of the storage when set.
+	Archiver       MailArchiver
+	ArchiveFilters []HeaderFilter
+	// TagRules tag the received mails before they are persisted.
+	TagRules []TagRule
+	// DedupeWindow counts a message received again within it, with the same Message-ID, envelope and content,
+	// as a duplicate of the stored mail instead of storing it twice. Zero stores every delivery.
+	DedupeWindow time.Duration
+
+	locks    hashLocks
+	archives sync.WaitGroup
 }
 
+// MailArchiver keeps a copy of a persisted mail and its raw message outside the storage.
+type MailArchiver interface {
+	Archive(mail *Mail, raw []byte) error
+}
+
+// The archive states of the mails selected for the archive. A mail stays pending when the server stopped
+// before the upload ended, the pending and failed mails are uploaded again by the archive command.
+const (
+	ArchivePending = "pending"
+	ArchiveDone    = "archived"
+	ArchiveFailed  = "failed"
+)
+
 func (p *DBReceiver) Receive(mail *smtp.Envelope) error {
-	//mail.Content.Body = io.TeeReader(mail.Content.Body, os.Stdout)
-	email, err := NewMail(mail.Content)
+	var email *Mail
+	var err error
+	if mail.Data != nil {
+		email, err = NewMailFromRaw(mail.Data)
+	} else {
+		email, err = NewMail(mail.Content)
+	}
+	if err != nil {
+		return err
+	}
+	email.Owner = mail.Username
+	email.SessionID = mail.SessionID
+	email.Envelope = NewMailEnvelope(mail)
+	if mail.TLS != nil {
+		email.TLS = TLSDetails(*mail.TLS)
+	}
+	email.ContentHash = contentHash(email.MessageID, mail)
+	if p.DedupeWindow > 0 && email.MessageID != "" && email.ContentHash != "" {
+		defer p.locks.lock(email.ContentHash)()
+		duplicate, err := findDuplicate(p.Storage, email.ContentHash, p.DedupeWindow)
+		if err != nil {
+			return err
+		}
+		if duplicate != nil {
+			return p.Storage.AddDuplicate(duplicate.ID)
+		}
+	}
+	usernames, err := p.Storage.ResolveMailboxes(mail.Recipient)
 	if err != nil {
 		return err
 	}
-	return p.Storage.Persist(email)
+	for _, username := range usernames {
+		email.Mailboxes = append(email.Mailboxes, &Mailbox{Username: username})
+	}
+	applyTagRules(email, p.TagRules)
+	archived := p.Archiver != nil && mail.Data != nil && hasHeaders(email, p.ArchiveFilters)
+	if archived {
+		email.ArchiveState = ArchivePending
+	}
+	if err := p.Storage.Persist(email); err != nil {
+		return err
+	}
+	if archived {
+		// uploads are retried with backoff, the client is not kept waiting for them
+		p.archives.Add(1)
+		go func() {
+			defer p.archives.Done()
+			state := ArchiveDone
+			if err := p.Archiver.Archive(email, mail.Data); err != nil {
+				log.Printf("error archiving mail %d %v", email.ID, err)
+				state = ArchiveFailed
+			}
+			if err := p.Storage.SetArchiveState(email.ID, state); err != nil {
+				log.Printf("error recording the archive state of mail %d %v", email.ID, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// WaitArchives waits for the uploads to the archive in progress, before the server stops.
+func (p *DBReceiver) WaitArchives() {
+	p.archives.Wait()
 }
 
 type PrinterReceiver struct {
@@ -1,9 +1,15 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"net/mail"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStorage(t *testing.T) {
@@ -37,3 +43,348 @@ func TestStorage(t *testing.T) {
 	assert.Equal(t, email.Body.Content.Data, body.Data)
 	assert.Equal(t, email.Body.Content.ContentType, body.ContentType)
 }
+
+func TestStorage_Mailboxes(t *testing.T) {
+	dbFile := "/tmp/testmailboxes.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	require.NoError(t, storage.AddUser("alice", []byte("alice@123")))
+	require.NoError(t, storage.SetUserAddresses("alice", []string{"alice@example.com"}))
+	require.NoError(t, storage.AddUser("bob", []byte("bob@123")))
+	require.NoError(t, storage.SetUserAddresses("bob", []string{"@bob.com"}))
+	receiver := &DBReceiver{Storage: storage}
+
+	send := func(username, sender string, recipients ...string) {
+		msg, err := mail.ReadMessage(strings.NewReader(simpleMail))
+		require.NoError(t, err)
+		err = receiver.Receive(&smtp.Envelope{Sender: sender, Recipient: recipients, Username: username, Content: msg})
+		require.NoError(t, err)
+	}
+	send("alice", "alice@example.com", "someone@test.com")
+	send("", "someone@test.com", "alice@example.com", "team@bob.com")
+	send("", "someone@test.com", "nobody@test.com")
+
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(all))
+	aliceMails, err := storage.GetAllByMailbox("alice")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(aliceMails))
+	assert.Equal(t, "alice", aliceMails[0].Owner)
+	bobMails, err := storage.GetAllByMailbox("bob")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(bobMails))
+	assert.Equal(t, all[1].ID, bobMails[0].ID)
+
+	isInMailbox, err := storage.IsInMailbox(all[1].ID, "bob")
+	require.NoError(t, err)
+	assert.True(t, isInMailbox)
+	isInMailbox, err = storage.IsInMailbox(all[0].ID, "bob")
+	require.NoError(t, err)
+	assert.False(t, isInMailbox)
+}
+
+func TestStorage_TLSDetails(t *testing.T) {
+	dbFile := "/tmp/testtlsdetails.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	receiver := &DBReceiver{Storage: storage}
+	msg, err := mail.ReadMessage(strings.NewReader("Return-Path: <sender@test.com>\r\nDelivered-To: receiver@test.com\r\n" +
+		"Received: from client by localhost with ESMTPS\r\n" + simpleMail))
+	require.NoError(t, err)
+	err = receiver.Receive(&smtp.Envelope{
+		Sender:    "sender@test.com",
+		Recipient: []string{"receiver@test.com"},
+		Content:   msg,
+		TLS: &smtp.TLSInfo{
+			Version:           "TLS1.3",
+			CipherSuite:       "TLS_AES_128_GCM_SHA256",
+			ServerName:        "mx.test",
+			ClientCertificate: "CN=client",
+		},
+	})
+	require.NoError(t, err)
+
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	assert.Equal(t, "TLS1.3", mails[0].TLS.Version)
+	assert.Equal(t, "TLS_AES_128_GCM_SHA256", mails[0].TLS.CipherSuite)
+	assert.Equal(t, "mx.test", mails[0].TLS.ServerName)
+	assert.Equal(t, "CN=client", mails[0].TLS.ClientCertificate)
+	assert.Equal(t, "from client by localhost with ESMTPS", mails[0].Received)
+	assert.Equal(t, "<sender@test.com>", mails[0].ReturnPath)
+	assert.Equal(t, Recipients{"receiver@test.com"}, mails[0].DeliveredTo)
+}
+
+func TestStorage_RawMessage(t *testing.T) {
+	dbFile := "/tmp/testrawmessage.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	receiver := &DBReceiver{Storage: storage}
+	raw := []byte("Received: from relay2 by localhost\nReceived: from relay1 by relay2\n" + simpleMail)
+	err = receiver.Receive(&smtp.Envelope{Sender: "sender@test.com", Recipient: []string{"receiver@test.com"}, Data: raw})
+	require.NoError(t, err)
+
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	assert.Equal(t, len(raw), mails[0].Size)
+	stored, err := storage.GetRawByMailID(mails[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, raw, stored)
+	_, err = storage.GetRawByMailID(mails[0].ID + 1)
+	assert.Error(t, err)
+
+	require.NoError(t, storage.Db.Model(&Mail{}).Where("id=?", mails[0].ID).Update("subject", "broken").Error)
+	require.NoError(t, storage.Reparse(mails[0].ID))
+	mails, err = storage.GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, "Test Mail", mails[0].Subject)
+	var bodies int64
+	require.NoError(t, storage.Db.Model(&Body{}).Where("mail_id=?", mails[0].ID).Count(&bodies).Error)
+	assert.Equal(t, int64(1), bodies)
+}
+
+func TestStorage_Envelope(t *testing.T) {
+	dbFile := "/tmp/testenvelope.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	receiver := &DBReceiver{Storage: storage}
+	receivedAt := time.Date(2021, 1, 5, 11, 49, 26, 0, time.UTC)
+	err = receiver.Receive(&smtp.Envelope{
+		Sender:          "bounce@test.com",
+		MailParams:      map[string]string{"SMTPUTF8": "", "BODY": "8BITMIME"},
+		Recipient:       []string{"balaajanthan@gmail.com", "bcc@test.com"},
+		RecipientParams: []map[string]string{{"NOTIFY": "NEVER"}, {}},
+		Helo:            "client.test",
+		ClientAddress:   "192.0.2.1:5123",
+		Username:        "alice",
+		ReceivedAt:      receivedAt,
+		Data:            []byte(simpleMail),
+	})
+	require.NoError(t, err)
+
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	envelope := mails[0].Envelope
+	require.NotNil(t, envelope)
+	assert.Equal(t, "bounce@test.com", envelope.MailFrom)
+	assert.Equal(t, "BODY=8BITMIME SMTPUTF8", envelope.MailParams)
+	assert.Equal(t, "client.test", envelope.Helo)
+	assert.Equal(t, "192.0.2.1:5123", envelope.ClientAddress)
+	assert.Equal(t, "alice", envelope.AuthUser)
+	assert.True(t, receivedAt.Equal(envelope.ReceivedAt))
+	require.Equal(t, 2, len(envelope.Recipients))
+	assert.Equal(t, "balaajanthan@gmail.com", envelope.Recipients[0].Address)
+	assert.Equal(t, "NOTIFY=NEVER", envelope.Recipients[0].Params)
+	assert.Equal(t, "bcc@test.com", envelope.Recipients[1].Address)
+	assert.Equal(t, "", envelope.Recipients[1].Params)
+}
+
+func TestStorage_Headers(t *testing.T) {
+	dbFile := "/tmp/testheaders.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	receiver := &DBReceiver{Storage: storage}
+	for _, campaign := range []string{"41", "42"} {
+		err = receiver.Receive(&smtp.Envelope{
+			Sender:    "sender@test.com",
+			Recipient: []string{"receiver@test.com"},
+			Data:      []byte("X-Campaign-ID: " + campaign + "\nCc: a@test.com\nCc: b@test.com\n" + simpleMail),
+		})
+		require.NoError(t, err)
+	}
+
+	mails, err := storage.GetAll(HeaderFilter{Name: "x-campaign-id", Value: "42"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	headers, err := storage.GetHeadersByMailID(mails[0].ID)
+	require.NoError(t, err)
+	require.True(t, len(headers) > 3)
+	assert.Equal(t, "X-Campaign-Id", headers[0].Name)
+	assert.Equal(t, "42", headers[0].Value)
+	assert.Equal(t, []string{"Cc", "Cc"}, []string{headers[1].Name, headers[2].Name})
+	assert.Equal(t, []string{"a@test.com", "b@test.com"}, []string{headers[1].Value, headers[2].Value})
+
+	mails, err = storage.GetAll(HeaderFilter{Name: "Cc"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(mails))
+	mails, err = storage.GetAll(HeaderFilter{Name: "X-Campaign-ID", Value: "43"})
+	require.NoError(t, err)
+	assert.Empty(t, mails)
+}
+
+func TestStorage_Transcript(t *testing.T) {
+	dbFile := "/tmp/testtranscript.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	receiver := &DBReceiver{Storage: storage}
+	startedAt := time.Now()
+	err = receiver.Receive(&smtp.Envelope{SessionID: "abc123", Sender: "sender@test.com", Recipient: []string{"receiver@test.com"}, Data: []byte(simpleMail)})
+	require.NoError(t, err)
+	err = receiver.ReceiveTranscript(&smtp.Transcript{
+		SessionID:     "abc123",
+		ClientAddress: "127.0.0.1:5000",
+		StartedAt:     startedAt,
+		EndedAt:       startedAt.Add(time.Second),
+		Entries: []smtp.TranscriptEntry{
+			{Time: startedAt, Direction: smtp.ServerLine, Line: "220 localhost ESMTP smtp-go"},
+			{Time: startedAt.Add(time.Millisecond), Direction: smtp.ClientLine, Line: "EHLO client"},
+		},
+	})
+	require.NoError(t, err)
+
+	mails, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	transcript, err := storage.GetTranscriptByMailID(mails[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5000", transcript.ClientAddress)
+	require.Equal(t, 2, len(transcript.Entries))
+	assert.Equal(t, "EHLO client", transcript.Entries[1].Line)
+	assert.Equal(t, "+0.000s S: 220 localhost ESMTP smtp-go\n+0.001s C: EHLO client\n", transcript.ToSMTP().String())
+	_, err = storage.GetTranscriptBySessionID("missing")
+	assert.Error(t, err)
+}
+
+func TestStorage_SessionRecords(t *testing.T) {
+	dbFile := "/tmp/testsessionrecords.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	receiver := &DBReceiver{Storage: storage}
+	transcript := &smtp.Transcript{
+		SessionID: "s1",
+		StartedAt: time.Now(),
+		Entries:   []smtp.TranscriptEntry{{Direction: smtp.ClientLine, Line: "MAIL FROM:<sender@test.com>"}},
+	}
+	require.NoError(t, receiver.ReceiveTranscript(transcript))
+	err = receiver.RecordSession(&smtp.SessionRecord{
+		SessionID:  "s1",
+		Outcome:    smtp.SessionAborted,
+		Reason:     "session closed before the mail transaction completed",
+		Username:   "alice",
+		Sender:     "sender@test.com",
+		Recipient:  []string{"receiver@test.com"},
+		TLS:        &smtp.TLSInfo{Version: "TLS1.3"},
+		Transcript: transcript,
+	})
+	require.NoError(t, err)
+	err = receiver.RecordSession(&smtp.SessionRecord{
+		SessionID:  "s2",
+		Outcome:    smtp.SessionFailed,
+		Reason:     "error reading command EOF",
+		Transcript: &smtp.Transcript{SessionID: "s2"},
+	})
+	require.NoError(t, err)
+
+	records, err := storage.GetSessionRecords("")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	assert.Equal(t, "s2", records[0].SessionID)
+	assert.Equal(t, smtp.SessionAborted, records[1].Outcome)
+	assert.Equal(t, "sender@test.com", records[1].MailFrom)
+	assert.Equal(t, Recipients{"receiver@test.com"}, records[1].Recipients)
+	assert.Equal(t, "TLS1.3", records[1].TLS.Version)
+	records, err = storage.GetSessionRecords("alice")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	_, err = storage.GetTranscriptBySessionID("s1")
+	require.NoError(t, err)
+	_, err = storage.GetTranscriptBySessionID("s2")
+	require.NoError(t, err)
+}
+
+func TestStorage_SearchIndex(t *testing.T) {
+	dbFile := "/tmp/testsearchindex.db"
+	t.Cleanup(func() {
+		err := os.Remove(dbFile)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	storage, err := NewStorage(dbFile)
+	require.NoError(t, err)
+	receiver := &DBReceiver{Storage: storage}
+	require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(passwordResetMail)}))
+	require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)}))
+	if storage.fullText {
+		var indexed int64
+		require.NoError(t, storage.Db.Raw("SELECT count(*) FROM mail_search WHERE mail_search MATCH ?", "password").Scan(&indexed).Error)
+		assert.Equal(t, int64(1), indexed)
+	}
+
+	// a database written before the texts were kept has none of them
+	require.NoError(t, storage.Db.Exec("DELETE FROM mail_texts").Error)
+	mails, err := storage.Search("password")
+	require.NoError(t, err)
+	assert.Empty(t, mails)
+	storage, err = NewStorage(dbFile)
+	require.NoError(t, err)
+	mails, err = storage.Search("password invoice")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	assert.Equal(t, "Your account", mails[0].Subject)
+	mails, err = storage.Search("balaajanthan")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mails))
+	assert.Equal(t, "Test Mail", mails[0].Subject)
+}
+
+func TestSQLiteStorage_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		dbFile := fmt.Sprintf("/tmp/testconformance%d.db", time.Now().UnixNano())
+		t.Cleanup(func() {
+			err := os.Remove(dbFile)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+		storage, err := NewStorage(dbFile)
+		require.NoError(t, err)
+		return storage
+	})
+}
@@ -0,0 +1,74 @@
+package storage
+
+import "github/ajanthan/smtp-go/pkg/smtp"
+
+// Storage is what the API, the SMTP receiver and the CLI need from a mail store.
+// Every backend has to pass the conformance tests in storage_conformance_test.go.
+type Storage interface {
+	MailStore
+	UserStore
+	SessionStore
+}
+
+type MailStore interface {
+	Persist(mail *Mail) error
+	// GetAll returns every mail having the header fields in the order they were received.
+	GetAll(filters ...HeaderFilter) ([]Mail, error)
+	// GetAllByMailbox returns the mails submitted by the user or delivered to one of its addresses.
+	GetAllByMailbox(username string, filters ...HeaderFilter) ([]Mail, error)
+	// FindMails returns a page of the mails matching the query.
+	FindMails(query MailQuery) (*MailPage, error)
+	// FindThreads returns a page of the threads having mails matching the query, the one with the latest mail
+	// first. Offset and Limit page the threads, which hold their mails of the query mailbox.
+	FindThreads(query MailQuery) (*ThreadPage, error)
+	GetMail(mailID uint) (*Mail, error)
+	IsInMailbox(mailID uint, username string) (bool, error)
+	GetBodyByMailID(mailID uint) (*Body, error)
+	GetAttachmentsByMailID(mailID uint) ([]Attachment, error)
+	GetHeadersByMailID(mailID uint) ([]Header, error)
+	GetRawByMailID(mailID uint) ([]byte, error)
+	Reparse(mailID uint) error
+	// UpdateFlags changes the read state, the star and the tags of the mail and returns it.
+	UpdateFlags(mailID uint, flags MailFlags) (*Mail, error)
+	// AddDuplicate counts a delivery of the mail that was not stored again.
+	AddDuplicate(mailID uint) error
+	// SetArchiveState records how the upload of the mail to the archive went, see ArchivePending.
+	SetArchiveState(mailID uint, state string) error
+	Delete(mailID uint) error
+	// DeleteAll deletes the mails having all the header fields, every mail when none is given, and returns how many.
+	DeleteAll(filters ...HeaderFilter) (int, error)
+	DeleteAllByMailbox(username string, filters ...HeaderFilter) (int, error)
+	// ListMailInfo returns the age, size and mailboxes of every mail, oldest first, for the retention policy.
+	ListMailInfo() ([]MailInfo, error)
+	// Compact gives the space of deleted mails back to the file system.
+	Compact() error
+	// Size returns the bytes the storage takes, leaving out the space Compact gives back.
+	Size() (int64, error)
+	// Search returns the mails matching a search in the syntax of ParseSearchQuery, in the order they were received.
+	Search(text string) ([]Mail, error)
+}
+
+type UserStore interface {
+	smtp.AuthenticationService
+	smtp.SenderPolicy
+	AddUser(username string, password []byte) error
+	ListUsers() ([]User, error)
+	// HasUsers tells whether any user was added, without loading them.
+	HasUsers() (bool, error)
+	DeleteUser(username string) error
+	SetPassword(username string, password []byte) error
+	SetUserDisabled(username string, disabled bool) error
+	SetUserAddresses(username string, addresses []string) error
+	// ResolveMailboxes maps recipient addresses to the users owning them.
+	ResolveMailboxes(recipients []string) ([]string, error)
+}
+
+type SessionStore interface {
+	PersistTranscript(transcript *Transcript) error
+	GetTranscriptBySessionID(sessionID string) (*Transcript, error)
+	GetTranscriptByMailID(mailID uint) (*Transcript, error)
+	// PersistSessionRecord stores the record together with its transcript, unless that is already stored.
+	PersistSessionRecord(record *SessionRecord, transcript *Transcript) error
+	GetSessionRecords(username string) ([]SessionRecord, error)
+	GetSessionRecord(sessionID string) (*SessionRecord, error)
+}
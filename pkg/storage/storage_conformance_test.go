@@ -0,0 +1,631 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorageConformance checks the behaviour every Storage backend has to provide.
+// newStorage returns an empty storage, cleaned up by the test.
+func testStorageConformance(t *testing.T, newStorage func(t *testing.T) Storage) {
+	receive := func(t *testing.T, storage Storage, envelope *smtp.Envelope) Mail {
+		receiver := &DBReceiver{Storage: storage}
+		require.NoError(t, receiver.Receive(envelope))
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		require.NotEmpty(t, mails)
+		latest := mails[0]
+		for _, mail := range mails {
+			if mail.ID > latest.ID {
+				latest = mail
+			}
+		}
+		return latest
+	}
+
+	t.Run("PersistAndGet", func(t *testing.T) {
+		storage := newStorage(t)
+		raw := []byte("X-Campaign-ID: 42\n" + mailWithAttachment)
+		mail := receive(t, storage, &smtp.Envelope{
+			SessionID: "s1",
+			Sender:    "bounce@test.com",
+			Recipient: []string{"test2@test.com", "bcc@test.com"},
+			Data:      raw,
+		})
+		assert.Equal(t, "Test with Attachment", mail.Subject)
+		assert.Equal(t, Recipients{"Test2 Test2 <test2@test.com>"}, mail.To)
+		assert.Equal(t, len(raw), mail.Size)
+
+		got, err := storage.GetMail(mail.ID)
+		require.NoError(t, err)
+		assert.Equal(t, mail.Subject, got.Subject)
+		require.NotNil(t, got.Envelope)
+		assert.Equal(t, "bounce@test.com", got.Envelope.MailFrom)
+		require.Equal(t, 2, len(got.Envelope.Recipients))
+		assert.Equal(t, "bcc@test.com", got.Envelope.Recipients[1].Address)
+		_, err = storage.GetMail(mail.ID + 100)
+		assert.Error(t, err)
+
+		body, err := storage.GetBodyByMailID(mail.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain", body.ContentType)
+		attachments, err := storage.GetAttachmentsByMailID(mail.ID)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(attachments))
+		assert.Equal(t, "image/gif", attachments[0].ContentType)
+		assert.NotEmpty(t, attachments[0].Data)
+
+		stored, err := storage.GetRawByMailID(mail.ID)
+		require.NoError(t, err)
+		assert.Equal(t, raw, stored)
+		headers, err := storage.GetHeadersByMailID(mail.ID)
+		require.NoError(t, err)
+		require.True(t, len(headers) > 1)
+		assert.Equal(t, "X-Campaign-Id", headers[0].Name)
+		assert.Equal(t, "42", headers[0].Value)
+	})
+
+	t.Run("FilterAndSearch", func(t *testing.T) {
+		storage := newStorage(t)
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte("X-Campaign-ID: 41\n" + simpleMail)})
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte("X-Campaign-ID: 42\n" + mailWithAttachment)})
+
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		assert.Equal(t, 2, len(mails))
+		mails, err = storage.GetAll(HeaderFilter{Name: "x-campaign-id", Value: "42"})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(mails))
+		assert.Equal(t, "Test with Attachment", mails[0].Subject)
+		mails, err = storage.GetAll(HeaderFilter{Name: "X-Campaign-Id"})
+		require.NoError(t, err)
+		assert.Equal(t, 2, len(mails))
+
+		mails, err = storage.Search("attachment")
+		require.NoError(t, err)
+		require.Equal(t, 1, len(mails))
+		assert.Equal(t, "Test with Attachment", mails[0].Subject)
+		mails, err = storage.Search("balaajanthan")
+		require.NoError(t, err)
+		require.Equal(t, 1, len(mails))
+		assert.Equal(t, "Test Mail", mails[0].Subject)
+		mails, err = storage.Search("nothing like this")
+		require.NoError(t, err)
+		assert.Empty(t, mails)
+	})
+
+	t.Run("FullTextSearch", func(t *testing.T) {
+		storage := newStorage(t)
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(mailWithAttachment)})
+		reset := receive(t, storage, &smtp.Envelope{Sender: "no-reply@shop.test", Recipient: []string{"hidden@test.com"}, Data: []byte(passwordResetMail)})
+		subjects := func(text string) []string {
+			mails, err := storage.Search(text)
+			require.NoError(t, err)
+			var subjects []string
+			for _, mail := range mails {
+				subjects = append(subjects, mail.Subject)
+			}
+			return subjects
+		}
+
+		assert.Equal(t, []string{"Your account"}, subjects("password reset"))
+		assert.Equal(t, []string{"Your account"}, subjects(`"reset your password"`))
+		assert.Empty(t, subjects("stylesheet"), "style elements are not indexed")
+		assert.Empty(t, subjects("href"), "markup is not indexed")
+		assert.Equal(t, []string{"Your account"}, subjects("invoice"), "attachment names are indexed")
+		assert.Equal(t, []string{"Your account"}, subjects("hidden"), "envelope recipients are indexed")
+		assert.Equal(t, []string{"Test with Attachment", "Your account"}, subjects("has:attachment"))
+		assert.Equal(t, []string{"Your account"}, subjects("from:accounts password"))
+		assert.Empty(t, subjects("from:test1 password"))
+		assert.Equal(t, []string{"Test with Attachment"}, subjects(`to:test2 subject:"with attachment"`))
+		assert.Equal(t, []string{"Your account"}, subjects("after:2000-01-01 password"))
+		assert.Empty(t, subjects("before:2000-01-01 password"))
+		assert.Empty(t, subjects("pass%reset"), "terms are matched literally")
+		assert.Empty(t, subjects("pa_sword"), "terms are matched literally")
+		_, err := storage.Search("has:wings")
+		assert.Error(t, err)
+		_, err = storage.Search("before:yesterday")
+		assert.Error(t, err)
+
+		page, err := storage.FindMails(MailQuery{Terms: []string{"password"}, Limit: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 1, page.Total)
+
+		require.NoError(t, storage.Reparse(reset.ID))
+		assert.Equal(t, []string{"Your account"}, subjects("password"))
+		require.NoError(t, storage.Delete(reset.ID))
+		assert.Empty(t, subjects("password"))
+		assert.Empty(t, subjects("invoice"))
+	})
+
+	t.Run("FlagsAndTags", func(t *testing.T) {
+		storage := newStorage(t)
+		receiver := &DBReceiver{Storage: storage, TagRules: []TagRule{{Tag: "shop", SenderDomain: "shop.test"}}}
+		require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)}))
+		require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "no-reply@shop.test", Recipient: []string{"b@test.com"}, Data: []byte(passwordResetMail)}))
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(mails))
+		plain, reset := mails[0], mails[1]
+		assert.False(t, plain.Seen)
+		assert.Empty(t, plain.Tags)
+		assert.Equal(t, Tags{"shop"}, reset.Tags)
+
+		yes := true
+		updated, err := storage.UpdateFlags(plain.ID, MailFlags{Seen: &yes, AddTags: []string{"Later", "todo"}})
+		require.NoError(t, err)
+		assert.True(t, updated.Seen)
+		assert.False(t, updated.Starred)
+		assert.Equal(t, Tags{"later", "todo"}, updated.Tags)
+		_, err = storage.UpdateFlags(reset.ID, MailFlags{Starred: &yes, AddTags: []string{"todo"}})
+		require.NoError(t, err)
+		trashed, err := storage.UpdateFlags(reset.ID, MailFlags{Trashed: &yes})
+		require.NoError(t, err)
+		assert.True(t, trashed.Trashed)
+		assert.True(t, trashed.Starred)
+		stored, err := storage.GetMail(reset.ID)
+		require.NoError(t, err)
+		assert.True(t, stored.Trashed)
+		got, err := storage.GetMail(plain.ID)
+		require.NoError(t, err)
+		assert.True(t, got.Seen)
+		assert.Equal(t, Tags{"later", "todo"}, got.Tags)
+
+		ids := func(query MailQuery) []uint {
+			page, err := storage.FindMails(query)
+			require.NoError(t, err)
+			var ids []uint
+			for _, mail := range page.Mails {
+				ids = append(ids, mail.ID)
+			}
+			return ids
+		}
+		assert.Equal(t, []uint{plain.ID, reset.ID}, ids(MailQuery{Tags: []string{"TODO"}}))
+		assert.Equal(t, []uint{plain.ID}, ids(MailQuery{Tags: []string{"todo", "later"}}))
+		assert.Empty(t, ids(MailQuery{Tags: []string{"lat"}}))
+		assert.Equal(t, []uint{reset.ID}, ids(MailQuery{Unseen: true}))
+		assert.Equal(t, []uint{reset.ID}, ids(MailQuery{Starred: true}))
+		mails, err = storage.Search("tag:todo is:starred password")
+		require.NoError(t, err)
+		require.Equal(t, 1, len(mails))
+		assert.Equal(t, reset.ID, mails[0].ID)
+
+		no := false
+		updated, err = storage.UpdateFlags(plain.ID, MailFlags{Seen: &no, Tags: []string{"done"}, RemoveTags: []string{"later"}})
+		require.NoError(t, err)
+		assert.False(t, updated.Seen)
+		assert.Equal(t, Tags{"done"}, updated.Tags)
+		updated, err = storage.UpdateFlags(plain.ID, MailFlags{RemoveTags: []string{"done"}})
+		require.NoError(t, err)
+		assert.Empty(t, updated.Tags)
+		require.NoError(t, storage.Reparse(reset.ID))
+		got, err = storage.GetMail(reset.ID)
+		require.NoError(t, err)
+		assert.True(t, got.Starred, "reparsing keeps the flags")
+		assert.Equal(t, Tags{"shop", "todo"}, got.Tags)
+
+		_, err = storage.UpdateFlags(plain.ID, MailFlags{AddTags: []string{"two words"}})
+		assert.Error(t, err)
+		_, err = storage.UpdateFlags(reset.ID+100, MailFlags{Seen: &yes})
+		assert.Error(t, err)
+	})
+
+	t.Run("Threading", func(t *testing.T) {
+		storage := newStorage(t)
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)})
+		reply := receive(t, storage, &smtp.Envelope{Sender: "b@test.com", Recipient: []string{"a@test.com"}, Data: []byte(
+			"Message-ID: <reply@test.com>\nIn-Reply-To: <C7F515EF-8A2F-4145-920B-733114E966B7@icloud.com>\n" +
+				"References: <C7F515EF-8A2F-4145-920B-733114E966B7@icloud.com>\nSubject: Re: Test Mail\nContent-Type: text/plain\n\nHello\n")})
+		assert.Equal(t, "C7F515EF-8A2F-4145-920B-733114E966B7@icloud.com", reply.InReplyTo)
+		assert.Equal(t, MessageIDs{"C7F515EF-8A2F-4145-920B-733114E966B7@icloud.com"}, reply.References)
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(
+			"Message-ID: <again@test.com>\nIn-Reply-To: <reply@test.com>\n" +
+				"References: <C7F515EF-8A2F-4145-920B-733114E966B7@icloud.com> <reply@test.com>\nSubject: Re: Re: Test Mail\nContent-Type: text/plain\n\nHi again\n")})
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(mailWithAttachment)})
+
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		threads := BuildThreads(mails)
+		require.Equal(t, 2, len(threads))
+		thread, ok := FindThread(threads, reply.ID)
+		require.True(t, ok)
+		assert.Equal(t, "Test Mail", thread.Subject)
+		assert.Equal(t, 3, thread.Messages)
+		require.Equal(t, 1, len(thread.Root.Replies))
+		assert.Equal(t, reply.ID, thread.Root.Replies[0].Mail.ID)
+		require.Equal(t, 1, len(thread.Root.Replies[0].Replies))
+		assert.Equal(t, "Re: Re: Test Mail", thread.Root.Replies[0].Replies[0].Mail.Subject)
+
+		// the thread ID is stored with the mail, the threads are paged without threading every mail
+		assert.Equal(t, "C7F515EF-8A2F-4145-920B-733114E966B7@icloud.com", reply.ThreadID)
+		anonymous := receive(t, storage, &smtp.Envelope{Sender: "c@test.com", Recipient: []string{"b@test.com"}, Data: []byte(
+			"Subject: No ID\nContent-Type: text/plain\n\nHello\n")})
+		assert.Equal(t, fmt.Sprintf("mail-%d", anonymous.ID), anonymous.ThreadID)
+		stored, err := storage.GetMail(anonymous.ID)
+		require.NoError(t, err)
+		assert.Equal(t, anonymous.ThreadID, stored.ThreadID)
+		page, err := storage.FindThreads(MailQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, 3, page.Total)
+		require.Equal(t, 3, len(page.Threads))
+		page, err = storage.FindThreads(MailQuery{Offset: 2, Limit: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 3, page.Total)
+		require.Equal(t, 1, len(page.Threads))
+		assert.Equal(t, "Test Mail", page.Threads[0].Subject)
+		page, err = storage.FindThreads(MailQuery{Subject: "Re:"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, page.Total)
+		found, err := GetThread(storage, reply.ID, "")
+		require.NoError(t, err)
+		assert.Equal(t, 3, found.Messages)
+		_, err = GetThread(storage, reply.ID, "nobody@test.com")
+		assert.Error(t, err)
+	})
+
+	t.Run("ThreadIDs", func(t *testing.T) {
+		storage := newStorage(t)
+		message := func(id, headers, subject string) *smtp.Envelope {
+			return &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(
+				"Message-ID: <" + id + ">\n" + headers + "Subject: " + subject + "\nContent-Type: text/plain\n\nHi\n")}
+		}
+		// replies naming only their parent join the thread of the parent
+		a := receive(t, storage, message("a@test.com", "", "Chain"))
+		b := receive(t, storage, message("b@test.com", "In-Reply-To: <a@test.com>\nReferences: <a@test.com>\n", "Re: Chain"))
+		c := receive(t, storage, message("c@test.com", "In-Reply-To: <b@test.com>\n", "Re: Re: Chain"))
+		assert.Equal(t, "a@test.com", a.ThreadID)
+		assert.Equal(t, a.ThreadID, b.ThreadID)
+		assert.Equal(t, a.ThreadID, c.ThreadID)
+
+		// replies received before their parent move to its thread when it arrives
+		z := receive(t, storage, message("z@test.com", "In-Reply-To: <y@test.com>\n", "Re: Re: Late"))
+		assert.Equal(t, "y@test.com", z.ThreadID)
+		x := receive(t, storage, message("x@test.com", "", "Late"))
+		y := receive(t, storage, message("y@test.com", "In-Reply-To: <x@test.com>\n", "Re: Late"))
+		assert.Equal(t, x.ThreadID, y.ThreadID)
+		stored, err := storage.GetMail(z.ID)
+		require.NoError(t, err)
+		assert.Equal(t, x.ThreadID, stored.ThreadID)
+
+		page, err := storage.FindThreads(MailQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, 2, page.Total)
+		for _, mail := range []Mail{c, z} {
+			thread, err := GetThread(storage, mail.ID, "")
+			require.NoError(t, err)
+			assert.Equal(t, 3, thread.Messages)
+		}
+	})
+
+	t.Run("Dedupe", func(t *testing.T) {
+		storage := newStorage(t)
+		receiver := &DBReceiver{Storage: storage, DedupeWindow: time.Hour}
+		deliver := func(trace, recipient string) {
+			require.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{recipient},
+				Data: []byte("Received: " + trace + "\n" + simpleMail)}))
+		}
+		deliver("from one", "b@test.com")
+		deliver("from two", "b@test.com")
+		deliver("from three", "b@test.com")
+		deliver("from one", "c@test.com")
+
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(mails))
+		page, err := storage.FindMails(MailQuery{Duplicated: true})
+		require.NoError(t, err)
+		require.Equal(t, 1, page.Total)
+		assert.Equal(t, 2, page.Mails[0].Duplicates)
+		assert.Equal(t, "b@test.com", page.Mails[0].Envelope.Recipients[0].Address)
+		assert.NotEmpty(t, page.Mails[0].ContentHash)
+
+		// parallel retries of a new message are stored once
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, receiver.Receive(&smtp.Envelope{Sender: "a@test.com", Recipient: []string{"d@test.com"},
+					Data: []byte(fmt.Sprintf("Received: from %d\n", i) + simpleMail)}))
+			}(i)
+		}
+		wg.Wait()
+		page, err = storage.FindMails(MailQuery{Duplicated: true, Sort: SortReceived, Descending: true})
+		require.NoError(t, err)
+		require.Equal(t, 2, page.Total)
+		assert.Equal(t, 7, page.Mails[0].Duplicates)
+		assert.Equal(t, "d@test.com", page.Mails[0].Envelope.Recipients[0].Address)
+
+		receiver.DedupeWindow = 0
+		deliver("from four", "b@test.com")
+		mails, err = storage.GetAll()
+		require.NoError(t, err)
+		assert.Equal(t, 4, len(mails))
+		assert.Error(t, storage.AddDuplicate(mails[0].ID+100))
+	})
+
+	t.Run("ArchiveState", func(t *testing.T) {
+		storage := newStorage(t)
+		first := receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)})
+		second := receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(mailWithAttachment)})
+		require.NoError(t, storage.SetArchiveState(first.ID, ArchiveFailed))
+		require.NoError(t, storage.SetArchiveState(second.ID, ArchiveDone))
+		assert.Error(t, storage.SetArchiveState(second.ID+100, ArchiveDone))
+
+		page, err := storage.FindMails(MailQuery{ArchiveStates: []string{ArchivePending, ArchiveFailed}})
+		require.NoError(t, err)
+		require.Equal(t, 1, page.Total)
+		assert.Equal(t, first.ID, page.Mails[0].ID)
+		assert.Equal(t, ArchiveFailed, page.Mails[0].ArchiveState)
+	})
+
+	t.Run("Mailboxes", func(t *testing.T) {
+		storage := newStorage(t)
+		require.NoError(t, storage.AddUser("alice", []byte("alice@123")))
+		require.NoError(t, storage.SetUserAddresses("alice", []string{"alice@example.com"}))
+		require.NoError(t, storage.AddUser("bob", []byte("bob@123")))
+		require.NoError(t, storage.SetUserAddresses("bob", []string{"@bob.com"}))
+		sent := receive(t, storage, &smtp.Envelope{Username: "alice", Sender: "alice@example.com", Recipient: []string{"x@test.com"}, Data: []byte(simpleMail)})
+		delivered := receive(t, storage, &smtp.Envelope{Sender: "x@test.com", Recipient: []string{"team@bob.com"}, Data: []byte(simpleMail)})
+
+		usernames, err := storage.ResolveMailboxes([]string{"ALICE@example.com", "someone@bob.com", "x@test.com"})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"alice", "bob"}, usernames)
+		mails, err := storage.GetAllByMailbox("alice")
+		require.NoError(t, err)
+		require.Equal(t, 1, len(mails))
+		assert.Equal(t, sent.ID, mails[0].ID)
+		assert.Equal(t, "alice", mails[0].Owner)
+		isInMailbox, err := storage.IsInMailbox(delivered.ID, "bob")
+		require.NoError(t, err)
+		assert.True(t, isInMailbox)
+		isInMailbox, err = storage.IsInMailbox(sent.ID, "bob")
+		require.NoError(t, err)
+		assert.False(t, isInMailbox)
+	})
+
+	t.Run("ReparseAndDelete", func(t *testing.T) {
+		storage := newStorage(t)
+		mail := receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(mailWithAttachment)})
+		require.NoError(t, storage.Reparse(mail.ID))
+		got, err := storage.GetMail(mail.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Test with Attachment", got.Subject)
+		attachments, err := storage.GetAttachmentsByMailID(mail.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(attachments))
+
+		require.NoError(t, storage.Delete(mail.ID))
+		assert.Error(t, storage.Delete(mail.ID))
+		_, err = storage.GetMail(mail.ID)
+		assert.Error(t, err)
+		_, err = storage.GetRawByMailID(mail.ID)
+		assert.Error(t, err)
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		assert.Empty(t, mails)
+		headers, err := storage.GetHeadersByMailID(mail.ID)
+		require.NoError(t, err)
+		assert.Empty(t, headers)
+	})
+
+	t.Run("FindMails", func(t *testing.T) {
+		storage := newStorage(t)
+		require.NoError(t, storage.AddUser("alice", []byte("alice@123")))
+		require.NoError(t, storage.SetUserAddresses("alice", []string{"alice@example.com"}))
+		subjects := []string{"Delta", "Alpha", "Charlie", "Bravo", "Echo"}
+		var ids []uint
+		for i, subject := range subjects {
+			recipient := "b@test.com"
+			if i%2 == 0 {
+				recipient = "alice@example.com"
+			}
+			raw := fmt.Sprintf("From: sender%d@test.com\nTo: %s\nSubject: %s\nContent-Type: text/plain\n\nHi\n", i, recipient, subject)
+			ids = append(ids, receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{recipient}, Data: []byte(raw)}).ID)
+		}
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(mailWithAttachment)})
+		subjectsOf := func(page *MailPage) []string {
+			var got []string
+			for _, mail := range page.Mails {
+				got = append(got, mail.Subject)
+			}
+			return got
+		}
+
+		page, err := storage.FindMails(MailQuery{Descending: true, Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, 6, page.Total)
+		assert.Equal(t, []string{"Test with Attachment", "Echo"}, subjectsOf(page))
+		page, err = storage.FindMails(MailQuery{Descending: true, Limit: 2, Cursor: page.NextCursor})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bravo", "Charlie"}, subjectsOf(page))
+		page, err = storage.FindMails(MailQuery{Descending: true, Limit: 3, Offset: 4})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Alpha", "Delta"}, subjectsOf(page))
+		assert.Empty(t, page.NextCursor)
+
+		var sorted []string
+		query := MailQuery{Sort: SortSubject, Limit: 4, Filters: []HeaderFilter{{Name: "Content-Type", Value: "text/plain"}}}
+		for {
+			page, err = storage.FindMails(query)
+			require.NoError(t, err)
+			assert.Equal(t, 5, page.Total)
+			sorted = append(sorted, subjectsOf(page)...)
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		assert.Equal(t, []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo"}, sorted)
+		page, err = storage.FindMails(MailQuery{Sort: SortSender, Descending: true, Limit: 1, From: "SENDER"})
+		require.NoError(t, err)
+		assert.Equal(t, 5, page.Total)
+		assert.Equal(t, []string{"Echo"}, subjectsOf(page))
+
+		page, err = storage.FindMails(MailQuery{Mailbox: "alice", Subject: "a"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Delta", "Charlie"}, subjectsOf(page))
+		page, err = storage.FindMails(MailQuery{To: "B@TEST", Subject: "o"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bravo"}, subjectsOf(page))
+		// the wildcards of LIKE are matched literally
+		for _, query := range []MailQuery{{Subject: "%"}, {Subject: "_"}, {From: "sender_"}} {
+			page, err = storage.FindMails(query)
+			require.NoError(t, err)
+			assert.Equal(t, 0, page.Total, query)
+		}
+		page, err = storage.FindMails(MailQuery{HasAttachment: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Test with Attachment"}, subjectsOf(page))
+		page, err = storage.FindMails(MailQuery{Before: time.Now().Add(time.Hour), After: time.Now().Add(-time.Hour)})
+		require.NoError(t, err)
+		assert.Equal(t, 6, page.Total)
+		page, err = storage.FindMails(MailQuery{After: time.Now().Add(time.Hour)})
+		require.NoError(t, err)
+		assert.Equal(t, 0, page.Total)
+		assert.NotNil(t, page.Mails)
+		mails, err := storage.GetAll()
+		require.NoError(t, err)
+		require.Equal(t, 6, len(mails))
+		assert.Equal(t, ids[0], mails[0].ID)
+
+		_, err = storage.FindMails(MailQuery{Sort: "size"})
+		assert.Error(t, err)
+		_, err = storage.FindMails(MailQuery{Cursor: "not a cursor"})
+		assert.Error(t, err)
+	})
+
+	t.Run("DeleteAllAndRetention", func(t *testing.T) {
+		storage := newStorage(t)
+		require.NoError(t, storage.AddUser("alice", []byte("alice@123")))
+		require.NoError(t, storage.SetUserAddresses("alice", []string{"alice@example.com"}))
+		first := receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"alice@example.com"}, Data: []byte("X-Campaign-ID: 41\n" + simpleMail)})
+		second := receive(t, storage, &smtp.Envelope{Username: "alice", Sender: "alice@example.com", Recipient: []string{"b@test.com"}, Data: []byte("X-Campaign-ID: 42\n" + simpleMail)})
+		third := receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte("X-Campaign-ID: 42\n" + mailWithAttachment)})
+
+		infos, err := storage.ListMailInfo()
+		require.NoError(t, err)
+		require.Equal(t, 3, len(infos))
+		assert.Equal(t, []uint{first.ID, second.ID, third.ID}, []uint{infos[0].ID, infos[1].ID, infos[2].ID})
+		assert.Equal(t, []string{"alice"}, infos[0].Mailboxes)
+		assert.Equal(t, []string{"alice"}, infos[1].Mailboxes)
+		assert.Empty(t, infos[2].Mailboxes)
+		assert.Equal(t, third.Size, infos[2].Size)
+		assert.False(t, infos[0].CreatedAt.IsZero())
+
+		deleted, err := Purge(storage, RetentionPolicy{MaxMails: 2})
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		_, err = storage.GetMail(first.ID)
+		assert.Error(t, err)
+
+		deleted, err = storage.DeleteAllByMailbox("alice", HeaderFilter{Name: "X-Campaign-Id", Value: "41"})
+		require.NoError(t, err)
+		assert.Equal(t, 0, deleted)
+		deleted, err = storage.DeleteAll(HeaderFilter{Name: "X-Campaign-Id", Value: "42"}, HeaderFilter{Name: "Subject", Value: "Test with Attachment"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		_, err = storage.GetRawByMailID(third.ID)
+		assert.Error(t, err)
+		deleted, err = storage.DeleteAllByMailbox("alice")
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		require.NoError(t, storage.Compact())
+
+		receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)})
+		latest := receive(t, storage, &smtp.Envelope{Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)})
+		size, err := storage.Size()
+		require.NoError(t, err)
+		assert.Greater(t, size, int64(0))
+		deleted, err = Purge(storage, RetentionPolicy{MaxSize: size - 1})
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		_, err = storage.GetMail(latest.ID)
+		assert.NoError(t, err)
+		deleted, err = storage.DeleteAll()
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		infos, err = storage.ListMailInfo()
+		require.NoError(t, err)
+		assert.Empty(t, infos)
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		storage := newStorage(t)
+		hasUsers, err := storage.HasUsers()
+		require.NoError(t, err)
+		assert.False(t, hasUsers)
+		require.NoError(t, storage.AddUser("bob", []byte("bob@123")))
+		hasUsers, err = storage.HasUsers()
+		require.NoError(t, err)
+		assert.True(t, hasUsers)
+		require.NoError(t, storage.AddUser("alice", []byte("alice@123")))
+		assert.Error(t, storage.AddUser("alice", []byte("other")))
+		users, err := storage.ListUsers()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(users))
+		assert.Equal(t, "alice", users[0].Username)
+
+		challenge := []byte("<1896.697170952@postoffice.example.net>")
+		assert.NoError(t, storage.Authenticate("alice", []byte("alice@123")))
+		assert.NoError(t, storage.ValidateHMAC("alice", challenge, cramMD5Response("alice@123", challenge)))
+		err = storage.Authenticate("alice", []byte("wrong"))
+		assert.True(t, errors.As(err, &smtp.InvalidCredentialError{}))
+		require.NoError(t, storage.SetPassword("alice", []byte("changed")))
+		assert.NoError(t, storage.Authenticate("alice", []byte("changed")))
+		require.NoError(t, storage.SetUserDisabled("alice", true))
+		assert.Error(t, storage.Authenticate("alice", []byte("changed")))
+		require.NoError(t, storage.SetUserDisabled("alice", false))
+
+		require.NoError(t, storage.SetUserAddresses("alice", []string{"@example.com"}))
+		assert.NoError(t, storage.AuthorizeSender("alice", "anyone@example.com"))
+		err = storage.AuthorizeSender("alice", "alice@test.com")
+		assert.True(t, errors.As(err, &smtp.SenderNotAllowedError{}))
+
+		require.NoError(t, storage.DeleteUser("alice"))
+		assert.Error(t, storage.DeleteUser("alice"))
+		assert.Error(t, storage.Authenticate("alice", []byte("changed")))
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		storage := newStorage(t)
+		receiver := &DBReceiver{Storage: storage}
+		startedAt := time.Now()
+		transcript := &smtp.Transcript{
+			SessionID: "s1",
+			StartedAt: startedAt,
+			Entries:   []smtp.TranscriptEntry{{Time: startedAt, Direction: smtp.ClientLine, Line: "EHLO client"}},
+		}
+		mail := receive(t, storage, &smtp.Envelope{SessionID: "s1", Sender: "a@test.com", Recipient: []string{"b@test.com"}, Data: []byte(simpleMail)})
+		require.NoError(t, receiver.ReceiveTranscript(transcript))
+		got, err := storage.GetTranscriptByMailID(mail.ID)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(got.Entries))
+		assert.Equal(t, "EHLO client", got.Entries[0].Line)
+		_, err = storage.GetTranscriptBySessionID("missing")
+		assert.Error(t, err)
+
+		require.NoError(t, receiver.RecordSession(&smtp.SessionRecord{SessionID: "s1", Outcome: smtp.SessionRejected, Username: "alice", Transcript: transcript}))
+		require.NoError(t, receiver.RecordSession(&smtp.SessionRecord{SessionID: "s2", Outcome: smtp.SessionFailed, Transcript: &smtp.Transcript{SessionID: "s2"}}))
+		records, err := storage.GetSessionRecords("")
+		require.NoError(t, err)
+		require.Equal(t, 2, len(records))
+		assert.Equal(t, "s2", records[0].SessionID)
+		records, err = storage.GetSessionRecords("alice")
+		require.NoError(t, err)
+		require.Equal(t, 1, len(records))
+		record, err := storage.GetSessionRecord("s2")
+		require.NoError(t, err)
+		assert.Equal(t, smtp.SessionFailed, record.Outcome)
+		_, err = storage.GetSessionRecord("missing")
+		assert.Error(t, err)
+		_, err = storage.GetTranscriptBySessionID("s2")
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Tags are the labels of a mail, lower case and without white space, commas or quotes.
+type Tags []string
+
+func (t Tags) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(t)
+	return string(bytes), err
+}
+
+func (t *Tags) Scan(input interface{}) error {
+	switch value := input.(type) {
+	case string:
+		return json.Unmarshal([]byte(value), t)
+	case []byte:
+		return json.Unmarshal(value, t)
+	case nil:
+		*t = nil
+		return nil
+	default:
+		return errors.New("unsupported type")
+	}
+}
+
+func (Tags) GormDataType() string {
+	return "text"
+}
+
+// Has tells whether the mail carries the tag.
+func (t Tags) Has(tag string) bool {
+	tag = strings.ToLower(tag)
+	for _, existing := range t {
+		if existing == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MailFlags changes the read state, the star, the trash mark and the tags of a mail, the nil fields are
+// left as they are.
+type MailFlags struct {
+	Seen    *bool `json:",omitempty"`
+	Starred *bool `json:",omitempty"`
+	Trashed *bool `json:",omitempty"`
+	// Tags replaces the tags when not nil, AddTags and RemoveTags are applied after it.
+	Tags       []string `json:",omitempty"`
+	AddTags    []string `json:",omitempty"`
+	RemoveTags []string `json:",omitempty"`
+}
+
+// apply changes the flags and the tags of the mail.
+func (f MailFlags) apply(mail *Mail) error {
+	tags := mail.Tags
+	if f.Tags != nil {
+		tags = nil
+	}
+	added, err := normalizeTags(append(append([]string{}, f.Tags...), f.AddTags...))
+	if err != nil {
+		return err
+	}
+	removed, err := normalizeTags(f.RemoveTags)
+	if err != nil {
+		return err
+	}
+	var changed Tags
+	for _, tag := range append(append(Tags{}, tags...), added...) {
+		if !changed.Has(tag) && !Tags(removed).Has(tag) {
+			changed = append(changed, tag)
+		}
+	}
+	mail.Tags = changed
+	if f.Seen != nil {
+		mail.Seen = *f.Seen
+	}
+	if f.Starred != nil {
+		mail.Starred = *f.Starred
+	}
+	if f.Trashed != nil {
+		mail.Trashed = *f.Trashed
+	}
+	return nil
+}
+
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || strings.ContainsAny(tag, " \t\r\n,\"") {
+			return nil, fmt.Errorf("invalid tag %q, tags can not be empty or contain white space, commas or quotes", tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	return normalized, nil
+}
+
+// TagRule tags the received mails matching all of its conditions.
+type TagRule struct {
+	Tag string
+	// RecipientDomain matches an envelope recipient or a To address in the domain or one of its subdomains.
+	RecipientDomain string
+	// SenderDomain matches the envelope sender or the From address the same way.
+	SenderDomain string
+	// Subject matches the subjects containing it, ignoring case.
+	Subject string
+	Headers []HeaderFilter
+}
+
+// ParseTagRule reads a rule given as TAG=CONDITION[,CONDITION...], the conditions being to-domain:DOMAIN,
+// from-domain:DOMAIN, subject:TEXT and header:Name[:Value]. For example billing=to-domain:shop.test,subject:invoice.
+func ParseTagRule(rule string) (TagRule, error) {
+	i := strings.Index(rule, "=")
+	if i < 0 {
+		return TagRule{}, fmt.Errorf("invalid tag rule %q, use TAG=CONDITION[,CONDITION...]", rule)
+	}
+	tags, err := normalizeTags([]string{rule[:i]})
+	if err != nil {
+		return TagRule{}, err
+	}
+	parsed := TagRule{Tag: tags[0]}
+	for _, condition := range strings.Split(rule[i+1:], ",") {
+		j := strings.Index(condition, ":")
+		if j < 0 {
+			return TagRule{}, fmt.Errorf("invalid condition %q of tag rule %q", condition, rule)
+		}
+		value := strings.TrimSpace(condition[j+1:])
+		switch strings.ToLower(strings.TrimSpace(condition[:j])) {
+		case "to-domain":
+			parsed.RecipientDomain = strings.ToLower(value)
+		case "from-domain":
+			parsed.SenderDomain = strings.ToLower(value)
+		case "subject":
+			parsed.Subject = value
+		case "header":
+			parsed.Headers = append(parsed.Headers, ParseHeaderFilter(value))
+		default:
+			return TagRule{}, fmt.Errorf("unknown condition %q of tag rule %q", condition, rule)
+		}
+	}
+	return parsed, nil
+}
+
+func (r TagRule) matches(m *Mail) bool {
+	var recipients, senders []string
+	if m.Envelope != nil {
+		senders = append(senders, m.Envelope.MailFrom)
+		for _, recipient := range m.Envelope.Recipients {
+			recipients = append(recipients, recipient.Address)
+		}
+	}
+	recipients = append(recipients, m.To...)
+	senders = append(senders, m.From)
+	if r.RecipientDomain != "" && !inDomain(recipients, r.RecipientDomain) {
+		return false
+	}
+	if r.SenderDomain != "" && !inDomain(senders, r.SenderDomain) {
+		return false
+	}
+	return containsFold(m.Subject, r.Subject) && hasHeaders(m, r.Headers)
+}
+
+// applyTagRules adds the tags of the rules matching the mail.
+func applyTagRules(m *Mail, rules []TagRule) {
+	for _, rule := range rules {
+		if rule.matches(m) && !m.Tags.Has(rule.Tag) {
+			m.Tags = append(m.Tags, rule.Tag)
+		}
+	}
+}
+
+func inDomain(addresses []string, domain string) bool {
+	for _, address := range addresses {
+		if parsed, err := mail.ParseAddress(address); err == nil {
+			address = parsed.Address
+		}
+		at := strings.LastIndex(address, "@")
+		if at < 0 {
+			continue
+		}
+		host := strings.ToLower(strings.TrimRight(address[at+1:], ">"))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseTagRule(t *testing.T) {
+	rule, err := ParseTagRule("Billing=to-domain:Shop.test, subject:invoice,header:X-Campaign-Id:42")
+	require.NoError(t, err)
+	assert.Equal(t, TagRule{
+		Tag:             "billing",
+		RecipientDomain: "shop.test",
+		Subject:         "invoice",
+		Headers:         []HeaderFilter{{Name: "X-Campaign-Id", Value: "42"}},
+	}, rule)
+
+	for _, invalid := range []string{"billing", "=to-domain:shop.test", "billing=shop.test", "billing=size:10"} {
+		_, err := ParseTagRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestApplyTagRules(t *testing.T) {
+	mail := &Mail{
+		From:     "Shop <no-reply@mail.shop.test>",
+		To:       Recipients{"Alice <alice@example.com>"},
+		Subject:  "Your invoice",
+		Envelope: &MailEnvelope{MailFrom: "bounce@relay.test", Recipients: []*EnvelopeRecipient{{Address: "bob@team.example.org"}}},
+	}
+	applyTagRules(mail, []TagRule{
+		{Tag: "shop", SenderDomain: "shop.test"},
+		{Tag: "relay", SenderDomain: "relay.test"},
+		{Tag: "team", RecipientDomain: "example.org"},
+		{Tag: "example", RecipientDomain: "example.com", Subject: "INVOICE"},
+		{Tag: "other", RecipientDomain: "ample.com"},
+		{Tag: "refund", Subject: "refund"},
+		{Tag: "shop", RecipientDomain: "example.com"},
+	})
+	assert.Equal(t, Tags{"shop", "relay", "team", "example"}, mail.Tags)
+}
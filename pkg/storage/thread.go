@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MessageIDs are message identifiers without their angle brackets, as listed by In-Reply-To and References.
+type MessageIDs []string
+
+func (m MessageIDs) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(m)
+	return string(bytes), err
+}
+
+func (m *MessageIDs) Scan(input interface{}) error {
+	switch value := input.(type) {
+	case string:
+		return json.Unmarshal([]byte(value), m)
+	case []byte:
+		return json.Unmarshal(value, m)
+	case nil:
+		*m = nil
+		return nil
+	default:
+		return errors.New("unsupported type")
+	}
+}
+
+func (MessageIDs) GormDataType() string {
+	return "text"
+}
+
+// parseMessageIDs returns the <id> tokens of a header field. Values without angle brackets, which
+// some mailers write, are taken word by word.
+func parseMessageIDs(value string) MessageIDs {
+	var ids MessageIDs
+	for {
+		start := strings.Index(value, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(value[start:], ">")
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+	if len(ids) == 0 {
+		for _, word := range strings.Fields(value) {
+			if strings.Contains(word, "@") {
+				ids = append(ids, word)
+			}
+		}
+	}
+	return ids
+}
+
+// normalizeMessageID drops the angle brackets and white space around a Message-ID header.
+func normalizeMessageID(value string) string {
+	if ids := parseMessageIDs(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return strings.TrimSpace(value)
+}
+
+// Thread is a conversation: the messages linked by their In-Reply-To and References fields.
+type Thread struct {
+	// Subject is the subject of the first message of the thread that was received.
+	Subject  string
+	Messages int
+	// LastReceived is when the latest message of the thread was received.
+	LastReceived time.Time
+	Root         *ThreadNode
+}
+
+// ThreadNode is a message of a thread with its replies, oldest first.
+type ThreadNode struct {
+	MessageID string
+	// Mail is nil for a message that was referenced but not received.
+	Mail    *Mail         `json:",omitempty"`
+	Replies []*ThreadNode `json:",omitempty"`
+
+	parent *ThreadNode
+}
+
+// BuildThreads threads the mails as described by Jamie Zawinski (https://www.jwz.org/doc/threading.html),
+// without grouping the threads by subject so that replies with broken headers stand out. The threads are
+// sorted by their latest message, newest first.
+func BuildThreads(mails []Mail) []Thread {
+	nodes := make(map[string]*ThreadNode)
+	node := func(id string) *ThreadNode {
+		if existing, ok := nodes[id]; ok {
+			return existing
+		}
+		created := &ThreadNode{MessageID: id}
+		nodes[id] = created
+		return created
+	}
+	var all []*ThreadNode
+	for i := range mails {
+		mail := &mails[i]
+		id := normalizeMessageID(mail.MessageID)
+		if id == "" {
+			id = fmt.Sprintf("mail-%d", mail.ID)
+		}
+		current := node(id)
+		if current.Mail != nil {
+			// a duplicate Message-ID gets a node of its own
+			current = &ThreadNode{MessageID: id}
+		}
+		current.Mail = mail
+		all = append(all, current)
+
+		references := append(MessageIDs{}, mail.References...)
+		if mail.InReplyTo != "" && (len(references) == 0 || references[len(references)-1] != mail.InReplyTo) {
+			references = append(references, mail.InReplyTo)
+		}
+		var parent *ThreadNode
+		for _, reference := range references {
+			next := node(reference)
+			if parent != nil && next.parent == nil && next != parent && !next.isAncestorOf(parent) {
+				parent.adopt(next)
+			}
+			parent = next
+		}
+		// the references of the message itself are trusted over the ones other messages gave for it
+		if current.parent != nil {
+			current.parent.orphan(current)
+		}
+		if parent != nil && parent != current && !current.isAncestorOf(parent) {
+			parent.adopt(current)
+		}
+	}
+	for _, n := range nodes {
+		all = append(all, n)
+	}
+
+	var roots []*ThreadNode
+	seen := make(map[*ThreadNode]bool)
+	for _, n := range all {
+		if n.parent == nil && !seen[n] {
+			seen[n] = true
+			roots = append(roots, n)
+		}
+	}
+	var pruned []*ThreadNode
+	for _, root := range roots {
+		root.prune()
+		switch {
+		case root.Mail == nil && len(root.Replies) == 0:
+		case root.Mail == nil && len(root.Replies) == 1:
+			// a missing root with a single reply is not worth showing
+			root.Replies[0].parent = nil
+			pruned = append(pruned, root.Replies[0])
+		default:
+			pruned = append(pruned, root)
+		}
+	}
+
+	threads := make([]Thread, 0, len(pruned))
+	for _, root := range pruned {
+		root.sort()
+		thread := Thread{Root: root}
+		root.walk(func(n *ThreadNode) {
+			if n.Mail == nil {
+				return
+			}
+			if thread.Messages == 0 {
+				thread.Subject = n.Mail.Subject
+			}
+			thread.Messages++
+			if n.Mail.CreatedAt.After(thread.LastReceived) {
+				thread.LastReceived = n.Mail.CreatedAt
+			}
+		})
+		threads = append(threads, thread)
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		if !threads[i].LastReceived.Equal(threads[j].LastReceived) {
+			return threads[i].LastReceived.After(threads[j].LastReceived)
+		}
+		return threads[i].Root.firstID() > threads[j].Root.firstID()
+	})
+	return threads
+}
+
+// threadID names the thread of a mail by the first message it references, or by its own Message-ID when it
+// starts a thread, so the mails of a conversation are looked up without threading every mail. Mails without
+// any Message-ID are threads of their own, named after their ID. joinThread keeps the name of the thread
+// of the stored messages it replies to instead.
+func threadID(mail *Mail) string {
+	if id := referencedThreadID(mail); id != "" {
+		return id
+	}
+	return fmt.Sprintf("mail-%d", mail.ID)
+}
+
+// referencedThreadID is the thread ID given by the Message-ID, In-Reply-To and References fields, if any.
+func referencedThreadID(mail *Mail) string {
+	switch {
+	case len(mail.References) > 0:
+		return mail.References[0]
+	case mail.InReplyTo != "":
+		return mail.InReplyTo
+	}
+	return normalizeMessageID(mail.MessageID)
+}
+
+// joinThread names the thread of a mail about to be stored after the stored messages it references, the first
+// one found in the order of References. The mail is left without a thread ID when it has no Message-ID at all.
+// It returns the threads that join the thread of the mail: those of the other messages it references and the
+// one named after its own Message-ID, which the replies received before it started.
+func joinThread(store MailStore, mail *Mail) ([]string, error) {
+	mail.ThreadID = referencedThreadID(mail)
+	references := append(MessageIDs{}, mail.References...)
+	if mail.InReplyTo != "" && !containsString(references, mail.InReplyTo) {
+		references = append(references, mail.InReplyTo)
+	}
+	var joined []string
+	if len(references) > 0 {
+		page, err := store.FindMails(MailQuery{MessageIDs: references})
+		if err != nil {
+			return nil, err
+		}
+		threads := make(map[string]string)
+		for _, parent := range page.Mails {
+			threads[normalizeMessageID(parent.MessageID)] = parent.ThreadID
+		}
+		for _, reference := range references {
+			if thread, ok := threads[reference]; ok {
+				mail.ThreadID = thread
+				break
+			}
+		}
+		for _, parent := range page.Mails {
+			if parent.ThreadID != mail.ThreadID && !containsString(joined, parent.ThreadID) {
+				joined = append(joined, parent.ThreadID)
+			}
+		}
+	}
+	if own := normalizeMessageID(mail.MessageID); own != "" && own != mail.ThreadID && !containsString(joined, own) {
+		joined = append(joined, own)
+	}
+	return joined, nil
+}
+
+// nameThreads sets the thread ID of mails stored before they were threaded, naming each thread after its root
+// as joinThread does.
+func nameThreads(mails []*Mail) {
+	list := make([]Mail, len(mails))
+	for i, mail := range mails {
+		list[i] = *mail
+	}
+	names := make(map[uint]string)
+	for _, thread := range BuildThreads(list) {
+		name := thread.Root.MessageID
+		if thread.Root.Mail != nil {
+			// the root may be a reply to messages that were not received
+			name = threadID(thread.Root.Mail)
+		}
+		thread.Root.walk(func(n *ThreadNode) {
+			if n.Mail != nil {
+				names[n.Mail.ID] = name
+			}
+		})
+	}
+	for _, mail := range mails {
+		mail.ThreadID = names[mail.ID]
+	}
+}
+
+// ThreadPage is a page of threads, Total counts the threads on all pages.
+type ThreadPage struct {
+	Threads []Thread
+	Total   int
+}
+
+// findThreads pages the threads of the mails matching the query for the backends keeping the mails in memory.
+func findThreads(store MailStore, query MailQuery) (*ThreadPage, error) {
+	offset, limit := query.Offset, query.Limit
+	query.Sort, query.Descending, query.Cursor, query.Offset, query.Limit = SortReceived, true, "", 0, 0
+	page, err := store.FindMails(query)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, mail := range page.Mails {
+		if !seen[mail.ThreadID] {
+			seen[mail.ThreadID] = true
+			ids = append(ids, mail.ThreadID)
+		}
+	}
+	return loadThreads(store, query.Mailbox, ids, offset, limit)
+}
+
+// loadThreads threads the mails of the page of thread IDs, which are ordered by their latest mail.
+func loadThreads(store MailStore, mailbox string, ids []string, offset, limit int) (*ThreadPage, error) {
+	threads := &ThreadPage{Threads: []Thread{}, Total: len(ids)}
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	ids = ids[offset:]
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	if len(ids) == 0 {
+		return threads, nil
+	}
+	page, err := store.FindMails(MailQuery{ThreadIDs: ids, Mailbox: mailbox})
+	if err != nil {
+		return nil, err
+	}
+	threads.Threads = BuildThreads(page.Mails)
+	return threads, nil
+}
+
+// GetThread returns the thread of the mail, threading only the mails sharing its thread ID. An empty mailbox
+// gives the mails of every mailbox.
+func GetThread(store MailStore, mailID uint, mailbox string) (*Thread, error) {
+	mail, err := store.GetMail(mailID)
+	if err != nil {
+		return nil, err
+	}
+	page, err := store.FindMails(MailQuery{ThreadIDs: []string{mail.ThreadID}, Mailbox: mailbox})
+	if err != nil {
+		return nil, err
+	}
+	thread, ok := FindThread(BuildThreads(page.Mails), mailID)
+	if !ok {
+		return nil, fmt.Errorf("mail %d not found", mailID)
+	}
+	return thread, nil
+}
+
+// FindThread returns the thread containing the mail.
+func FindThread(threads []Thread, mailID uint) (*Thread, bool) {
+	for i := range threads {
+		found := false
+		threads[i].Root.walk(func(n *ThreadNode) {
+			found = found || (n.Mail != nil && n.Mail.ID == mailID)
+		})
+		if found {
+			return &threads[i], true
+		}
+	}
+	return nil, false
+}
+
+func (n *ThreadNode) adopt(child *ThreadNode) {
+	child.parent = n
+	n.Replies = append(n.Replies, child)
+}
+
+func (n *ThreadNode) orphan(child *ThreadNode) {
+	for i, reply := range n.Replies {
+		if reply == child {
+			n.Replies = append(n.Replies[:i], n.Replies[i+1:]...)
+			break
+		}
+	}
+	child.parent = nil
+}
+
+func (n *ThreadNode) isAncestorOf(other *ThreadNode) bool {
+	for p := other; p != nil; p = p.parent {
+		if p == n {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops the missing messages without replies and puts the replies of the other missing
+// messages in their place.
+func (n *ThreadNode) prune() {
+	var replies []*ThreadNode
+	for _, reply := range n.Replies {
+		reply.prune()
+		if reply.Mail != nil {
+			replies = append(replies, reply)
+			continue
+		}
+		for _, grandchild := range reply.Replies {
+			grandchild.parent = n
+			replies = append(replies, grandchild)
+		}
+	}
+	n.Replies = replies
+}
+
+func (n *ThreadNode) sort() {
+	sort.SliceStable(n.Replies, func(i, j int) bool {
+		return n.Replies[i].firstID() < n.Replies[j].firstID()
+	})
+	for _, reply := range n.Replies {
+		reply.sort()
+	}
+}
+
+// firstID is the ID of the first mail received in the subtree, mail IDs grow in the order mails are received.
+func (n *ThreadNode) firstID() uint {
+	var first uint
+	n.walk(func(node *ThreadNode) {
+		if node.Mail != nil && (first == 0 || node.Mail.ID < first) {
+			first = node.Mail.ID
+		}
+	})
+	return first
+}
+
+func (n *ThreadNode) walk(visit func(n *ThreadNode)) {
+	visit(n)
+	for _, reply := range n.Replies {
+		reply.walk(visit)
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseMessageIDs(t *testing.T) {
+	assert.Equal(t, MessageIDs{"a@x", "b@y"}, parseMessageIDs("<a@x>\r\n\t<b@y> (comment)"))
+	assert.Equal(t, MessageIDs{"a@x"}, parseMessageIDs("a@x"))
+	assert.Empty(t, parseMessageIDs("your message of yesterday"))
+	assert.Equal(t, "a@x", normalizeMessageID(" <a@x> "))
+}
+
+func TestBuildThreads(t *testing.T) {
+	received := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mails []Mail
+	add := func(messageID, subject, inReplyTo string, references ...string) {
+		mail := Mail{MessageID: "<" + messageID + ">", Subject: subject, InReplyTo: inReplyTo, References: references}
+		mail.ID = uint(len(mails) + 1)
+		mail.CreatedAt = received.Add(time.Duration(len(mails)) * time.Minute)
+		mails = append(mails, mail)
+	}
+	// replies may arrive before the messages they reply to
+	add("r2@x", "Re: Re: Order", "r1@x", "order@x", "r1@x")
+	add("order@x", "Order", "")
+	add("r1@x", "Re: Order", "order@x", "order@x")
+	add("r3@x", "Re: Order", "", "order@x")
+	// the root of this one was never received, its replies are kept together under it
+	add("a@x", "Re: Lost", "lost@x", "lost@x")
+	add("b@x", "Re: Lost", "", "lost@x")
+	// a reply to a missing message alone is its own thread
+	add("c@x", "Re: Gone", "gone@x")
+	// a reply without threading headers is not put into the thread of its subject
+	add("d@x", "Re: Order", "")
+	// references making a loop are ignored
+	add("loop1@x", "Loop", "loop2@x")
+	add("loop2@x", "Loop", "loop1@x")
+
+	threads := BuildThreads(mails)
+	require.Equal(t, 5, len(threads))
+
+	loop := threads[0]
+	assert.Equal(t, "Loop", loop.Subject)
+	assert.Equal(t, 2, loop.Messages)
+	assert.Equal(t, received.Add(9*time.Minute), loop.LastReceived)
+
+	assert.Equal(t, "d@x", threads[1].Root.MessageID)
+	assert.Equal(t, "c@x", threads[2].Root.MessageID)
+	assert.Empty(t, threads[2].Root.Replies)
+
+	lost := threads[3]
+	assert.Equal(t, "lost@x", lost.Root.MessageID)
+	assert.Nil(t, lost.Root.Mail)
+	assert.Equal(t, "Re: Lost", lost.Subject)
+	require.Equal(t, 2, len(lost.Root.Replies))
+	assert.Equal(t, "a@x", lost.Root.Replies[0].MessageID)
+
+	order := threads[4]
+	assert.Equal(t, "Order", order.Subject)
+	assert.Equal(t, 4, order.Messages)
+	assert.Equal(t, "order@x", order.Root.MessageID)
+	require.Equal(t, 2, len(order.Root.Replies))
+	r2, r3 := order.Root.Replies[0], order.Root.Replies[1]
+	assert.Equal(t, "r1@x", r2.MessageID)
+	assert.Equal(t, "r3@x", r3.MessageID)
+	require.Equal(t, 1, len(r2.Replies))
+	assert.Equal(t, "r2@x", r2.Replies[0].MessageID)
+
+	found, ok := FindThread(threads, 1)
+	require.True(t, ok)
+	assert.Equal(t, "order@x", found.Root.MessageID)
+	_, ok = FindThread(threads, 100)
+	assert.False(t, ok)
+}
+
+func TestBuildThreads_DuplicateMessageID(t *testing.T) {
+	first := Mail{MessageID: "<same@x>", Subject: "First"}
+	first.ID = 1
+	second := Mail{MessageID: "<same@x>", Subject: "Second"}
+	second.ID = 2
+	reply := Mail{MessageID: "<reply@x>", Subject: "Re: First", InReplyTo: "same@x"}
+	reply.ID = 3
+	threads := BuildThreads([]Mail{first, second, reply})
+	require.Equal(t, 2, len(threads))
+	subjects := []string{threads[0].Subject, threads[1].Subject}
+	assert.ElementsMatch(t, []string{"First", "Second"}, subjects)
+	thread, ok := FindThread(threads, 3)
+	require.True(t, ok)
+	assert.Equal(t, "First", thread.Subject)
+}
+
+func TestNameThreads(t *testing.T) {
+	mails := []*Mail{
+		{MessageID: "<c@x>", InReplyTo: "b@x"},
+		{MessageID: "<b@x>", InReplyTo: "a@x", References: MessageIDs{"a@x"}},
+		{MessageID: "<other@x>"},
+		{Subject: "no id"},
+	}
+	for i, mail := range mails {
+		mail.ID = uint(i + 1)
+	}
+	nameThreads(mails)
+	assert.Equal(t, "a@x", mails[0].ThreadID)
+	assert.Equal(t, "a@x", mails[1].ThreadID)
+	assert.Equal(t, "other@x", mails[2].ThreadID)
+	assert.Equal(t, "mail-4", mails[3].ThreadID)
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/ajanthan/smtp-go/pkg/smtp"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Transcript is the recorded conversation of an SMTP session. Mails link to it through SessionID.
+type Transcript struct {
+	gorm.Model
+	SessionID     string `gorm:"uniqueIndex"`
+	ClientAddress string
+	StartedAt     time.Time
+	EndedAt       time.Time
+	Entries       TranscriptEntries `sql:"type:text"`
+}
+
+type TranscriptEntries []smtp.TranscriptEntry
+
+func (e TranscriptEntries) Value() (driver.Value, error) {
+	bytes, err := json.Marshal(e)
+	return string(bytes), err
+}
+
+func (e *TranscriptEntries) Scan(input interface{}) error {
+	switch value := input.(type) {
+	case string:
+		return json.Unmarshal([]byte(value), e)
+	case []byte:
+		return json.Unmarshal(value, e)
+	default:
+		return errors.New("unsupported type")
+	}
+}
+
+func (t Transcript) ToSMTP() *smtp.Transcript {
+	return &smtp.Transcript{
+		SessionID:     t.SessionID,
+		ClientAddress: t.ClientAddress,
+		StartedAt:     t.StartedAt,
+		EndedAt:       t.EndedAt,
+		Entries:       t.Entries,
+	}
+}
+
+func (s GormStorage) PersistTranscript(transcript *Transcript) error {
+	return s.Db.Create(transcript).Error
+}
+
+func (s GormStorage) GetTranscriptBySessionID(sessionID string) (*Transcript, error) {
+	var transcript Transcript
+	tx := s.Db.Where("session_id=?", sessionID).Find(&transcript)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, fmt.Errorf("no transcript is recorded for session %s", sessionID)
+	}
+	return &transcript, nil
+}
+
+// GetTranscriptByMailID returns the transcript of the session the mail was received in.
+func (s GormStorage) GetTranscriptByMailID(mailID uint) (*Transcript, error) {
+	var mail Mail
+	if err := s.Db.Select("id", "session_id").First(&mail, mailID).Error; err != nil {
+		return nil, err
+	}
+	if mail.SessionID == "" {
+		return nil, fmt.Errorf("no transcript is recorded for mail %d", mailID)
+	}
+	return s.GetTranscriptBySessionID(mail.SessionID)
+}
+
+func (p *DBReceiver) ReceiveTranscript(transcript *smtp.Transcript) error {
+	return p.Storage.PersistTranscript(newTranscript(transcript))
+}
+
+func newTranscript(transcript *smtp.Transcript) *Transcript {
+	return &Transcript{
+		SessionID:     transcript.SessionID,
+		ClientAddress: transcript.ClientAddress,
+		StartedAt:     transcript.StartedAt,
+		EndedAt:       transcript.EndedAt,
+		Entries:       transcript.Entries,
+	}
+}
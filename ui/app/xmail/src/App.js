@@ -1,31 +1,52 @@
-import React, { Fragment } from 'react';
+import React, { Fragment, useState } from 'react';
 import {Grid, Input, Menu} from 'semantic-ui-react';
 
 import Mails from "./Mails";
+import Sessions from "./Sessions";
+import Threads from "./Threads";
 import Header from "./Header";
 
-const App = () => (
+const App = () => {
+  const [auth,setAuth]=useState(null)
+  const [view,setView]=useState('mail')
+  const [search,setSearch]=useState('')
+  return (
     <Fragment>
-        <Header />
+        <Header auth={auth} onLogin={setAuth} onLogout={()=>setAuth(null)} />
         <Grid container columns={2}>
             <Grid.Row>
                 <Grid.Column width={4}>
         <Menu vertical>
             <Menu.Item>
-                <Input placeholder='Search...' />
+                <Input icon='search' placeholder='Search...' onKeyPress={(event)=>{
+                    if (event.key === 'Enter') {
+                        setSearch(event.target.value.trim());
+                        setView('mail');
+                    }
+                }} />
             </Menu.Item>
             <Menu.Item
-                name='Mail'>
-                Mail
+                name='Mail' active={view === 'mail'} onClick={()=>setView('mail')}>
+                {auth ? 'My Mailbox' : 'Mail'}
+            </Menu.Item>
+            <Menu.Item
+                name='Threads' active={view === 'threads'} onClick={()=>setView('threads')}>
+                Threads
+            </Menu.Item>
+            <Menu.Item
+                name='Failed sessions' active={view === 'sessions'} onClick={()=>setView('sessions')}>
+                Failed sessions
             </Menu.Item>
         </Menu>
                 </Grid.Column>
                 <Grid.Column width={12}>
-            <Mails />
+            {view === 'mail' ? <Mails auth={auth} search={search} /> :
+                view === 'threads' ? <Threads auth={auth} /> : <Sessions auth={auth} />}
                 </Grid.Column>
             </Grid.Row>
         </Grid>
     </Fragment>
-);
+  );
+}
 
 export default App;
\ No newline at end of file
@@ -1,8 +1,27 @@
-import React from 'react';
-import {Container, Icon,Menu} from 'semantic-ui-react';
+import React,{useState} from 'react';
+import {Button, Container, Form, Icon, Menu, Message, Modal} from 'semantic-ui-react';
 
+const authHeader = (username, password) => 'Basic ' + btoa(username + ':' + password)
 
-const Header= () =>{
+const Header= ({auth,onLogin,onLogout}) =>{
+   const [open,setOpen]=useState(false)
+   const [username,setUsername]=useState('')
+   const [password,setPassword]=useState('')
+   const [error,setError]=useState(null)
+   const login = () => {
+       const header = authHeader(username, password)
+       fetch('http://localhost:8085/mail', {headers: {Authorization: header}})
+           .then(response => {
+               if (!response.ok) {
+                   setError('Invalid username or password')
+                   return
+               }
+               onLogin({username: username, header: header})
+               setPassword('')
+               setError(null)
+               setOpen(false)
+           })
+   }
    return( <Menu>
         <Container>
             <Menu.Item as="a" header>
@@ -13,15 +32,30 @@ const Header= () =>{
             </Menu.Item>
 
             <Menu.Menu position="right">
-                <Menu.Item as="a" name="login">
-                    Login
-                </Menu.Item>
+                {auth ?
+                    <Menu.Item as="a" name="logout" onClick={onLogout}>
+                        Logout {auth.username}
+                    </Menu.Item> :
+                    <Menu.Item as="a" name="login" onClick={()=>setOpen(true)}>
+                        Login
+                    </Menu.Item>}
 
                 <Menu.Item as="a" name="register">
                     Register
                 </Menu.Item>
             </Menu.Menu>
         </Container>
+        <Modal size='mini' open={open} onClose={()=>setOpen(false)}>
+            <Modal.Header>Login</Modal.Header>
+            <Modal.Content>
+                <Form error={error !== null} onSubmit={login}>
+                    <Form.Input label='Username' value={username} onChange={(e,{value})=>setUsername(value)} />
+                    <Form.Input label='Password' type='password' value={password} onChange={(e,{value})=>setPassword(value)} />
+                    <Message error content={error} />
+                    <Button primary type='submit'>Login</Button>
+                </Form>
+            </Modal.Content>
+        </Modal>
     </Menu>)
 }
 export default Header;
\ No newline at end of file
@@ -1,32 +1,51 @@
 import React,{useState,useEffect} from 'react'
-import {Container, Header, Table, List, Portal, Segment, Button, Label} from 'semantic-ui-react'
+import {Container, Header, Table, List, Portal, Segment, Button, Label, Icon} from 'semantic-ui-react'
 
-function Mails() {
+function Mails({auth,search}) {
   const [mails,setMails]=useState(new Map())
   const [open,setOpen]=useState(false)
   const [mail,setMailContent]=useState({})
+  const headers = auth ? {Authorization: auth.header} : {}
   useEffect(()=>{
-    fetch('http://localhost:8085/mail')
+    const url = search ? 'http://localhost:8085/search?q='+encodeURIComponent(search) : 'http://localhost:8085/mail'
+    fetch(url, {headers: auth ? {Authorization: auth.header} : {}})
         .then(response => response.json())
         .then(data => {
             let mailMap = new Map();
-            data.map( (mail)=> mailMap.set(mail.ID,mail));
+            (Array.isArray(data) ? data : []).map( (mail)=> mailMap.set(mail.ID,mail));
             setMails(mailMap);
         })
-  },[])
+  },[auth,search])
+  const patch=(mail,flags)=>{
+    fetch('http://localhost:8085/mail/'+mail.ID, {
+        method: 'PATCH',
+        headers: {...headers, 'Content-Type': 'application/json'},
+        body: JSON.stringify(flags)})
+        .then(response => response.json())
+        .then(updated => {
+            if (updated.ID) {
+                setMails(prevMails => new Map(prevMails).set(updated.ID,updated));
+            }
+        })
+  }
   return (
         <Container style={{ margin: 0 }}>
-          <Header as='h2'>Mails</Header>
+          <Header as='h2'>{search ? 'Search results' : 'Mails'}</Header>
           <List divided relaxed>
             {[...mails.values()].map((mail)=>
             <List.Item key={mail.ID} onClick={()=> {
-                fetch('http://localhost:8085/mail/'+mail.ID+'/content')
+                if (!mail.Seen) {
+                    patch(mail,{Seen:true});
+                }
+                fetch('http://localhost:8085/mail/'+mail.ID+'/content', {headers: headers})
                     .then(response => {
                         setMailContent({
                         Subject:mail.Subject,
                         To:mail.To,
                         From:mail.From,
                         Date:mail.Date,
+                        TLS:mail.TLS,
+                        Envelope:mail.Envelope,
                         isHtml:response.headers.get('Content-Type').startsWith('text/html')});
                         return response.text();
                     })
@@ -35,10 +54,19 @@ function Mails() {
                      );
                 setOpen(true);
             }}>
-                <List.Icon name='mail' size='large' verticalAlign='middle' />
+                <List.Icon name={mail.Seen ? 'mail outline' : 'mail'} size='large' verticalAlign='middle' />
+              <List.Content floated='right'>
+                <Icon link name={mail.Starred ? 'star' : 'star outline'} color={mail.Starred ? 'yellow' : undefined}
+                      onClick={(event)=>{
+                          event.stopPropagation();
+                          patch(mail,{Starred:!mail.Starred});
+                      }} />
+              </List.Content>
               <List.Content>
-                <List.Header as='a'>{mail.Subject}</List.Header>
+                <List.Header as='a' style={{fontWeight: mail.Seen ? 'normal' : 'bold'}}>{mail.Subject}</List.Header>
                 <List.Description as='a'>from: {mail.From}</List.Description>
+                {(mail.Tags || []).map((tag)=> <Label key={tag} size='mini'>{tag}</Label>)}
+                {mail.Duplicates > 0 && <Label size='mini' color='orange'>delivered {mail.Duplicates + 1} times</Label>}
               </List.Content>
             </List.Item>
                   )}
@@ -77,6 +105,38 @@ function Mails() {
                                 </Table.Cell>
                                 <Table.Cell>{mail.Date}</Table.Cell>
                             </Table.Row>
+                            <Table.Row>
+                                <Table.Cell>
+                                <Label>TLS</Label>
+                                </Table.Cell>
+                                <Table.Cell>
+                                    { mail.TLS && mail.TLS.Version ?
+                                        <span>
+                                            {mail.TLS.Version} {mail.TLS.CipherSuite}
+                                            {mail.TLS.ServerName && <span> (SNI {mail.TLS.ServerName})</span>}
+                                            {mail.TLS.ClientCertificate && <span>, client {mail.TLS.ClientCertificate}</span>}
+                                        </span> :
+                                        'none'}
+                                </Table.Cell>
+                            </Table.Row>
+                            { mail.Envelope &&
+                            <Table.Row>
+                                <Table.Cell>
+                                <Label>Envelope</Label>
+                                </Table.Cell>
+                                <Table.Cell>
+                                    <List>
+                                        <List.Item>MAIL FROM: &lt;{mail.Envelope.MailFrom}&gt; {mail.Envelope.MailParams}</List.Item>
+                                        {(mail.Envelope.Recipients || []).map((rcpt)=>
+                                            <List.Item key={rcpt.ID}>RCPT TO: &lt;{rcpt.Address}&gt; {rcpt.Params}</List.Item>
+                                        )}
+                                        <List.Item>HELO: {mail.Envelope.Helo}</List.Item>
+                                        <List.Item>Client: {mail.Envelope.ClientAddress}</List.Item>
+                                        {mail.Envelope.AuthUser && <List.Item>Authenticated as: {mail.Envelope.AuthUser}</List.Item>}
+                                        <List.Item>Received at: {mail.Envelope.ReceivedAt}</List.Item>
+                                    </List>
+                                </Table.Cell>
+                            </Table.Row>}
                             <Table.Row>
                                 <Table.Cell/>
                                 <Table.Cell>
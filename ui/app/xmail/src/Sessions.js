@@ -0,0 +1,78 @@
+import React,{useState,useEffect} from 'react'
+import {Button, Container, Header, Label, Portal, Segment, Table} from 'semantic-ui-react'
+
+const outcomeColors = {failed: 'red', rejected: 'orange', aborted: 'yellow'}
+
+function Sessions({auth}) {
+  const [sessions,setSessions]=useState([])
+  const [open,setOpen]=useState(false)
+  const [transcript,setTranscript]=useState(null)
+  const headers = auth ? {Authorization: auth.header} : {}
+  useEffect(()=>{
+    fetch('http://localhost:8085/sessions', {headers: auth ? {Authorization: auth.header} : {}})
+        .then(response => response.json())
+        .then(data => setSessions(Array.isArray(data) ? data : []))
+  },[auth])
+  const showTranscript = (session) => {
+      fetch('http://localhost:8085/sessions/'+session.SessionID+'/transcript', {headers: headers})
+          .then(response => response.ok ? response.json() : null)
+          .then(data => setTranscript(data))
+      setOpen(true)
+  }
+  return (
+        <Container style={{ margin: 0 }}>
+          <Header as='h2'>Failed sessions</Header>
+          <Table selectable>
+              <Table.Header>
+                  <Table.Row>
+                      <Table.HeaderCell>Started</Table.HeaderCell>
+                      <Table.HeaderCell>Outcome</Table.HeaderCell>
+                      <Table.HeaderCell>Client</Table.HeaderCell>
+                      <Table.HeaderCell>Envelope</Table.HeaderCell>
+                      <Table.HeaderCell>Reason</Table.HeaderCell>
+                  </Table.Row>
+              </Table.Header>
+              <Table.Body>
+                  {sessions.map((session)=>
+                  <Table.Row key={session.ID} onClick={()=>showTranscript(session)}>
+                      <Table.Cell>{session.StartedAt}</Table.Cell>
+                      <Table.Cell><Label color={outcomeColors[session.Outcome]}>{session.Outcome}</Label></Table.Cell>
+                      <Table.Cell>
+                          {session.Helo} {session.ClientAddress}
+                          {session.Username && <span> as {session.Username}</span>}
+                      </Table.Cell>
+                      <Table.Cell>
+                          {session.MailFrom && <span>&lt;{session.MailFrom}&gt; to {(session.Recipients || []).join(', ')}</span>}
+                      </Table.Cell>
+                      <Table.Cell>{session.Reason}</Table.Cell>
+                  </Table.Row>
+                  )}
+              </Table.Body>
+          </Table>
+            <Portal onClose={()=>setOpen(false)} open={open}>
+                <Segment
+                    style={{
+                        left: '30%',
+                        position: 'fixed',
+                        top: '8%',
+                        zIndex: 1000,
+                        overflow: 'auto',
+                        maxHeight: '90%',
+                    }}
+                >
+                    <Header>Transcript</Header>
+                    { transcript ?
+                        <pre>{(transcript.Entries || []).map((entry)=> entry.Direction+': '+entry.Line).join('\n')}</pre> :
+                        'no transcript recorded'}
+                    <Button
+                        content='Close'
+                        negative
+                        onClick={()=>setOpen(false)}
+                    />
+                </Segment>
+            </Portal>
+        </Container>
+  );
+}
+
+export default Sessions;
@@ -0,0 +1,71 @@
+import React,{useState,useEffect} from 'react'
+import {Button, Container, Header, List, Portal, Segment} from 'semantic-ui-react'
+
+function ThreadNode({node}) {
+  return (
+      <List.Item>
+          <List.Icon name={node.Mail ? 'mail outline' : 'question'} />
+          <List.Content>
+              {node.Mail ?
+                  <List.Header as='a' href={'http://localhost:8085/mail/'+node.Mail.ID+'/content'} target='_blank'>
+                      {node.Mail.Subject}
+                  </List.Header> :
+                  <List.Header>&lt;{node.MessageID}&gt; not received</List.Header>}
+              {node.Mail && <List.Description>from: {node.Mail.From}</List.Description>}
+              {node.Replies && <List.List>{node.Replies.map((reply,i)=> <ThreadNode key={i} node={reply} />)}</List.List>}
+          </List.Content>
+      </List.Item>
+  )
+}
+
+function Threads({auth}) {
+  const [threads,setThreads]=useState([])
+  const [open,setOpen]=useState(false)
+  const [thread,setThread]=useState(null)
+  useEffect(()=>{
+    fetch('http://localhost:8085/threads', {headers: auth ? {Authorization: auth.header} : {}})
+        .then(response => response.json())
+        .then(data => setThreads(Array.isArray(data) ? data : []))
+  },[auth])
+  return (
+        <Container style={{ margin: 0 }}>
+          <Header as='h2'>Threads</Header>
+          <List divided relaxed>
+              {threads.map((thread,i)=>
+              <List.Item key={i} onClick={()=>{
+                  setThread(thread);
+                  setOpen(true);
+              }}>
+                  <List.Icon name='comments outline' size='large' verticalAlign='middle' />
+                  <List.Content>
+                      <List.Header as='a'>{thread.Subject}</List.Header>
+                      <List.Description as='a'>{thread.Messages} messages, last {thread.LastReceived}</List.Description>
+                  </List.Content>
+              </List.Item>
+              )}
+          </List>
+            <Portal onClose={()=>setOpen(false)} open={open}>
+                <Segment
+                    style={{
+                        left: '30%',
+                        position: 'fixed',
+                        top: '8%',
+                        zIndex: 1000,
+                        overflow: 'auto',
+                        maxHeight: '90%',
+                    }}
+                >
+                    <Header>{thread && thread.Subject}</Header>
+                    {thread && <List><ThreadNode node={thread.Root} /></List>}
+                    <Button
+                        content='Close'
+                        negative
+                        onClick={()=>setOpen(false)}
+                    />
+                </Segment>
+            </Portal>
+        </Container>
+  );
+}
+
+export default Threads;